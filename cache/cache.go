@@ -2,6 +2,7 @@ package cache
 
 import (
 	"context"
+	"time"
 
 	"github.com/redis/go-redis/v9"
 )
@@ -36,3 +37,50 @@ func Get(key string) string {
 func Set(key string, value string) error {
 	return Client.Set(ctx, key, value, 0).Err()
 }
+
+// Ready reports whether Init has been called
+func Ready() bool {
+	return Client != nil
+}
+
+// SetEx stores value under key for the given duration
+func SetEx(key string, value string, ttl time.Duration) error {
+	return Client.Set(ctx, key, value, ttl).Err()
+}
+
+// Del removes the given keys
+func Del(keys ...string) error {
+	return Client.Del(ctx, keys...).Err()
+}
+
+// SetNX stores value under key for the given duration unless the key exists,
+// and reports whether it was stored
+func SetNX(key string, value string, ttl time.Duration) (bool, error) {
+	return Client.SetNX(ctx, key, value, ttl).Result()
+}
+
+// HGet returns the value of field in the hash at key, or "" if there is none
+func HGet(key string, field string) string {
+	val, err := Client.HGet(ctx, key, field).Result()
+	if err != nil {
+		return ""
+	}
+	return val
+}
+
+// HSetEx sets field of the hash at key and lets the whole hash expire after
+// the given duration
+func HSetEx(key string, field string, value string, ttl time.Duration) error {
+	_, err := Client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, key, field, value)
+		pipe.Expire(ctx, key, ttl)
+		return nil
+	})
+	return err
+}
+
+// Exists reports whether key exists
+func Exists(key string) (bool, error) {
+	n, err := Client.Exists(ctx, key).Result()
+	return n > 0, err
+}
@@ -0,0 +1,91 @@
+// Command replay sends the requests of a forward recording again, for example
+// to a staging RuoYi, and reports where the responses differ from the
+// recorded ones. It exits with status 1 when any do.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"e.coding.net/Love54dj/weizhong/etc/forward"
+)
+
+func main() {
+	file := flag.String("file", "", "recording file (JSONL), - for stdin")
+	upstream := flag.String("upstream", "", "base URL to send the requests to")
+	viaProxy := flag.Bool("via-proxy", false, "send the client URIs, for replaying against a forward proxy")
+	token := flag.String("token", "", "Authorization header replacing the redacted one, e.g. \"Bearer ...\"")
+	route := flag.String("route", "", "only replay recordings of this route")
+	ignore := flag.String("ignore", "createdAt,updatedAt", "comma separated JSON keys not compared")
+	timeout := flag.Duration("timeout", 30*time.Second, "timeout per request")
+	flag.Parse()
+	if *file == "" || *upstream == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	in := os.Stdin
+	if *file != "-" {
+		f, err := os.Open(*file)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer f.Close()
+		in = f
+	}
+	recordings, err := forward.ReadRecordings(in)
+	if err != nil {
+		log.Fatalf("Error reading %s: %v", *file, err)
+	}
+
+	opts := forward.ReplayOptions{
+		Upstream:      *upstream,
+		ThroughProxy:  *viaProxy,
+		Authorization: *token,
+		Client:        &http.Client{Timeout: *timeout},
+	}
+	for _, key := range strings.Split(*ignore, ",") {
+		if key = strings.TrimSpace(key); key != "" {
+			opts.Ignore = append(opts.Ignore, key)
+		}
+	}
+
+	replayed, skipped, differing := 0, 0, 0
+	for i := range recordings {
+		rec := &recordings[i]
+		if *route != "" && rec.Route != *route {
+			continue
+		}
+		if rec.Truncated {
+			// Only part of the body was recorded
+			skipped++
+			fmt.Printf("SKIP  %s %s %s: truncated\n", rec.RequestID, rec.Method, rec.URI)
+			continue
+		}
+		replayed++
+		result, err := forward.Replay(context.Background(), rec, opts)
+		switch {
+		case err != nil:
+			differing++
+			fmt.Printf("ERROR %s %s %s: %v\n", rec.RequestID, rec.Method, rec.URI, err)
+		case len(result.Diffs) > 0:
+			differing++
+			fmt.Printf("DIFF  %s %s %s\n", rec.RequestID, rec.Method, rec.URI)
+			for _, diff := range result.Diffs {
+				fmt.Printf("      %s\n", diff)
+			}
+		default:
+			fmt.Printf("OK    %s %s %s\n", rec.RequestID, rec.Method, rec.URI)
+		}
+	}
+	fmt.Printf("%d replayed, %d differ, %d skipped\n", replayed, differing, skipped)
+	if differing > 0 {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,25 @@
+// Command ryfake serves the RuoYi stand-in of package ryfake, for running the
+// forward proxy locally: point its baseUrl at the listen address and log in
+// with one of the printed tokens.
+package main
+
+import (
+	"flag"
+	"log"
+	"net/http"
+
+	"e.coding.net/Love54dj/weizhong/etc/ryfake"
+)
+
+func main() {
+	addr := flag.String("addr", ":9303", "listen address")
+	flag.Parse()
+
+	for _, u := range ryfake.DefaultUsers {
+		log.Printf("[INFO] User %d (%s, %s): Authorization: Bearer %s", u.ID, u.Nickname, u.Type, u.Token)
+	}
+	log.Printf("[INFO] Fake RuoYi listening on %s", *addr)
+	if err := http.ListenAndServe(*addr, ryfake.New()); err != nil {
+		log.Fatal(err)
+	}
+}
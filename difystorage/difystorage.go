@@ -13,6 +13,8 @@ import (
 	"path/filepath"
 	"strings"
 	"time"
+
+	"e.coding.net/Love54dj/weizhong/etc/metrics"
 )
 
 // Dify API configuration
@@ -50,7 +52,7 @@ func Init(apiURL string, apiKey string) (err error) {
 	}
 
 	// Test connection to Dify API
-	client := &http.Client{Timeout: 10 * time.Second}
+	client := metrics.InstrumentClient("dify", &http.Client{Timeout: 10 * time.Second})
 	req, err := http.NewRequest("GET", apiURL+"/v1", nil)
 	if err != nil {
 		slog.Error("failed to create test request", "error", err)
@@ -156,7 +158,7 @@ func Upload(localFilePath string, targetFileName string, userIdentifier string)
 	req.Header.Set("Content-Type", writer.FormDataContentType())
 
 	// Send request
-	client := &http.Client{Timeout: 60 * time.Second}
+	client := metrics.InstrumentClient("dify", &http.Client{Timeout: 60 * time.Second})
 	resp, err := client.Do(req)
 	if err != nil {
 		slog.Error("failed to send HTTP request", "error", err)
@@ -0,0 +1,251 @@
+package forward
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// RouteInfo describes a route of the running configuration
+type RouteInfo struct {
+	Path               string     `json:"path"`
+	TargetPath         string     `json:"targetPath"`
+	Methods            []string   `json:"methods,omitempty"`
+	Upstreams          []string   `json:"upstreams,omitempty"`
+	Auth               string     `json:"auth"`
+	Middleware         []string   `json:"middleware"`
+	ResponseMiddleware []string   `json:"responseMiddleware,omitempty"`
+	WebSocket          bool       `json:"websocket,omitempty"`
+	Disabled           bool       `json:"disabled"`
+	Breaker            string     `json:"breaker"`
+	Stats              RouteStats `json:"stats"`
+}
+
+// Routes describes every route of the running configuration, sorted by path
+func (s *ProxyServer) Routes() []RouteInfo {
+	table := s.routes()
+	stats := s.RouteStats()
+	infos := make([]RouteInfo, 0, len(table.config.Routes))
+	for _, path := range sortedKeys(table.config.Routes) {
+		route := table.config.Routes[path]
+		info := RouteInfo{
+			Path:       path,
+			TargetPath: route.TargetPath,
+			Methods:    route.allowedMethods(),
+			Upstreams:  route.Upstreams,
+			Auth:       typeName(route.AuthValidator),
+			Middleware: []string{},
+			WebSocket:  route.WebSocket,
+			Disabled:   route.Disabled,
+			Stats:      stats[path],
+		}
+		for _, m := range route.Middleware {
+			info.Middleware = append(info.Middleware, typeName(m))
+		}
+		for _, m := range route.ResponseMiddleware {
+			info.ResponseMiddleware = append(info.ResponseMiddleware, typeName(m))
+		}
+		if b := table.breakers[path]; b != nil {
+			info.Breaker = b.currentState()
+		}
+		infos = append(infos, info)
+	}
+	return infos
+}
+
+func typeName(v any) string {
+	if v == nil {
+		return ""
+	}
+	return strings.TrimPrefix(strings.TrimPrefix(fmt.Sprintf("%T", v), "*"), "forward.")
+}
+
+// updateRoutes applies change to a copy of the running routes and swaps the
+// result in
+func (s *ProxyServer) updateRoutes(change func(routes map[string]*RouteConfig) error) error {
+	s.adminMu.Lock()
+	defer s.adminMu.Unlock()
+	current := s.routes().config
+	next := *current
+	next.Routes = make(map[string]*RouteConfig, len(current.Routes)+1)
+	for path, route := range current.Routes {
+		next.Routes[path] = route
+	}
+	if err := change(next.Routes); err != nil {
+		return err
+	}
+	s.SetConfig(&next)
+	return nil
+}
+
+// SetRouteDisabled disables or re-enables the route at path. Disabled routes
+// answer 503 without contacting the upstream.
+func (s *ProxyServer) SetRouteDisabled(path string, disabled bool) error {
+	return s.updateRoutes(func(routes map[string]*RouteConfig) error {
+		route, ok := routes[path]
+		if !ok {
+			return fmt.Errorf("no route %s", path)
+		}
+		updated := *route
+		updated.Disabled = disabled
+		routes[path] = &updated
+		return nil
+	})
+}
+
+// PutRoute adds the route at path, replacing an existing one
+func (s *ProxyServer) PutRoute(path string, route *RouteConfig) error {
+	if isPatternPath(path) {
+		p, err := parsePattern(path)
+		if err == nil {
+			err = p.checkTarget(route.TargetPath)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return s.updateRoutes(func(routes map[string]*RouteConfig) error {
+		routes[path] = route
+		return nil
+	})
+}
+
+// RemoveRoute removes the route at path
+func (s *ProxyServer) RemoveRoute(path string) error {
+	return s.updateRoutes(func(routes map[string]*RouteConfig) error {
+		if _, ok := routes[path]; !ok {
+			return fmt.Errorf("no route %s", path)
+		}
+		delete(routes, path)
+		return nil
+	})
+}
+
+// AdminHandler returns the admin API of the proxy. Requests must present one
+// of tokens, keyed by operator name, as a Bearer token; the name is recorded
+// as the actor of every change. Mount it with http.StripPrefix, e.g. below
+// /admin on Server.InternalMux, never on the public listener:
+//
+//	GET    /routes                   routes with their plugins and counters
+//	POST   /routes                   add or replace a route, the body is a
+//	                                 route file entry in JSON or YAML
+//	DELETE /routes?path=/x           remove a route
+//	POST   /routes/disable?path=/x   answer 503 on a route
+//	POST   /routes/enable?path=/x    serve a disabled route again
+//	GET    /upstreams                upstream health
+//	GET    /audit                    recent audited changes, see OpenAuditLog
+//
+// Changes last until the route file is reloaded.
+func (s *ProxyServer) AdminHandler(tokens map[string]string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /routes", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, s.Routes())
+	})
+	mux.HandleFunc("POST /routes", func(w http.ResponseWriter, r *http.Request) {
+		var spec RouteSpec
+		dec := yaml.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20))
+		dec.KnownFields(true)
+		if err := dec.Decode(&spec); err != nil {
+			http.Error(w, "Invalid route: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		route, err := spec.build()
+		if err == nil {
+			err = s.PutRoute(spec.Path, route)
+		}
+		if err != nil {
+			http.Error(w, "Invalid route: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		auditAdmin(r, "route.put", spec.Path, fmt.Sprintf("targetPath=%s auth=%s", route.TargetPath, spec.Auth.Name))
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("DELETE /routes", func(w http.ResponseWriter, r *http.Request) {
+		path := r.URL.Query().Get("path")
+		if err := s.RemoveRoute(path); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		auditAdmin(r, "route.remove", path, "")
+		w.WriteHeader(http.StatusNoContent)
+	})
+	for action, disabled := range map[string]bool{"disable": true, "enable": false} {
+		mux.HandleFunc("POST /routes/"+action, func(w http.ResponseWriter, r *http.Request) {
+			path := r.URL.Query().Get("path")
+			if err := s.SetRouteDisabled(path, disabled); err != nil {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			}
+			auditAdmin(r, "route."+action, path, "")
+			w.WriteHeader(http.StatusNoContent)
+		})
+	}
+	mux.Handle("GET /upstreams", s.UpstreamStatusHandler())
+	mux.HandleFunc("GET /audit", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, AuditEntries())
+	})
+
+	names := sortedKeys(tokens)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Resolves client addresses through the configured trusted proxies
+		table := s.routes()
+		r = withRoutes(r, table)
+
+		// Browsers send preflight requests without the token
+		if cors := table.config.CORS; cors != nil {
+			if isPreflight(r) {
+				cors.preflight(w, r, nil)
+				return
+			}
+			cors.apply(w, r)
+		}
+		actor := adminActor(r, names, tokens)
+		if actor == "" {
+			log.Printf("[ERROR] Rejected admin request %s %s from %s", r.Method, r.URL.Path, clientIP(r))
+			w.Header().Set("WWW-Authenticate", `Bearer realm="forward admin"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		mux.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), adminActorKey{}, actor)))
+	})
+}
+
+// adminActorKey carries the authenticated operator to the admin handlers
+type adminActorKey struct{}
+
+// adminActor returns the name of the token r presents, or "" if none matches
+func adminActor(r *http.Request, names []string, tokens map[string]string) string {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || token == "" {
+		return ""
+	}
+	actor := ""
+	// Compare against every token so timing does not reveal which matched
+	for _, name := range names {
+		if tokens[name] != "" && subtle.ConstantTimeCompare([]byte(token), []byte(tokens[name])) == 1 {
+			actor = name
+		}
+	}
+	return actor
+}
+
+func auditAdmin(r *http.Request, action, target, detail string) {
+	audit(AuditEntry{
+		Actor:      r.Context().Value(adminActorKey{}).(string),
+		RemoteAddr: clientIP(r),
+		Action:     action,
+		Target:     target,
+		Detail:     detail,
+	})
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
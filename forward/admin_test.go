@@ -0,0 +1,117 @@
+package forward
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAdminHandler(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.URL.Path)
+	}))
+	defer upstream.Close()
+
+	config := &Config{BaseURL: upstream.URL}
+	AddRoute(config, "/system/message", "/system/message", &pathValueValidator{})
+	proxy := NewProxyServer(config)
+	admin := http.StripPrefix("/admin", proxy.AdminHandler(map[string]string{"ops": "secret"}))
+
+	call := func(method, target, token, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		if strings.HasPrefix(target, "/admin") {
+			admin.ServeHTTP(rec, req)
+		} else {
+			proxy.ServeHTTP(rec, req)
+		}
+		return rec
+	}
+
+	if rec := call(http.MethodGet, "/admin/routes", "wrong", ""); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("wrong token: got %d", rec.Code)
+	}
+	if rec := call(http.MethodPost, "/admin/routes/disable?path=/system/message", "secret", ""); rec.Code != http.StatusNoContent {
+		t.Fatalf("disable: got %d %s", rec.Code, rec.Body.String())
+	}
+	if rec := call(http.MethodGet, "/system/message", "", ""); rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("disabled route: got %d", rec.Code)
+	}
+	call(http.MethodPost, "/admin/routes/enable?path=/system/message", "secret", "")
+	if rec := call(http.MethodGet, "/system/message", "", ""); rec.Code != http.StatusOK {
+		t.Fatalf("enabled route: got %d", rec.Code)
+	}
+
+	rec := call(http.MethodPost, "/admin/routes", "secret", `{"path": "/files/{path...}", "targetPath": "/static/{path...}", "auth": "referer"}`)
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("add route: got %d %s", rec.Code, rec.Body.String())
+	}
+	if rec := call(http.MethodGet, "/files/a.txt", "", ""); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("added route: got %d", rec.Code)
+	}
+	if rec := call(http.MethodDelete, "/admin/routes?path=/files/{path...}", "secret", ""); rec.Code != http.StatusNoContent {
+		t.Fatalf("remove route: got %d", rec.Code)
+	}
+
+	infos := proxy.Routes()
+	if len(infos) != 1 || infos[0].Stats.Requests != 2 || infos[0].Stats.ServerErrors != 1 {
+		t.Errorf("unexpected routes %+v", infos)
+	}
+	var actions []string
+	for _, entry := range AuditEntries() {
+		if entry.Actor == "ops" {
+			actions = append(actions, entry.Action)
+		}
+	}
+	if strings.Join(actions, ",") != "route.disable,route.enable,route.put,route.remove" {
+		t.Errorf("unexpected audit trail %v", actions)
+	}
+}
+
+func TestAuditLogSurvivesRestart(t *testing.T) {
+	prev := audits
+	t.Cleanup(func() {
+		if audits.file != nil {
+			audits.file.Close()
+		}
+		audits = prev
+	})
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+
+	audits = &auditTrail{entries: make([]AuditEntry, 2)}
+	if err := OpenAuditLog(path); err != nil {
+		t.Fatal(err)
+	}
+	for _, action := range []string{"a", "b", "c"} {
+		audit(AuditEntry{Actor: "ops", Action: action})
+	}
+	audits.file.Close()
+
+	// A restarted process loads the most recent entries
+	audits = &auditTrail{entries: make([]AuditEntry, 2)}
+	if err := OpenAuditLog(path); err != nil {
+		t.Fatal(err)
+	}
+	audit(AuditEntry{Actor: "ops", Action: "d"})
+	var actions []string
+	for _, entry := range AuditEntries() {
+		actions = append(actions, entry.Action)
+	}
+	if strings.Join(actions, ",") != "c,d" {
+		t.Errorf("got trail %v, want c,d", actions)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(string(data), "\n"); n != 4 {
+		t.Errorf("audit log has %d lines, want 4:\n%s", n, data)
+	}
+}
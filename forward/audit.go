@@ -0,0 +1,103 @@
+package forward
+
+import (
+	"bufio"
+	"encoding/json"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// AuditEntry records a privileged action, such as a route change through the
+// admin API
+type AuditEntry struct {
+	Time       time.Time `json:"time"`
+	Actor      string    `json:"actor"`
+	RemoteAddr string    `json:"remoteAddr"`
+	Action     string    `json:"action"`
+	Target     string    `json:"target"`
+	Detail     string    `json:"detail,omitempty"`
+}
+
+// auditTrail keeps the most recent audit entries in memory; every entry is
+// also written to the log and, after OpenAuditLog, appended to a file.
+// Without a file the trail is best-effort: it is lost on restart, and only
+// the log lines remain.
+type auditTrail struct {
+	mu      sync.Mutex
+	entries []AuditEntry
+	next    int
+	full    bool
+	file    *os.File
+}
+
+const auditTrailSize = 500
+
+var audits = &auditTrail{entries: make([]AuditEntry, auditTrailSize)}
+
+// audit records entry in the audit trail and the log
+func audit(entry AuditEntry) {
+	if entry.Time.IsZero() {
+		entry.Time = time.Now()
+	}
+	log.Printf("[AUDIT] actor=%s remote=%s action=%s target=%s %s",
+		entry.Actor, entry.RemoteAddr, entry.Action, entry.Target, entry.Detail)
+
+	audits.mu.Lock()
+	defer audits.mu.Unlock()
+	audits.add(entry)
+	if audits.file != nil {
+		line, _ := json.Marshal(entry)
+		if _, err := audits.file.Write(append(line, '\n')); err != nil {
+			log.Printf("[ERROR] Writing audit log failed: %v", err)
+		}
+	}
+}
+
+func (t *auditTrail) add(entry AuditEntry) {
+	t.entries[t.next] = entry
+	t.next = (t.next + 1) % len(t.entries)
+	if t.next == 0 {
+		t.full = true
+	}
+}
+
+// OpenAuditLog appends every later audit entry to the JSON lines file at
+// path, creating it if needed, and loads the most recent entries already in
+// it so the trail survives restarts
+func OpenAuditLog(path string) error {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return err
+	}
+	audits.mu.Lock()
+	defer audits.mu.Unlock()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		var entry AuditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err == nil {
+			audits.add(entry)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		f.Close()
+		return err
+	}
+	if audits.file != nil {
+		audits.file.Close()
+	}
+	audits.file = f
+	return nil
+}
+
+// AuditEntries returns the retained audit entries, oldest first
+func AuditEntries() []AuditEntry {
+	audits.mu.Lock()
+	defer audits.mu.Unlock()
+	if !audits.full {
+		return append([]AuditEntry(nil), audits.entries[:audits.next]...)
+	}
+	return append(append([]AuditEntry(nil), audits.entries[audits.next:]...), audits.entries[:audits.next]...)
+}
@@ -0,0 +1,173 @@
+package forward
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// BreakerConfig configures the circuit breaker of a route. The zero value
+// enables the breaker with default settings.
+type BreakerConfig struct {
+	Disabled    bool          `yaml:"disabled"`
+	Threshold   float64       `yaml:"threshold"`   // error ratio that opens the breaker, default 0.5
+	MinRequests int           `yaml:"minRequests"` // requests in the window before it can open, default 20
+	Window      time.Duration `yaml:"window"`      // default 30s
+	OpenFor     time.Duration `yaml:"openFor"`     // how long to fail fast before probing, default 30s
+}
+
+func (bc BreakerConfig) withDefaults() BreakerConfig {
+	if bc.Threshold <= 0 {
+		bc.Threshold = 0.5
+	}
+	if bc.MinRequests <= 0 {
+		bc.MinRequests = 20
+	}
+	if bc.Window < breakerBuckets {
+		// Too short to split into buckets
+		bc.Window = 30 * time.Second
+	}
+	if bc.OpenFor <= 0 {
+		bc.OpenFor = 30 * time.Second
+	}
+	return bc
+}
+
+// Circuit breaker states as reported by BreakerStatus
+const (
+	BreakerClosed   = "closed"
+	BreakerOpen     = "open"
+	BreakerHalfOpen = "half-open"
+)
+
+const breakerBuckets = 10
+
+type breakerBucket struct {
+	start           time.Time
+	total, failures int
+}
+
+// circuitBreaker counts the upstream outcomes of one route over a rolling
+// window and fails fast once the error ratio crosses the threshold. After
+// OpenFor a single probe request is let through to decide whether to close.
+type circuitBreaker struct {
+	route  string
+	config BreakerConfig
+
+	mu        sync.Mutex
+	state     string
+	openedAt  time.Time
+	probeSent time.Time // zero unless a half-open probe is in flight
+	buckets   [breakerBuckets]breakerBucket
+}
+
+func newCircuitBreaker(route string, config BreakerConfig) *circuitBreaker {
+	return &circuitBreaker{route: route, config: config.withDefaults(), state: BreakerClosed}
+}
+
+// allow reports whether a request may be sent and, if not, how long until
+// the breaker lets a probe through
+func (b *circuitBreaker) allow() (bool, time.Duration) {
+	if b.config.Disabled {
+		return true, 0
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	switch b.state {
+	case BreakerOpen:
+		if wait := b.config.OpenFor - now.Sub(b.openedAt); wait > 0 {
+			return false, wait
+		}
+		b.setState(BreakerHalfOpen)
+	case BreakerHalfOpen:
+		// A probe whose client went away never reports back, so give up on
+		// it after OpenFor
+		if wait := b.config.OpenFor - now.Sub(b.probeSent); !b.probeSent.IsZero() && wait > 0 {
+			return false, wait
+		}
+	default:
+		return true, 0
+	}
+	b.probeSent = now
+	return true, 0
+}
+
+// record counts the outcome of one upstream attempt
+func (b *circuitBreaker) record(failed bool) {
+	if b.config.Disabled {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case BreakerHalfOpen:
+		b.probeSent = time.Time{}
+		if failed {
+			b.open()
+		} else {
+			b.buckets = [breakerBuckets]breakerBucket{}
+			b.setState(BreakerClosed)
+		}
+		return
+	case BreakerOpen:
+		return
+	}
+
+	now := time.Now()
+	width := b.config.Window / breakerBuckets
+	bucket := &b.buckets[(now.UnixNano()/int64(width))%breakerBuckets]
+	if now.Sub(bucket.start) >= width {
+		*bucket = breakerBucket{start: now.Truncate(width)}
+	}
+	bucket.total++
+	if failed {
+		bucket.failures++
+	}
+
+	var total, failures int
+	for _, bk := range b.buckets {
+		if now.Sub(bk.start) < b.config.Window {
+			total += bk.total
+			failures += bk.failures
+		}
+	}
+	if total >= b.config.MinRequests && float64(failures)/float64(total) >= b.config.Threshold {
+		log.Printf("[ERROR] %d of the last %d requests to %s failed", failures, total, b.route)
+		b.open()
+	}
+}
+
+func (b *circuitBreaker) open() {
+	b.openedAt = time.Now()
+	b.setState(BreakerOpen)
+}
+
+func (b *circuitBreaker) setState(state string) {
+	if b.state == state {
+		return
+	}
+	if state == BreakerOpen {
+		log.Printf("[ERROR] Circuit breaker for %s: %s -> %s, failing fast for %s", b.route, b.state, state, b.config.OpenFor)
+	} else {
+		log.Printf("[INFO] Circuit breaker for %s: %s -> %s", b.route, b.state, state)
+	}
+	b.state = state
+}
+
+func (b *circuitBreaker) currentState() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+// BreakerStatus reports the circuit breaker state of every route
+func (s *ProxyServer) BreakerStatus() map[string]string {
+	table := s.routes()
+	status := make(map[string]string, len(table.breakers))
+	for path, b := range table.breakers {
+		status[path] = b.currentState()
+	}
+	return status
+}
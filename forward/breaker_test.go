@@ -0,0 +1,32 @@
+package forward
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	b := newCircuitBreaker("/test", BreakerConfig{Threshold: 0.5, MinRequests: 4, Window: time.Minute, OpenFor: 50 * time.Millisecond})
+	for _, failed := range []bool{false, true, false} {
+		b.record(failed)
+	}
+	if b.currentState() != BreakerClosed {
+		t.Fatalf("opened before MinRequests")
+	}
+	b.record(true)
+	if ok, wait := b.allow(); ok || wait <= 0 {
+		t.Fatalf("expected open breaker to fail fast, got %v %v", ok, wait)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if ok, _ := b.allow(); !ok || b.currentState() != BreakerHalfOpen {
+		t.Fatalf("expected a probe in half-open state, got %s", b.currentState())
+	}
+	if ok, _ := b.allow(); ok {
+		t.Fatal("expected a single probe while half-open")
+	}
+	b.record(false)
+	if ok, _ := b.allow(); !ok || b.currentState() != BreakerClosed {
+		t.Fatalf("expected successful probe to close the breaker, got %s", b.currentState())
+	}
+}
@@ -0,0 +1,477 @@
+package forward
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// FileConfig is the on-disk form of Config. Route files may be written in
+// YAML or JSON; see routes.example.yaml for the layout.
+type FileConfig struct {
+	BaseURL      string      `yaml:"baseUrl"`
+	LoginInfoURL string      `yaml:"loginInfoUrl"`
+	Routes       []RouteSpec `yaml:"routes"`
+
+	// Upstreams spread routes without their own, and the proxy's lookups,
+	// over several RuoYi nodes
+	Upstreams   []string    `yaml:"upstreams"`
+	Balance     string      `yaml:"balance"`
+	HealthCheck HealthCheck `yaml:"healthCheck"`
+
+	Lawyer     LawyerResolver `yaml:"lawyer"`
+	TestAccess TestAccess     `yaml:"testAccess"`
+
+	// TrustedProxies lists the addresses or CIDR ranges of proxies in front
+	// of this one, whose X-Forwarded-For is kept
+	TrustedProxies []string `yaml:"trustedProxies"`
+
+	// Recording enables the traffic recorder for routes with record set
+	Recording *RecordingConfig `yaml:"recording"`
+
+	// CORS applies to the admin API; routes set their own
+	CORS *CORSPolicy `yaml:"cors"`
+
+	// Metrics serves Prometheus metrics on the internal listener
+	Metrics bool `yaml:"metrics"`
+}
+
+// RouteSpec declares a single proxied route
+type RouteSpec struct {
+	Path               string       `yaml:"path"`
+	TargetPath         string       `yaml:"targetPath"`
+	Methods            []string     `yaml:"methods"`
+	Upstreams          []string     `yaml:"upstreams"`
+	Balance            string       `yaml:"balance"`
+	Auth               PluginSpec   `yaml:"auth"`
+	Middleware         []PluginSpec `yaml:"middleware"`
+	ResponseMiddleware []PluginSpec `yaml:"responseMiddleware"`
+
+	// BufferResponse disables streaming of the upstream response
+	BufferResponse bool `yaml:"bufferResponse"`
+	// WebSocket enables proxying of WebSocket upgrades on the route
+	WebSocket bool `yaml:"websocket"`
+
+	Timeout time.Duration `yaml:"timeout"`
+	Retries int           `yaml:"retries"` // only used for idempotent methods
+	Breaker BreakerConfig `yaml:"breaker"`
+
+	// Disabled keeps the route configured but answers 503
+	Disabled bool `yaml:"disabled"`
+
+	Idempotency IdempotencyConfig `yaml:"idempotency"`
+
+	MaxBodySize int64          `yaml:"maxBodySize"` // bytes
+	Validate    *RequestSchema `yaml:"validate"`
+
+	Headers HeaderPolicy        `yaml:"headers"`
+	Cache   ResponseCacheConfig `yaml:"cache"`
+	Record  bool                `yaml:"record"`
+
+	// PerMethod gives methods their own auth and middleware; they are allowed
+	// in addition to methods. Route level auth is then only required for the
+	// other methods.
+	PerMethod map[string]ChainSpec `yaml:"perMethod"`
+	CORS      *CORSPolicy          `yaml:"cors"`
+}
+
+// ChainSpec declares the auth and middleware of one method of a route. Auth
+// defaults to the route's; middleware always replaces the route's.
+type ChainSpec struct {
+	Auth       PluginSpec   `yaml:"auth"`
+	Middleware []PluginSpec `yaml:"middleware"`
+}
+
+// PluginSpec references a registered validator or middleware by name. In a
+// route file it is either a bare name or a mapping with name and options.
+type PluginSpec struct {
+	Name    string
+	Options yaml.Node
+}
+
+// UnmarshalYAML accepts both the short and the long form of a PluginSpec
+func (p *PluginSpec) UnmarshalYAML(value *yaml.Node) error {
+	switch value.Kind {
+	case yaml.ScalarNode:
+		return value.Decode(&p.Name)
+	case yaml.MappingNode:
+		var raw struct {
+			Name    string    `yaml:"name"`
+			Options yaml.Node `yaml:"options"`
+		}
+		if err := value.Decode(&raw); err != nil {
+			return err
+		}
+		p.Name, p.Options = raw.Name, raw.Options
+		return nil
+	}
+	return fmt.Errorf("line %d: expected a name or a mapping with name and options", value.Line)
+}
+
+// Decode implements Options for the options block of the spec
+func (p *PluginSpec) Decode(v any) error {
+	if p.Options.Kind == 0 {
+		return nil
+	}
+	return p.Options.Decode(v)
+}
+
+var knownMethods = map[string]bool{
+	http.MethodGet: true, http.MethodHead: true, http.MethodPost: true,
+	http.MethodPut: true, http.MethodPatch: true, http.MethodDelete: true,
+	http.MethodOptions: true,
+}
+
+// ParseConfig decodes a route file and builds the Config it describes
+func ParseConfig(data []byte) (*Config, error) {
+	var fc FileConfig
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(&fc); err != nil && err != io.EOF {
+		return nil, fmt.Errorf("parse route file: %w", err)
+	}
+	return fc.Build()
+}
+
+// LoadConfigFile reads and builds the route file at path
+func LoadConfigFile(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseConfig(data)
+}
+
+// Build validates the file configuration and resolves every validator and
+// middleware through the registry. All problems are reported together.
+func (fc *FileConfig) Build() (*Config, error) {
+	var errs []error
+	if fc.BaseURL == "" {
+		errs = append(errs, errors.New("baseUrl is required"))
+	} else if u, err := url.Parse(fc.BaseURL); err != nil || u.Scheme == "" || u.Host == "" {
+		errs = append(errs, fmt.Errorf("baseUrl %q is not an absolute URL", fc.BaseURL))
+	}
+	for _, upstream := range fc.Upstreams {
+		if u, err := url.Parse(upstream); err != nil || u.Scheme == "" || u.Host == "" {
+			errs = append(errs, fmt.Errorf("upstream %q is not an absolute URL", upstream))
+		}
+	}
+	switch fc.Balance {
+	case "", BalanceRoundRobin, BalanceLeastConn:
+	default:
+		errs = append(errs, fmt.Errorf("unknown balance %q", fc.Balance))
+	}
+	if fc.HealthCheck.Interval < 0 || fc.HealthCheck.Timeout < 0 || fc.HealthCheck.Cooldown < 0 {
+		errs = append(errs, errors.New("healthCheck durations must not be negative"))
+	}
+	if err := fc.Lawyer.validate(); err != nil {
+		errs = append(errs, fmt.Errorf("lawyer: %w", err))
+	}
+	if err := fc.TestAccess.validate(); err != nil {
+		errs = append(errs, fmt.Errorf("testAccess: %w", err))
+	}
+	if fc.CORS != nil {
+		if err := fc.CORS.validate(); err != nil {
+			errs = append(errs, fmt.Errorf("cors: %w", err))
+		}
+	}
+	trusted, err := ParseTrustedProxies(fc.TrustedProxies)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("trustedProxies: %w", err))
+	}
+	var recorder *Recorder
+	if fc.Recording != nil {
+		if fc.Recording.Path == "" {
+			errs = append(errs, errors.New("recording: path is required"))
+		} else {
+			recorder = NewRecorder(*fc.Recording)
+		}
+	}
+	baseURL := strings.TrimSuffix(fc.BaseURL, "/")
+	config := &Config{
+		BaseURL:      baseURL,
+		LoginInfoURL: fc.LoginInfoURL,
+		Routes:       make(map[string]*RouteConfig, len(fc.Routes)),
+		Upstreams:    fc.Upstreams,
+		Balance:      fc.Balance,
+		HealthCheck:  fc.HealthCheck,
+		Lawyer:       fc.Lawyer,
+		TestAccess:   fc.TestAccess,
+
+		TrustedProxies: trusted,
+		Recorder:       recorder,
+		CORS:           fc.CORS,
+		Metrics:        fc.Metrics,
+	}
+	if config.LoginInfoURL == "" {
+		config.LoginInfoURL = baseURL + "/system/loginInfo"
+	}
+
+	for i := range fc.Routes {
+		spec := &fc.Routes[i]
+		route, err := spec.build()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("routes[%d] %s: %w", i, spec.Path, err))
+			continue
+		}
+		if _, dup := config.Routes[spec.Path]; dup {
+			errs = append(errs, fmt.Errorf("routes[%d] %s: duplicate path", i, spec.Path))
+			continue
+		}
+		config.Routes[spec.Path] = route
+	}
+	for i, spec := range fc.Routes {
+		if spec.Record && fc.Recording == nil {
+			errs = append(errs, fmt.Errorf("routes[%d] %s: record needs a recording section", i, spec.Path))
+		}
+		for _, by := range spec.Cache.InvalidatedBy {
+			if _, ok := config.Routes[by]; !ok {
+				errs = append(errs, fmt.Errorf("routes[%d] %s: cache invalidatedBy unknown route %s", i, spec.Path, by))
+			}
+		}
+	}
+
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	return config, nil
+}
+
+func (spec *RouteSpec) build() (*RouteConfig, error) {
+	pattern, err := parsePattern(spec.Path)
+	if err != nil {
+		return nil, err
+	}
+	targetPath := spec.TargetPath
+	if targetPath == "" {
+		targetPath = spec.Path
+	}
+	if !strings.HasPrefix(targetPath, "/") {
+		return nil, errors.New("targetPath must start with /")
+	}
+	if err := pattern.checkTarget(targetPath); err != nil {
+		return nil, err
+	}
+
+	var methods []string
+	for _, m := range spec.Methods {
+		m = strings.ToUpper(m)
+		if !knownMethods[m] {
+			return nil, fmt.Errorf("unsupported method %q", m)
+		}
+		methods = append(methods, m)
+	}
+
+	for _, upstream := range spec.Upstreams {
+		if u, err := url.Parse(upstream); err != nil || u.Scheme == "" || u.Host == "" {
+			return nil, fmt.Errorf("upstream %q is not an absolute URL", upstream)
+		}
+	}
+	switch spec.Balance {
+	case "", BalanceRoundRobin, BalanceLeastConn:
+	default:
+		return nil, fmt.Errorf("unknown balance %q", spec.Balance)
+	}
+
+	if spec.Timeout < 0 || spec.Retries < 0 {
+		return nil, errors.New("timeout and retries must not be negative")
+	}
+	if spec.Cache.TTL < 0 {
+		return nil, errors.New("cache ttl must not be negative")
+	}
+	if spec.MaxBodySize < 0 {
+		return nil, errors.New("maxBodySize must not be negative")
+	}
+	if spec.Validate != nil {
+		if err := spec.Validate.compile(); err != nil {
+			return nil, fmt.Errorf("validate: %w", err)
+		}
+	}
+	if spec.Idempotency.Window < 0 || spec.Idempotency.MaxWait < 0 {
+		return nil, errors.New("idempotency durations must not be negative")
+	}
+	if spec.Breaker.Threshold < 0 || spec.Breaker.Threshold > 1 {
+		return nil, errors.New("breaker threshold must be between 0 and 1")
+	}
+	if spec.Breaker.Window < 0 || (spec.Breaker.Window > 0 && spec.Breaker.Window < breakerBuckets) {
+		return nil, fmt.Errorf("breaker window must be at least %dns", breakerBuckets)
+	}
+
+	if spec.CORS != nil {
+		if err := spec.CORS.validate(); err != nil {
+			return nil, fmt.Errorf("cors: %w", err)
+		}
+	}
+
+	var validator AuthValidator
+	var middleware []Middleware
+	if spec.Auth.Name != "" {
+		if validator, middleware, err = buildChain(&spec.Auth, spec.Middleware); err != nil {
+			return nil, err
+		}
+	} else if len(spec.PerMethod) == 0 || len(methods) > 0 && !spec.chainsCover(methods) {
+		return nil, errors.New("auth is required")
+	}
+
+	var chains map[string]MethodChain
+	for _, m := range sortedKeys(spec.PerMethod) {
+		chainSpec := spec.PerMethod[m]
+		method := strings.ToUpper(m)
+		if !knownMethods[method] {
+			return nil, fmt.Errorf("perMethod: unsupported method %q", m)
+		}
+		if _, dup := chains[method]; dup {
+			return nil, fmt.Errorf("perMethod: duplicate method %s", method)
+		}
+		auth := &chainSpec.Auth
+		if auth.Name == "" {
+			if spec.Auth.Name == "" {
+				return nil, fmt.Errorf("perMethod %s: auth is required", method)
+			}
+			auth = &spec.Auth
+		}
+		chain := MethodChain{}
+		if chain.AuthValidator, chain.Middleware, err = buildChain(auth, chainSpec.Middleware); err != nil {
+			return nil, fmt.Errorf("perMethod %s: %w", method, err)
+		}
+		if chains == nil {
+			chains = make(map[string]MethodChain, len(spec.PerMethod))
+		}
+		chains[method] = chain
+	}
+
+	var responseMiddleware []ResponseMiddleware
+	for j := range spec.ResponseMiddleware {
+		m, err := NewResponseMiddleware(spec.ResponseMiddleware[j].Name, &spec.ResponseMiddleware[j])
+		if err != nil {
+			return nil, fmt.Errorf("responseMiddleware[%d]: %w", j, err)
+		}
+		responseMiddleware = append(responseMiddleware, m)
+	}
+
+	return &RouteConfig{
+		TargetPath:         targetPath,
+		Methods:            methods,
+		Upstreams:          spec.Upstreams,
+		Balance:            spec.Balance,
+		AuthValidator:      validator,
+		Middleware:         middleware,
+		ResponseMiddleware: responseMiddleware,
+		BufferResponse:     spec.BufferResponse,
+		WebSocket:          spec.WebSocket,
+		Timeout:            spec.Timeout,
+		Retries:            spec.Retries,
+		Breaker:            spec.Breaker,
+		Disabled:           spec.Disabled,
+		Idempotency:        spec.Idempotency,
+		MaxBodySize:        spec.MaxBodySize,
+		Schema:             spec.Validate,
+		Headers:            spec.Headers,
+		Cache:              spec.Cache,
+		Record:             spec.Record,
+		MethodChains:       chains,
+		CORS:               spec.CORS,
+	}, nil
+}
+
+// chainsCover reports whether every one of methods has a perMethod chain
+func (spec *RouteSpec) chainsCover(methods []string) bool {
+	chained := sortedKeys(spec.PerMethod)
+	for _, m := range methods {
+		if !slices.ContainsFunc(chained, func(k string) bool { return strings.EqualFold(k, m) }) {
+			return false
+		}
+	}
+	return true
+}
+
+// buildChain resolves an auth validator and its middleware through the
+// registry
+func buildChain(auth *PluginSpec, specs []PluginSpec) (AuthValidator, []Middleware, error) {
+	validator, err := NewValidator(auth.Name, auth)
+	if err != nil {
+		return nil, nil, err
+	}
+	middleware := make([]Middleware, 0, len(specs))
+	for j := range specs {
+		m, err := NewMiddleware(specs[j].Name, &specs[j])
+		if err != nil {
+			return nil, nil, fmt.Errorf("middleware[%d]: %w", j, err)
+		}
+		middleware = append(middleware, m)
+	}
+	return validator, middleware, nil
+}
+
+// ReloadConfigFile loads path and swaps it in as the running configuration.
+// On error the running configuration is left untouched.
+func (s *ProxyServer) ReloadConfigFile(path string) error {
+	config, err := LoadConfigFile(path)
+	if err != nil {
+		return err
+	}
+	s.SetConfig(config)
+	log.Printf("[INFO] Loaded %d routes from %s", len(config.Routes), path)
+	return nil
+}
+
+// WatchConfigFile reloads path whenever the file changes on disk or the
+// process receives SIGHUP. The file is polled every interval. Reload errors are
+// logged and the running configuration is kept. Call the returned function to
+// stop watching.
+func (s *ProxyServer) WatchConfigFile(path string, interval time.Duration) (stop func()) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	done := make(chan struct{})
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		defer signal.Stop(hup)
+
+		var lastMod time.Time
+		var lastSize int64
+		if info, err := os.Stat(path); err == nil {
+			lastMod, lastSize = info.ModTime(), info.Size()
+		}
+		reload := func(reason string) {
+			log.Printf("[INFO] Reloading route file %s (%s)", path, reason)
+			if err := s.ReloadConfigFile(path); err != nil {
+				log.Printf("[ERROR] Keeping running routes, reload of %s failed: %v", path, err)
+			}
+		}
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-hup:
+				reload("SIGHUP")
+			case <-ticker.C:
+				info, err := os.Stat(path)
+				if err != nil {
+					continue
+				}
+				if info.ModTime().Equal(lastMod) && info.Size() == lastSize {
+					continue
+				}
+				lastMod, lastSize = info.ModTime(), info.Size()
+				reload("file changed")
+			}
+		}
+	}()
+
+	return func() { close(done) }
+}
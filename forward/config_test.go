@@ -0,0 +1,74 @@
+package forward
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLoadExampleRouteFile(t *testing.T) {
+	config, err := LoadConfigFile("routes.example.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defaults := DefaultConfig()
+	if config.BaseURL != defaults.BaseURL || config.LoginInfoURL != defaults.LoginInfoURL {
+		t.Errorf("unexpected upstream %s / %s", config.BaseURL, config.LoginInfoURL)
+	}
+	for path := range defaults.Routes {
+		if _, ok := config.Routes[path]; !ok {
+			t.Errorf("route %s missing from example file", path)
+		}
+	}
+	if _, ok := config.Routes["/system/message"].AuthValidator.(*MessageAuthValidator); !ok {
+		t.Errorf("message route has validator %T", config.Routes["/system/message"].AuthValidator)
+	}
+}
+
+func TestParseConfigJSON(t *testing.T) {
+	config, err := ParseConfig([]byte(`{
+		"baseUrl": "http://127.0.0.1:9303/",
+		"metrics": true,
+		"routes": [{"path": "/logout", "methods": ["post"], "auth": {"name": "referer"}}]
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	route := config.Routes["/logout"]
+	if config.LoginInfoURL != "http://127.0.0.1:9303/system/loginInfo" {
+		t.Errorf("loginInfoUrl not derived from baseUrl: %s", config.LoginInfoURL)
+	}
+	if route.TargetPath != "/logout" || len(route.Methods) != 1 || route.Methods[0] != "POST" {
+		t.Errorf("unexpected route %+v", route)
+	}
+	if !config.Metrics {
+		t.Error("metrics not enabled")
+	}
+}
+
+func TestParseConfigReportsAllErrors(t *testing.T) {
+	_, err := ParseConfig([]byte(`
+baseUrl: http://127.0.0.1:9303
+upstreams: [10.0.0.1:9303]
+balance: random
+routes:
+  - path: /a
+    auth: nosuchvalidator
+  - path: /b
+    auth: token
+    middleware: [nosuchmiddleware]
+  - path: /c
+    methods: [FETCH]
+    auth: token
+  - path: /d
+    auth: token
+    breaker: {window: 5ns}
+`))
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	for _, want := range []string{"nosuchvalidator", "nosuchmiddleware", "FETCH", "10.0.0.1:9303", "random", "breaker window"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error does not mention %s: %v", want, err)
+		}
+	}
+}
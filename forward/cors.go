@@ -0,0 +1,121 @@
+package forward
+
+import (
+	"errors"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CORSPolicy lets browsers on other origins, such as the admin web console,
+// call a route. The proxy answers preflight requests itself and replaces the
+// upstream's Access-Control-* headers with its own.
+type CORSPolicy struct {
+	// AllowOrigins are the origins allowed, e.g. https://admin.example.com,
+	// or "*" for any
+	AllowOrigins []string `yaml:"allowOrigins"`
+	// AllowHeaders are the request headers allowed, those the browser asks
+	// for when empty
+	AllowHeaders []string `yaml:"allowHeaders"`
+	// ExposeHeaders are the response headers scripts may read
+	ExposeHeaders []string `yaml:"exposeHeaders"`
+	// AllowCredentials lets browsers send cookies and Authorization
+	AllowCredentials bool `yaml:"allowCredentials"`
+	// MaxAge is how long browsers may cache a preflight response
+	MaxAge time.Duration `yaml:"maxAge"`
+}
+
+// corsResponseHeaders are dropped from upstream responses of routes with a
+// CORSPolicy
+var corsResponseHeaders = []string{
+	"Access-Control-Allow-Origin",
+	"Access-Control-Allow-Credentials",
+	"Access-Control-Allow-Methods",
+	"Access-Control-Allow-Headers",
+	"Access-Control-Expose-Headers",
+	"Access-Control-Max-Age",
+}
+
+func (p *CORSPolicy) validate() error {
+	if len(p.AllowOrigins) == 0 {
+		return errors.New("allowOrigins is required")
+	}
+	if p.AllowCredentials && slices.Contains(p.AllowOrigins, "*") {
+		return errors.New("allowCredentials cannot be combined with the * origin")
+	}
+	if p.MaxAge < 0 {
+		return errors.New("maxAge must not be negative")
+	}
+	return nil
+}
+
+func (p *CORSPolicy) allowsOrigin(origin string) bool {
+	return origin != "" && (slices.Contains(p.AllowOrigins, "*") || slices.Contains(p.AllowOrigins, origin))
+}
+
+// isPreflight reports whether r is a CORS preflight request
+func isPreflight(r *http.Request) bool {
+	return r.Method == http.MethodOptions && r.Header.Get("Origin") != "" &&
+		r.Header.Get("Access-Control-Request-Method") != ""
+}
+
+// setOrigin marks the response to a request from an allowed origin
+func (p *CORSPolicy) setOrigin(h http.Header, origin string) {
+	if slices.Contains(p.AllowOrigins, "*") {
+		h.Set("Access-Control-Allow-Origin", "*")
+	} else {
+		h.Set("Access-Control-Allow-Origin", origin)
+		h.Add("Vary", "Origin")
+	}
+	if p.AllowCredentials {
+		h.Set("Access-Control-Allow-Credentials", "true")
+	}
+}
+
+// apply sets the CORS headers of an actual request's response. Requests from
+// other origins get none and are left for the browser to block.
+func (p *CORSPolicy) apply(w http.ResponseWriter, r *http.Request) {
+	origin := r.Header.Get("Origin")
+	if !p.allowsOrigin(origin) {
+		return
+	}
+	p.setOrigin(w.Header(), origin)
+	if len(p.ExposeHeaders) > 0 {
+		w.Header().Set("Access-Control-Expose-Headers", strings.Join(p.ExposeHeaders, ", "))
+	}
+}
+
+// preflight answers a preflight request for a route accepting methods, any
+// method when methods is nil
+func (p *CORSPolicy) preflight(w http.ResponseWriter, r *http.Request, methods []string) {
+	h := w.Header()
+	h.Add("Vary", "Origin, Access-Control-Request-Method, Access-Control-Request-Headers")
+	origin := r.Header.Get("Origin")
+	method := r.Header.Get("Access-Control-Request-Method")
+	if !p.allowsOrigin(origin) || (methods != nil && !slices.Contains(methods, method)) {
+		http.Error(w, "CORS request not allowed", http.StatusForbidden)
+		return
+	}
+	p.setOrigin(h, origin)
+	if methods == nil {
+		methods = []string{method}
+	}
+	h.Set("Access-Control-Allow-Methods", strings.Join(methods, ", "))
+	if len(p.AllowHeaders) > 0 {
+		h.Set("Access-Control-Allow-Headers", strings.Join(p.AllowHeaders, ", "))
+	} else if requested := r.Header.Get("Access-Control-Request-Headers"); requested != "" {
+		h.Set("Access-Control-Allow-Headers", requested)
+	}
+	if p.MaxAge > 0 {
+		h.Set("Access-Control-Max-Age", strconv.Itoa(int(p.MaxAge.Seconds())))
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func removeCORSHeaders(h http.Header) {
+	for _, name := range corsResponseHeaders {
+		h.Del(name)
+	}
+}
@@ -0,0 +1,133 @@
+package forward
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestMethodChainsAndCORS(t *testing.T) {
+	hits := 0
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits++
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Write([]byte(`{"code":200}`))
+	}))
+	defer upstream.Close()
+
+	config, err := ParseConfig([]byte(`
+baseUrl: ` + upstream.URL + `
+cors: {allowOrigins: [https://admin.example.com, https://console.example.com]}
+routes:
+  - path: /system/message
+    methods: [GET]
+    auth: referer
+    cors:
+      allowOrigins: [https://admin.example.com]
+      allowCredentials: true
+      maxAge: 10m
+    perMethod:
+      post:
+        auth: token
+  - {path: /system/user, auth: referer}
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := NewProxyServer(config)
+
+	serve := func(method string, header map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/system/message", nil)
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		rec := httptest.NewRecorder()
+		proxy.ServeHTTP(rec, req)
+		return rec
+	}
+
+	// Each method runs its own chain
+	if rec := serve(http.MethodGet, map[string]string{"Referer": ValidReferer}); rec.Code != http.StatusOK {
+		t.Errorf("GET: got %d %s", rec.Code, rec.Body)
+	}
+	if rec := serve(http.MethodPost, map[string]string{"Referer": ValidReferer}); rec.Code != http.StatusUnauthorized {
+		t.Errorf("POST without token: got %d %s", rec.Code, rec.Body)
+	}
+
+	hits = 0
+	rec := serve(http.MethodDelete, map[string]string{"Referer": ValidReferer})
+	if rec.Code != http.StatusMethodNotAllowed || rec.Header().Get("Allow") != "GET, POST, OPTIONS" {
+		t.Errorf("DELETE: got %d, Allow %q", rec.Code, rec.Header().Get("Allow"))
+	}
+	rec = serve(http.MethodOptions, nil)
+	if rec.Code != http.StatusNoContent || rec.Header().Get("Allow") != "GET, POST, OPTIONS" {
+		t.Errorf("OPTIONS: got %d, Allow %q", rec.Code, rec.Header().Get("Allow"))
+	}
+
+	rec = serve(http.MethodOptions, map[string]string{
+		"Origin":                         "https://admin.example.com",
+		"Access-Control-Request-Method":  "POST",
+		"Access-Control-Request-Headers": "authorization, content-type",
+	})
+	want := map[string]string{
+		"Access-Control-Allow-Origin":      "https://admin.example.com",
+		"Access-Control-Allow-Credentials": "true",
+		"Access-Control-Allow-Methods":     "GET, POST",
+		"Access-Control-Allow-Headers":     "authorization, content-type",
+		"Access-Control-Max-Age":           "600",
+	}
+	if rec.Code != http.StatusNoContent {
+		t.Errorf("preflight: got %d %s", rec.Code, rec.Body)
+	}
+	for name, value := range want {
+		if got := rec.Header().Get(name); got != value {
+			t.Errorf("preflight %s: got %q, want %q", name, got, value)
+		}
+	}
+	for _, header := range []map[string]string{
+		{"Origin": "https://evil.example.com", "Access-Control-Request-Method": "GET"},
+		{"Origin": "https://admin.example.com", "Access-Control-Request-Method": "DELETE"},
+	} {
+		if rec := serve(http.MethodOptions, header); rec.Code != http.StatusForbidden || rec.Header().Get("Access-Control-Allow-Origin") != "" {
+			t.Errorf("preflight %v: got %d", header, rec.Code)
+		}
+	}
+	if hits != 0 {
+		t.Errorf("rejected and preflight requests reached the upstream %d times", hits)
+	}
+
+	// The proxy's policy replaces the upstream's
+	rec = serve(http.MethodGet, map[string]string{"Referer": ValidReferer, "Origin": "https://admin.example.com"})
+	if got := rec.Header().Values("Access-Control-Allow-Origin"); len(got) != 1 || got[0] != "https://admin.example.com" {
+		t.Errorf("GET from origin: Access-Control-Allow-Origin %q", got)
+	}
+
+	// Routes without a policy of their own pass the upstream's through
+	req := httptest.NewRequest(http.MethodGet, "/system/user", nil)
+	req.Header.Set("Referer", ValidReferer)
+	req.Header.Set("Origin", "https://admin.example.com")
+	rec = httptest.NewRecorder()
+	proxy.ServeHTTP(rec, req)
+	if got := rec.Header().Get("Access-Control-Allow-Origin"); rec.Code != http.StatusOK || got != "*" {
+		t.Errorf("GET /system/user: got %d, Access-Control-Allow-Origin %q", rec.Code, got)
+	}
+}
+
+func TestMethodChainsConfig(t *testing.T) {
+	tests := []struct {
+		spec RouteSpec
+		ok   bool
+	}{
+		{RouteSpec{Path: "/x", PerMethod: map[string]ChainSpec{"GET": {Auth: PluginSpec{Name: "referer"}}}}, true},
+		{RouteSpec{Path: "/x", Methods: []string{"GET"}, PerMethod: map[string]ChainSpec{"get": {Auth: PluginSpec{Name: "referer"}}}}, true},
+		{RouteSpec{Path: "/x", Methods: []string{"GET", "POST"}, PerMethod: map[string]ChainSpec{"GET": {Auth: PluginSpec{Name: "referer"}}}}, false},
+		{RouteSpec{Path: "/x", PerMethod: map[string]ChainSpec{"GET": {}}}, false},
+		{RouteSpec{Path: "/x", Auth: PluginSpec{Name: "referer"}, PerMethod: map[string]ChainSpec{"FETCH": {}}}, false},
+		{RouteSpec{Path: "/x", Auth: PluginSpec{Name: "referer"}, CORS: &CORSPolicy{AllowOrigins: []string{"*"}, AllowCredentials: true}}, false},
+	}
+	for i, tt := range tests {
+		if _, err := tt.spec.build(); (err == nil) != tt.ok {
+			t.Errorf("%d: got error %v", i, err)
+		}
+	}
+}
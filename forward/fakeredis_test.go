@@ -0,0 +1,246 @@
+package forward
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"e.coding.net/Love54dj/weizhong/etc/cache"
+	"github.com/redis/go-redis/v9"
+)
+
+// fakeRedis speaks enough RESP2 for the cache package: strings, hashes and
+// expiry. startFakeRedis points cache.Client at it for the rest of the test.
+type fakeRedis struct {
+	ln net.Listener
+
+	mu      sync.Mutex
+	values  map[string]string
+	hashes  map[string]map[string]string
+	expires map[string]time.Time
+}
+
+func startFakeRedis(t *testing.T) *fakeRedis {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fr := &fakeRedis{
+		ln:      ln,
+		values:  map[string]string{},
+		hashes:  map[string]map[string]string{},
+		expires: map[string]time.Time{},
+	}
+	go fr.serve()
+
+	prev := cache.Client
+	cache.Client = redis.NewClient(&redis.Options{Addr: ln.Addr().String(), Protocol: 2})
+	t.Cleanup(func() {
+		cache.Client.Close()
+		cache.Client = prev
+		ln.Close()
+	})
+	return fr
+}
+
+func (fr *fakeRedis) serve() {
+	for {
+		conn, err := fr.ln.Accept()
+		if err != nil {
+			return
+		}
+		go fr.handle(conn)
+	}
+}
+
+func (fr *fakeRedis) handle(conn net.Conn) {
+	defer conn.Close()
+	rd := bufio.NewReader(conn)
+	for {
+		args, err := readCommand(rd)
+		if err != nil {
+			return
+		}
+		fr.mu.Lock()
+		reply := fr.exec(args)
+		fr.mu.Unlock()
+		if _, err := io.WriteString(conn, reply); err != nil {
+			return
+		}
+	}
+}
+
+func readCommand(rd *bufio.Reader) ([]string, error) {
+	line, err := rd.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "*")))
+	if err != nil {
+		return nil, err
+	}
+	args := make([]string, n)
+	for i := range args {
+		if line, err = rd.ReadString('\n'); err != nil {
+			return nil, err
+		}
+		size, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "$")))
+		if err != nil {
+			return nil, err
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(rd, buf); err != nil {
+			return nil, err
+		}
+		args[i] = string(buf[:size])
+	}
+	return args, nil
+}
+
+func bulk(s string) string { return fmt.Sprintf("$%d\r\n%s\r\n", len(s), s) }
+func integer(n int) string { return fmt.Sprintf(":%d\r\n", n) }
+
+const nilReply = "$-1\r\n"
+
+// exists drops key once it has expired and reports whether it is still there
+func (fr *fakeRedis) exists(key string) bool {
+	if at, ok := fr.expires[key]; ok && !time.Now().Before(at) {
+		delete(fr.values, key)
+		delete(fr.hashes, key)
+		delete(fr.expires, key)
+	}
+	_, isValue := fr.values[key]
+	_, isHash := fr.hashes[key]
+	return isValue || isHash
+}
+
+func (fr *fakeRedis) del(key string) bool {
+	found := fr.exists(key)
+	delete(fr.values, key)
+	delete(fr.hashes, key)
+	delete(fr.expires, key)
+	return found
+}
+
+func (fr *fakeRedis) exec(args []string) string {
+	switch strings.ToUpper(args[0]) {
+	case "PING":
+		return "+PONG\r\n"
+	case "CLIENT":
+		return "+OK\r\n"
+	case "GET":
+		if !fr.exists(args[1]) {
+			return nilReply
+		}
+		return bulk(fr.values[args[1]])
+	case "SET":
+		key, nx, ttl := args[1], false, time.Duration(0)
+		for i := 3; i < len(args); i++ {
+			switch strings.ToUpper(args[i]) {
+			case "NX":
+				nx = true
+			case "EX", "PX":
+				n, _ := strconv.Atoi(args[i+1])
+				ttl = time.Duration(n) * time.Millisecond
+				if strings.EqualFold(args[i], "EX") {
+					ttl = time.Duration(n) * time.Second
+				}
+				i++
+			}
+		}
+		if nx && fr.exists(key) {
+			return nilReply
+		}
+		fr.del(key)
+		fr.values[key] = args[2]
+		if ttl > 0 {
+			fr.expires[key] = time.Now().Add(ttl)
+		}
+		return "+OK\r\n"
+	case "DEL":
+		n := 0
+		for _, key := range args[1:] {
+			if fr.del(key) {
+				n++
+			}
+		}
+		return integer(n)
+	case "EXISTS":
+		n := 0
+		for _, key := range args[1:] {
+			if fr.exists(key) {
+				n++
+			}
+		}
+		return integer(n)
+	case "HGET":
+		if !fr.exists(args[1]) {
+			return nilReply
+		}
+		value, ok := fr.hashes[args[1]][args[2]]
+		if !ok {
+			return nilReply
+		}
+		return bulk(value)
+	case "HSET":
+		if !fr.exists(args[1]) {
+			fr.hashes[args[1]] = map[string]string{}
+		}
+		n := 0
+		for i := 2; i+1 < len(args); i += 2 {
+			if _, ok := fr.hashes[args[1]][args[i]]; !ok {
+				n++
+			}
+			fr.hashes[args[1]][args[i]] = args[i+1]
+		}
+		return integer(n)
+	case "EXPIRE":
+		if !fr.exists(args[1]) {
+			return integer(0)
+		}
+		n, _ := strconv.Atoi(args[2])
+		fr.expires[args[1]] = time.Now().Add(time.Duration(n) * time.Second)
+		return integer(1)
+	}
+	return fmt.Sprintf("-ERR unknown command '%s'\r\n", args[0])
+}
+
+// ttl returns how long key has left to live, -1 without expiry and -2 when
+// it does not exist
+func (fr *fakeRedis) ttl(key string) time.Duration {
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+	if !fr.exists(key) {
+		return -2
+	}
+	at, ok := fr.expires[key]
+	if !ok {
+		return -1
+	}
+	return time.Until(at)
+}
+
+// keys returns the live keys starting with prefix
+func (fr *fakeRedis) keys(prefix string) []string {
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+	var keys []string
+	for key := range fr.values {
+		if strings.HasPrefix(key, prefix) && fr.exists(key) {
+			keys = append(keys, key)
+		}
+	}
+	for key := range fr.hashes {
+		if strings.HasPrefix(key, prefix) && fr.exists(key) {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
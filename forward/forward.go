@@ -3,20 +3,29 @@ package forward
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
+	"net/netip"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
-	"e.coding.net/Love54dj/weizhong/etc/ryconn"
+	"e.coding.net/Love54dj/weizhong/etc/cache"
+	"e.coding.net/Love54dj/weizhong/etc/metrics"
+	"github.com/gorilla/websocket"
 )
 
 // Constants
 const (
-	TestSessionID = "e5b21a57889541ffa01c6e387da971cd"
-	ValidReferer  = "https://servicewechat.com/"
+	ValidReferer = "https://servicewechat.com/"
+	// FixedLawyerId is the lawyer of the zero LawyerResolver.
+	//
+	// Deprecated: configure Config.Lawyer instead.
 	FixedLawyerId = "132"
 )
 
@@ -25,11 +34,99 @@ type Config struct {
 	BaseURL      string
 	LoginInfoURL string
 	Routes       map[string]*RouteConfig
+
+	// Upstreams are the RuoYi nodes behind BaseURL, used by routes without
+	// upstreams of their own and by the proxy's own lookups. BaseURL alone
+	// when empty.
+	Upstreams   []string
+	Balance     string // for Upstreams, BalanceRoundRobin (default) or BalanceLeastConn
+	HealthCheck HealthCheck
+
+	Lawyer     LawyerResolver // whose session sender IDs belong to
+	TestAccess TestAccess     // credentials for automated tests
+
+	// TrustedProxies may pass on the X-Forwarded-* headers of their clients;
+	// those of anyone else are replaced
+	TrustedProxies []netip.Prefix
+
+	// Recorder keeps the traffic of routes with Record set
+	Recorder *Recorder
+
+	// CORS is the policy of the admin API. Routes do not inherit it.
+	CORS *CORSPolicy
+
+	// Metrics exports Prometheus metrics at "GET /metrics" on the internal
+	// mux of a Server. Read when the Server is created.
+	Metrics bool
 }
 
 // RouteConfig holds the configuration for a specific route
 type RouteConfig struct {
 	TargetPath    string
+	Methods       []string // allowed methods, empty allows all
+	Upstreams     []string // base URLs, Config.Upstreams when empty
+	Balance       string   // BalanceRoundRobin (default) or BalanceLeastConn
+	AuthValidator AuthValidator
+	Middleware    []Middleware
+
+	// ResponseMiddleware runs on the upstream response, in order, before it
+	// is written to the client. Routes with response middleware are buffered.
+	ResponseMiddleware []ResponseMiddleware
+
+	// BufferResponse reads the whole upstream response before replying.
+	// Otherwise the body is streamed to the client as it arrives.
+	BufferResponse bool
+
+	// WebSocket proxies upgrade requests to the upstream WebSocket endpoint
+	// once AuthValidator and Middleware have accepted the handshake
+	WebSocket bool
+
+	// Timeout bounds each upstream attempt, DefaultTimeout when zero. It
+	// covers the whole exchange for buffered routes and the wait for response
+	// headers for streamed ones.
+	Timeout time.Duration
+
+	// Retries is how many more upstreams an idempotent request is tried on
+	// after a transport error, timeout or 502/503/504
+	Retries int
+
+	// Breaker fails requests fast with 503 while the upstream keeps erroring
+	Breaker BreakerConfig
+
+	// Disabled routes answer 503 without contacting the upstream
+	Disabled bool
+
+	// Idempotency replays the stored response to POSTs repeating an
+	// Idempotency-Key
+	Idempotency IdempotencyConfig
+
+	// MaxBodySize rejects larger request bodies with 413, unlimited when zero
+	MaxBodySize int64
+
+	// Schema rejects request bodies that do not match with 400
+	Schema *RequestSchema
+
+	// Headers filters the headers exchanged with the upstream and sets the
+	// Host it is sent
+	Headers HeaderPolicy
+
+	// Cache serves repeated GETs of a caller from Redis
+	Cache ResponseCacheConfig
+
+	// Record writes the route's requests and responses to Config.Recorder
+	Record bool
+
+	// MethodChains replace AuthValidator and Middleware for the methods they
+	// name. Those methods are allowed in addition to Methods.
+	MethodChains map[string]MethodChain
+
+	// CORS answers preflight requests from browsers on the allowed origins
+	// and marks the responses to them
+	CORS *CORSPolicy
+}
+
+// MethodChain authenticates and checks the requests of one method of a route
+type MethodChain struct {
 	AuthValidator AuthValidator
 	Middleware    []Middleware
 }
@@ -43,6 +140,7 @@ func DefaultConfig() *Config {
 		Routes: map[string]*RouteConfig{
 			"/system/message/list": {
 				TargetPath:    "/system/message/list",
+				Methods:       []string{http.MethodGet},
 				AuthValidator: &MessageListAuthValidator{},
 				Middleware: []Middleware{
 					&MessageListHandler{},
@@ -50,6 +148,7 @@ func DefaultConfig() *Config {
 			},
 			"/system/message": {
 				TargetPath:    "/system/message",
+				Methods:       []string{http.MethodPost},
 				AuthValidator: &MessageAuthValidator{},
 				Middleware: []Middleware{
 					&MessageHandler{},
@@ -58,7 +157,9 @@ func DefaultConfig() *Config {
 			"/logout": {
 				TargetPath:    "/logout",
 				AuthValidator: &RefererAuthValidator{},
-				Middleware:    []Middleware{},
+				Middleware: []Middleware{
+					&LogoutInvalidator{},
+				},
 			},
 		},
 	}
@@ -69,11 +170,70 @@ type AuthValidator interface {
 	Validate(r *http.Request) (string, error)
 }
 
+// RequestValidator is an AuthValidator that records what it learned on the
+// request, such as an admitted test credential. The proxy calls
+// ValidateRequest instead of Validate and hands the returned request on to
+// middleware and the upstream.
+type RequestValidator interface {
+	AuthValidator
+	ValidateRequest(r *http.Request) (*http.Request, string, error)
+}
+
 // Middleware defines the interface for request middleware
 type Middleware interface {
 	Process(w http.ResponseWriter, r *http.Request, auth string) error
 }
 
+// ResponseObserver is a Middleware that also learns the status the client
+// got, once the response has been written
+type ResponseObserver interface {
+	Middleware
+	Observe(r *http.Request, status int, auth string)
+}
+
+// UpstreamResponse is the buffered upstream response passed to ResponseMiddleware
+type UpstreamResponse struct {
+	StatusCode int
+	Header     http.Header
+	Body       []byte
+}
+
+// ResponseMiddleware defines the interface for middleware that inspects or
+// rewrites the upstream response. Returning an error rejects the response.
+type ResponseMiddleware interface {
+	ProcessResponse(r *http.Request, resp *UpstreamResponse, auth string) error
+}
+
+// StatusError is an error that replies with a specific HTTP status. Validators
+// and middleware return it to override the default status for their phase.
+type StatusError struct {
+	Code   int
+	Msg    string
+	Header http.Header // extra headers for the reply, may be nil
+}
+
+func (e *StatusError) Error() string {
+	return e.Msg
+}
+
+// NewStatusError creates a StatusError with a formatted message
+func NewStatusError(code int, format string, args ...any) *StatusError {
+	return &StatusError{Code: code, Msg: fmt.Sprintf(format, args...)}
+}
+
+// writeError replies with err, using the status of a StatusError or fallback
+func writeError(w http.ResponseWriter, err error, fallback int) {
+	status := fallback
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		status = statusErr.Code
+		for key, values := range statusErr.Header {
+			w.Header()[key] = values
+		}
+	}
+	http.Error(w, err.Error(), status)
+}
+
 // TokenAuthValidator validates authentication based on the Authorization header
 type TokenAuthValidator struct{}
 
@@ -82,7 +242,7 @@ func (v *TokenAuthValidator) Validate(r *http.Request) (string, error) {
 	if auth == "" {
 		return "", fmt.Errorf("unauthorized: missing authorization header")
 	}
-	_, err := ryconn.AuthToMobile(auth)
+	_, err := DefaultResolver.Resolve(r, auth)
 	if err != nil {
 		return "", err
 	}
@@ -106,14 +266,14 @@ type MessageListAuthValidator struct {
 }
 
 func (v *MessageListAuthValidator) Validate(r *http.Request) (string, error) {
-	// Special case for test session
-	targetUrl := r.URL.String()
-	if strings.Contains(targetUrl, TestSessionID) {
-		return "", nil
-	}
+	_, auth, err := v.ValidateRequest(r)
+	return auth, err
+}
 
-	// Otherwise use token validation
-	return v.TokenAuthValidator.Validate(r)
+// ValidateRequest admits the test credentials configured for this
+// environment and validates the token otherwise
+func (v *MessageListAuthValidator) ValidateRequest(r *http.Request) (*http.Request, string, error) {
+	return validateWithTestAccess(r, &v.TokenAuthValidator)
 }
 
 // MessageAuthValidator validates authentication for message
@@ -122,14 +282,26 @@ type MessageAuthValidator struct {
 }
 
 func (v *MessageAuthValidator) Validate(r *http.Request) (string, error) {
-	// Special case for test session
-	targetUrl := r.URL.String()
-	if strings.Contains(targetUrl, TestSessionID) {
-		return "", nil
-	}
+	_, auth, err := v.ValidateRequest(r)
+	return auth, err
+}
 
-	// Otherwise use token validation
-	return v.TokenAuthValidator.Validate(r)
+// ValidateRequest admits the test credentials configured for this
+// environment and validates the token otherwise
+func (v *MessageAuthValidator) ValidateRequest(r *http.Request) (*http.Request, string, error) {
+	return validateWithTestAccess(r, &v.TokenAuthValidator)
+}
+
+func validateWithTestAccess(r *http.Request, token *TokenAuthValidator) (*http.Request, string, error) {
+	admitted, err := admitTestAccess(r)
+	if err != nil {
+		return r, "", err
+	}
+	if admitted != nil {
+		return admitted, "", nil
+	}
+	auth, err := token.Validate(r)
+	return r, auth, err
 }
 
 // SenderIDValidator validates the sender ID in the request
@@ -141,19 +313,25 @@ func (m *SenderIDValidator) Process(w http.ResponseWriter, r *http.Request, auth
 		return fmt.Errorf("invalid URL format")
 	}
 
-	// Get userId
-	userId, err := GetIdByAuth(auth)
+	// Test credentials may only read their own session
+	if c := TestCredentialFrom(r); c != nil {
+		if c.SessionID == "" || r.URL.Query().Get("senderId") != c.SessionID {
+			return fmt.Errorf("invalid senderId")
+		}
+		return nil
+	}
+
+	if auth == "" {
+		return fmt.Errorf("empty authorization token")
+	}
+	senderId, err := DefaultResolver.SenderID(r, auth)
 	if err != nil {
 		return err
 	}
 
 	// Check senderId
 	requestSenderId := r.URL.Query().Get("senderId")
-	standardSenderId, err := GetSenderIdByAuth(userId, auth)
-	if err != nil {
-		return err
-	}
-	if requestSenderId != standardSenderId {
+	if requestSenderId != senderId {
 		return fmt.Errorf("invalid senderId")
 	}
 
@@ -162,7 +340,7 @@ func (m *SenderIDValidator) Process(w http.ResponseWriter, r *http.Request, auth
 
 // Message represents the message request body structure
 type Message struct {
-	ID         int64  `json:"id"`
+	ID         int64  `json:"id,omitempty"`
 	MsgText    string `json:"msgText"`
 	MsgType    int    `json:"msgType"`
 	SenderID   string `json:"senderId"`
@@ -183,55 +361,156 @@ func (m *MessageListHandler) Process(w http.ResponseWriter, r *http.Request, aut
 	return fmt.Errorf("unsupported HTTP method for /system/message/list: %s", r.Method)
 }
 
-// MessageHandler handles POST requests for message
-type MessageHandler struct{}
+// MessageHandler handles POST requests for message. By default it checks the
+// userId and senderId of the body against the caller. With InjectIdentity it
+// instead sets both from the authenticated identity, rejects unknown fields
+// and forwards the re-encoded body, so clients cannot spoof either.
+type MessageHandler struct {
+	InjectIdentity bool `yaml:"injectIdentity"`
+}
+
+func newMessageHandler(opts Options) (Middleware, error) {
+	m := &MessageHandler{}
+	if err := opts.Decode(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
 
 func (m *MessageHandler) Process(w http.ResponseWriter, r *http.Request, auth string) error {
 	// Only handle POST requests for message
-	if r.Method == http.MethodPost {
-		// Read and parse the request body
-		var msg Message
-		body, err := io.ReadAll(r.Body)
-		if err != nil {
-			return fmt.Errorf("error reading request body: %v", err)
-		}
+	if r.Method != http.MethodPost {
+		return fmt.Errorf("unsupported HTTP method for /system/message: %s", r.Method)
+	}
+	if m.InjectIdentity {
+		return m.injectIdentity(r, auth)
+	}
 
-		// Create a new reader from the body for the forwarded request
-		r.Body = io.NopCloser(bytes.NewBuffer(body))
+	// Read and parse the request body
+	var msg Message
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return fmt.Errorf("error reading request body: %v", err)
+	}
 
-		// Unmarshal the JSON body
-		if err := json.Unmarshal(body, &msg); err != nil {
-			return fmt.Errorf("invalid JSON format: %v", err)
-		}
+	// Create a new reader from the body for the forwarded request
+	r.Body = io.NopCloser(bytes.NewBuffer(body))
 
-		// Validate that senderId and userId
-		if msg.SenderID == "" {
-			return fmt.Errorf("missing senderId in request body")
-		}
+	// Unmarshal the JSON body
+	if err := json.Unmarshal(body, &msg); err != nil {
+		return fmt.Errorf("invalid JSON format: %v", err)
+	}
+
+	// Validate that senderId and userId
+	if msg.SenderID == "" {
+		return fmt.Errorf("missing senderId in request body")
+	}
 
-		if msg.UserID == 0 {
-			return fmt.Errorf("missing or invalid userId in request body")
+	if msg.UserID == 0 {
+		return fmt.Errorf("missing or invalid userId in request body")
+	}
+
+	// Test credentials may only post to their own session
+	if c := TestCredentialFrom(r); c != nil {
+		if c.SessionID == "" || msg.SenderID != c.SessionID {
+			return fmt.Errorf("invalid senderId")
 		}
+		return nil
+	}
+
+	senderId, err := senderIdForUser(r, strconv.Itoa(msg.UserID), auth)
+	if err != nil {
+		return err
+	}
+
+	if senderId != msg.SenderID {
+		return fmt.Errorf("invalid senderId")
+	}
+
+	return nil
+}
+
+// injectIdentity rewrites the message body with the caller's userId and senderId
+func (m *MessageHandler) injectIdentity(r *http.Request, auth string) error {
+	var msg Message
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&msg); err != nil {
+		return fmt.Errorf("invalid JSON format: %v", err)
+	}
+	if dec.More() {
+		return fmt.Errorf("invalid JSON format: unexpected data after message")
+	}
 
-		senderId, err := GetSenderIdByAuth(strconv.Itoa(msg.UserID), auth)
+	if c := TestCredentialFrom(r); c != nil {
+		// Test sessions have no RuoYi user, keep the userId of the test client
+		if c.SessionID == "" || msg.UserID == 0 {
+			return fmt.Errorf("missing senderId or userId for test credential")
+		}
+		msg.SenderID = c.SessionID
+	} else {
+		identity, err := DefaultResolver.Resolve(r, auth)
 		if err != nil {
 			return err
 		}
-
-		if senderId != msg.SenderID {
-			return fmt.Errorf("invalid senderId")
+		if msg.UserID, err = strconv.Atoi(identity.UserID); err != nil {
+			return fmt.Errorf("invalid userId %q: %v", identity.UserID, err)
+		}
+		if msg.SenderID, err = DefaultResolver.SenderID(r, auth); err != nil {
+			return err
+		}
+		if msg.SenderID == "" {
+			return fmt.Errorf("no session for user %s", identity.UserID)
 		}
+	}
 
-		return nil
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	setRequestBody(r, body)
+	return nil
+}
+
+// setRequestBody replaces the body of r, keeping the length headers in line
+func setRequestBody(r *http.Request, body []byte) {
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	r.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(body)), nil
 	}
+	r.ContentLength = int64(len(body))
+	r.TransferEncoding = nil
+	r.Header.Del("Transfer-Encoding")
+	r.Header.Set("Content-Length", strconv.Itoa(len(body)))
+}
 
-	return fmt.Errorf("unsupported HTTP method for /system/message: %s", r.Method)
+// senderIdForUser returns the sender ID of userId in the session r addresses,
+// using the cached identity when userId is the caller
+func senderIdForUser(r *http.Request, userId string, auth string) (string, error) {
+	var identity *Identity
+	if auth != "" {
+		var err error
+		identity, err = DefaultResolver.Resolve(r, auth)
+		if err == nil && identity.UserID == userId {
+			return DefaultResolver.SenderID(r, auth)
+		}
+	}
+	counterpart, err := requestConfig(r).Lawyer.Resolve(r, identity)
+	if err != nil {
+		return "", err
+	}
+	return lookupSenderId(requestRoutes(r), userId, counterpart, auth)
 }
 
 // ProxyServer represents the proxy server
 type ProxyServer struct {
-	Config *Config
+	Config *Config // use SetConfig to replace while serving
 	Client *http.Client
+
+	mu      sync.RWMutex
+	table   *routeTable
+	adminMu sync.Mutex // serialises changes through the admin API
+	stats   routeStats
 }
 
 // NewProxyServer creates a new proxy server with the given configuration
@@ -239,10 +518,96 @@ func NewProxyServer(config *Config) *ProxyServer {
 	if config == nil {
 		config = DefaultConfig()
 	}
-	return &ProxyServer{
+	s := &ProxyServer{
 		Config: config,
-		Client: &http.Client{},
+		Client: metrics.InstrumentClient("forward", &http.Client{}),
+		table:  compileRoutes(config, nil),
+	}
+	s.exportBreakers()
+	return s
+}
+
+// SetConfig atomically replaces the running configuration. Requests already
+// in flight finish with the configuration they started with.
+func (s *ProxyServer) SetConfig(config *Config) {
+	s.mu.Lock()
+	old := s.table
+	s.Config = config
+	s.table = compileRoutes(config, old)
+	s.mu.Unlock()
+	if old != nil {
+		old.close()
+	}
+}
+
+// Close stops the background health checks of the proxy and closes its
+// recording
+func (s *ProxyServer) Close() {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.table != nil {
+		s.table.close()
+	}
+	if s.Config != nil && s.Config.Recorder != nil {
+		s.Config.Recorder.Close()
+	}
+}
+
+// routes returns the compiled routes of the running configuration
+func (s *ProxyServer) routes() *routeTable {
+	s.mu.RLock()
+	table := s.table
+	current := table != nil && table.config == s.Config
+	s.mu.RUnlock()
+	if current {
+		return table
+	}
+
+	// Config was assigned directly rather than through SetConfig
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.table == nil || s.table.config != s.Config {
+		old := s.table
+		s.table = compileRoutes(s.Config, old)
+		if old != nil {
+			old.close()
+		}
+	}
+	return s.table
+}
+
+// allowedMethods lists the methods the route accepts, nil when it accepts
+// any
+func (rc *RouteConfig) allowedMethods() []string {
+	if len(rc.Methods) == 0 && len(rc.MethodChains) == 0 {
+		return nil
+	}
+	methods := slices.Clone(rc.Methods)
+	for _, m := range sortedKeys(rc.MethodChains) {
+		if !slices.Contains(methods, m) {
+			methods = append(methods, m)
+		}
+	}
+	return methods
+}
+
+// allowsMethod reports whether the route accepts the given method
+func (rc *RouteConfig) allowsMethod(method string) bool {
+	if len(rc.Methods) == 0 && len(rc.MethodChains) == 0 {
+		return true
+	}
+	if _, ok := rc.MethodChains[method]; ok {
+		return true
 	}
+	return slices.Contains(rc.Methods, method)
+}
+
+// chain returns the validator and middleware for requests of method
+func (rc *RouteConfig) chain(method string) (AuthValidator, []Middleware) {
+	if chain, ok := rc.MethodChains[method]; ok {
+		return chain.AuthValidator, chain.Middleware
+	}
+	return rc.AuthValidator, rc.Middleware
 }
 
 // ServeHTTP handles HTTP requests
@@ -251,153 +616,228 @@ func (s *ProxyServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	// Log the HTTP method and path
 	log.Printf("[REQUEST] Method: %s, Path: %s", r.Method, path)
 
-	routeConfig, exists := s.Config.Routes[path]
-	if !exists {
+	table := s.routes()
+	match := table.match(path)
+	if match == nil {
 		log.Printf("[ERROR] Route not found for path: %s", path)
 		http.Error(w, "Not found", http.StatusNotFound)
 		return
 	}
+	routeConfig := match.route
+	rec := &statusRecorder{ResponseWriter: w}
+	w = rec
+	start := time.Now()
+	defer func() {
+		s.stats.counters(match.path).record(rec.statusCode())
+		observeRequest(match.path, r.Method, rec.statusCode(), time.Since(start))
+	}()
+	ensureRequestID(w, r)
+	var recording *Recording
+	if recorder := table.config.Recorder; recorder != nil && routeConfig.Record && !websocket.IsWebSocketUpgrade(r) {
+		var finish func()
+		w, recording, finish = recorder.startRecording(w, r, match.path)
+		defer finish()
+	}
+
+	// Answered before any authentication reaches the upstream
+	if cors := routeConfig.CORS; cors != nil {
+		if isPreflight(r) {
+			cors.preflight(w, r, routeConfig.allowedMethods())
+			return
+		}
+		cors.apply(w, r)
+	}
+	if !routeConfig.allowsMethod(r.Method) {
+		allow := routeConfig.allowedMethods()
+		if !slices.Contains(allow, http.MethodOptions) {
+			allow = append(allow, http.MethodOptions)
+		}
+		w.Header().Set("Allow", strings.Join(allow, ", "))
+		if r.Method == http.MethodOptions {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		log.Printf("[ERROR] Method %s not allowed for path: %s", r.Method, path)
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if routeConfig.Disabled {
+		log.Printf("[ERROR] Route disabled: %s", match.path)
+		http.Error(w, "Route disabled", http.StatusServiceUnavailable)
+		return
+	}
+
+	// Expose the configuration, route and captured path parameters to
+	// validators and middleware
+	r = withRoutes(withRoutePattern(r, match.path), table)
+	for name, value := range match.params {
+		r.SetPathValue(name, value)
+	}
 
 	// Validate authentication
-	auth, err := routeConfig.AuthValidator.Validate(r)
+	validator, middlewares := routeConfig.chain(r.Method)
+	var auth string
+	var err error
+	if rv, ok := validator.(RequestValidator); ok {
+		r, auth, err = rv.ValidateRequest(r)
+	} else {
+		auth, err = validator.Validate(r)
+	}
 	if err != nil {
 		log.Printf("[ERROR] Authentication failed for path: %s, error: %v", path, err)
-		http.Error(w, err.Error(), http.StatusUnauthorized)
+		writeError(w, err, http.StatusUnauthorized)
 		return
 	}
 	log.Printf("[INFO] Authentication successful for path: %s", path)
 
+	if !checkRequestBody(w, r, routeConfig) {
+		return
+	}
+
 	// Apply middleware
-	for i, middleware := range routeConfig.Middleware {
+	for i, middleware := range middlewares {
 		log.Printf("[INFO] Applying middleware %d for path: %s", i, path)
 		if err := middleware.Process(w, r, auth); err != nil {
 			log.Printf("[ERROR] Middleware %d failed for path: %s, error: %v", i, path, err)
-			http.Error(w, err.Error(), http.StatusBadRequest)
+			writeError(w, err, http.StatusBadRequest)
 			return
 		}
 	}
 
 	// Forward the request
-	log.Printf("[INFO] Forwarding request to target path: %s", routeConfig.TargetPath)
-	s.forwardRequest(w, r, routeConfig.TargetPath)
-}
+	targetPath := match.targetPath()
+	if recording != nil {
+		recording.Target = targetPath
+		if r.URL.RawQuery != "" {
+			recording.Target += "?" + maskMobiles(r.URL.RawQuery, "")
+		}
+	}
+	if routeConfig.WebSocket && websocket.IsWebSocketUpgrade(r) {
+		log.Printf("[INFO] Proxying websocket to target path: %s", targetPath)
+		s.proxyWebSocket(w, r, table.pools[routeConfig], targetPath, routeConfig)
+		return
+	}
+	log.Printf("[INFO] Forwarding request to target path: %s", targetPath)
+	forward := func(w http.ResponseWriter) {
+		s.forwardRequest(w, r, table.pools[routeConfig], table.breakers[match.path], targetPath, routeConfig, auth)
+	}
+	switch {
+	case routeConfig.Idempotency.Window > 0 && r.Method == http.MethodPost && r.Header.Get(IdempotencyKeyHeader) != "":
+		s.forwardIdempotent(w, r, routeConfig, auth, forward)
+	case routeConfig.Cache.TTL > 0 && r.Method == http.MethodGet && cache.Ready():
+		s.forwardCached(w, r, routeConfig, auth, forward)
+	default:
+		forward(w)
+	}
 
-// forwardRequest forwards the request to the target server
-func (s *ProxyServer) forwardRequest(w http.ResponseWriter, r *http.Request, targetPath string) {
-	// Build target URL
-	targetURL := s.Config.BaseURL + targetPath
-	if r.URL.RawQuery != "" {
-		targetURL += "?" + r.URL.RawQuery
+	// Once the write is done, so stale responses are not cached again
+	if routes := table.invalidates[match.path]; len(routes) > 0 && !isSafeMethod(r.Method) && cache.Ready() {
+		invalidateResponses(r, auth, routes)
+	}
+	for _, middleware := range middlewares {
+		if observer, ok := middleware.(ResponseObserver); ok {
+			observer.Observe(r, rec.statusCode(), auth)
+		}
 	}
+}
 
-	// Create new request
-	req, err := http.NewRequest(r.Method, targetURL, r.Body)
+// forwardRequest forwards the request to the target server
+func (s *ProxyServer) forwardRequest(w http.ResponseWriter, r *http.Request, pool *upstreamPool, breaker *circuitBreaker, targetPath string, routeConfig *RouteConfig, auth string) {
+	call, err := s.send(r, pool, breaker, targetPath, routeConfig)
 	if err != nil {
-		log.Printf("Error creating request: %v", err)
-		http.Error(w, "Error creating request: "+err.Error(), http.StatusInternalServerError)
+		writeUpstreamError(w, err)
 		return
 	}
-
-	// Copy headers from client request
-	for key, value := range r.Header {
-		req.Header[key] = value
+	defer call.close()
+	resp := call.resp
+	filterResponseHeader(resp.Header, &routeConfig.Headers)
+	if routeConfig.CORS != nil {
+		removeCORSHeaders(resp.Header)
 	}
 
-	// Send request to target server
-	resp, err := s.Client.Do(req)
-	if err != nil {
-		log.Printf("Error making request to %s: %v", targetURL, err)
-		http.Error(w, "Error making request: "+err.Error(), http.StatusInternalServerError)
+	if !routeConfig.BufferResponse && len(routeConfig.ResponseMiddleware) == 0 {
+		call.headersReceived()
+		streamResponse(w, r, resp)
 		return
 	}
-	defer resp.Body.Close()
 
 	// Read response body
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
 		log.Printf("Error reading response body: %v", err)
+		if call.timedOut() {
+			writeUpstreamError(w, errUpstreamTimeout)
+			return
+		}
 		http.Error(w, "Error reading response body: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
 
+	// Apply response middleware
+	upstreamResp := &UpstreamResponse{StatusCode: resp.StatusCode, Header: resp.Header, Body: body}
+	for i, middleware := range routeConfig.ResponseMiddleware {
+		if err := middleware.ProcessResponse(r, upstreamResp, auth); err != nil {
+			log.Printf("[ERROR] Response middleware %d failed for path: %s, error: %v", i, r.URL.Path, err)
+			writeError(w, err, http.StatusBadGateway)
+			return
+		}
+	}
+	if len(routeConfig.ResponseMiddleware) > 0 {
+		upstreamResp.Header.Set("Content-Length", strconv.Itoa(len(upstreamResp.Body)))
+	}
+
 	// Set response headers and status code
-	for key, values := range resp.Header {
+	for key, values := range upstreamResp.Header {
 		for _, value := range values {
 			w.Header().Add(key, value)
 		}
 	}
-	w.WriteHeader(resp.StatusCode)
+	w.WriteHeader(upstreamResp.StatusCode)
 
 	// Write response body to client
-	_, err = w.Write(body)
+	_, err = w.Write(upstreamResp.Body)
 	if err != nil {
 		log.Printf("Error writing response: %v", err)
 	}
 }
 
-// GetIdByAuth retrieves the user ID using the authentication token
-func GetIdByAuth(auth string) (string, error) {
+// GetIdByAuth retrieves the user ID using the authentication token, checked
+// by the proxy serving r, or with DefaultConfig when r is nil
+func GetIdByAuth(r *http.Request, auth string) (string, error) {
 	if auth == "" {
 		return "", fmt.Errorf("empty authorization token")
 	}
-
-	config := DefaultConfig()
-	req, err := http.NewRequest("GET", config.LoginInfoURL, nil)
-	if err != nil {
-		return "", err
-	}
-	req.Header.Set("Authorization", auth)
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	identity, err := DefaultResolver.Resolve(r, auth)
 	if err != nil {
 		return "", err
 	}
-	defer resp.Body.Close()
+	return identity.UserID, nil
+}
 
-	// Read the response body
-	bodyBytes, err := io.ReadAll(resp.Body)
+// GetSenderIdByAuth retrieves the sender ID using the user ID and authentication
+// token, in the session with the default lawyer
+func GetSenderIdByAuth(userId string, auth string) (string, error) {
+	counterpart, err := DefaultConfig().Lawyer.Resolve(nil, nil)
 	if err != nil {
 		return "", err
 	}
+	return GetSenderIdFor(userId, counterpart, auth)
+}
 
-	// Print the response body
-	// fmt.Println("Response body:", string(bodyBytes))
-
-	// Create a new reader from the bytes for JSON decoding
-	bodyReader := bytes.NewReader(bodyBytes)
-
-	var data struct {
-		Data struct {
-			Id int `json:"id"`
-		} `json:"data"`
-	}
-	if err := json.NewDecoder(bodyReader).Decode(&data); err != nil {
-		return "", err
-	}
-	return strconv.Itoa(data.Data.Id), nil
+// GetSenderIdFor retrieves the sender ID of userId in the session with
+// counterpart, from the backend of the default configuration
+func GetSenderIdFor(userId string, counterpart Counterpart, auth string) (string, error) {
+	return lookupSenderId(defaultRoutes(), userId, counterpart, auth)
 }
 
-// GetSenderIdByAuth retrieves the sender ID using the user ID and authentication token
-func GetSenderIdByAuth(userId string, auth string) (string, error) {
+// lookupSenderId asks the RuoYi nodes of table for the sender ID of userId
+// in the session with counterpart
+func lookupSenderId(table *routeTable, userId string, counterpart Counterpart, auth string) (string, error) {
 	if userId == "" || auth == "" {
 		return "", fmt.Errorf("empty userId or authorization token")
 	}
 
-	config := DefaultConfig()
-	req, err := http.NewRequest("GET", fmt.Sprintf("%s/system/session/digital/%s/%s", config.BaseURL, userId, FixedLawyerId), nil)
-	if err != nil {
-		return "", err
-	}
-	req.Header.Set("Authorization", auth)
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		return "", err
-	}
-	defer resp.Body.Close()
-
-	// Read the response body
-	bodyBytes, err := io.ReadAll(resp.Body)
+	bodyBytes, err := table.lookups.get(counterpart.sessionPath(userId), auth)
 	if err != nil {
 		return "", err
 	}
@@ -419,20 +859,79 @@ func GetSenderIdByAuth(userId string, auth string) (string, error) {
 	return data.Data.SenderId, nil
 }
 
-// ServeOnPort starts the proxy server on the specified port
+// ServeOnPort starts the proxy server on the specified port and serves until
+// SIGINT or SIGTERM, letting active requests finish
 func ServeOnPort(port int) {
-	proxyServer := NewProxyServer(nil) // Use default config
+	serve(ServeOptions{Addr: fmt.Sprintf(":%d", port)}) // Use default config
+}
+
+// ServeOnPortWithRoutes starts the proxy server on the specified port with
+// the routes declared in routesFile, reloading them when the file changes or
+// the process receives SIGHUP
+func ServeOnPortWithRoutes(port int, routesFile string) {
+	serve(ServeOptions{Addr: fmt.Sprintf(":%d", port), RoutesFile: routesFile})
+}
 
-	// Register handlers for each route
-	for route := range proxyServer.Config.Routes {
-		http.Handle(route, proxyServer)
+func serve(opts ServeOptions) {
+	if err := Serve(opts); err != nil {
+		log.Fatal(err)
 	}
+}
 
-	log.Printf("Starting proxy server on port :%d", port)
-	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", port), nil))
+// ServeOptions says how Serve runs the proxy. Only Addr is required.
+type ServeOptions struct {
+	Addr       string // e.g. ":9304"
+	RoutesFile string // watched for changes, the built-in routes when empty
+
+	// TLSCertFile and TLSKeyFile switch the listener to HTTPS when both are set
+	TLSCertFile string
+	TLSKeyFile  string
+
+	// InternalAddr serves the admin API and, with Config.Metrics, the
+	// metrics. Keep it off the public network.
+	InternalAddr string
+	// AdminTokens maps operator names to their admin API tokens. The admin
+	// API is off without any.
+	AdminTokens map[string]string
+	// AuditLog keeps the admin audit trail across restarts, in memory only
+	// when empty
+	AuditLog string
+}
+
+// Serve runs the proxy as opts say until SIGINT or SIGTERM, letting active
+// requests finish
+func Serve(opts ServeOptions) error {
+	var config *Config
+	if opts.RoutesFile != "" {
+		var err error
+		if config, err = LoadConfigFile(opts.RoutesFile); err != nil {
+			return fmt.Errorf("loading route file %s: %w", opts.RoutesFile, err)
+		}
+	}
+	proxy := NewProxyServer(config)
+	if opts.RoutesFile != "" {
+		defer proxy.WatchConfigFile(opts.RoutesFile, 2*time.Second)()
+	}
+
+	server := NewServer(opts.Addr, proxy)
+	if proxy.routes().config.Metrics {
+		server.InternalAddr = opts.InternalAddr
+	}
+	if len(opts.AdminTokens) > 0 {
+		if opts.AuditLog != "" {
+			if err := OpenAuditLog(opts.AuditLog); err != nil {
+				return fmt.Errorf("opening audit log %s: %w", opts.AuditLog, err)
+			}
+		}
+		server.InternalAddr = opts.InternalAddr
+		server.InternalMux.Handle("/admin/", http.StripPrefix("/admin", proxy.AdminHandler(opts.AdminTokens)))
+	}
+	server.TLSCertFile, server.TLSKeyFile = opts.TLSCertFile, opts.TLSKeyFile
+	return server.Run()
 }
 
-// AddRoute adds a new route to the proxy server configuration
+// AddRoute adds a new route to the proxy server configuration. To change the
+// routes of a running server, build a new Config and pass it to SetConfig.
 func AddRoute(config *Config, path string, targetPath string, authValidator AuthValidator, middleware ...Middleware) {
 	if config.Routes == nil {
 		config.Routes = make(map[string]*RouteConfig)
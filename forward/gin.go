@@ -0,0 +1,109 @@
+package forward
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// GinHandler serves the proxy from gin. basePath is stripped from the request
+// path before matching, for proxies mounted on a RouterGroup. Matching stays
+// with the proxy, so the handler also serves routes added by later reloads,
+// e.g. as engine.NoRoute(proxy.GinHandler("")).
+func (s *ProxyServer) GinHandler(basePath string) gin.HandlerFunc {
+	basePath = strings.TrimSuffix(basePath, "/")
+	var handler http.Handler = s
+	if basePath != "" {
+		handler = http.StripPrefix(basePath, s)
+	}
+	return func(c *gin.Context) {
+		handler.ServeHTTP(c.Writer, c.Request)
+	}
+}
+
+// RegisterGin registers every route of the running configuration on router,
+// an Engine or a RouterGroup, so gin middleware such as logging and recovery
+// runs in front of the proxy. Validators, middleware and method checks keep
+// working as with ServeHTTP. Routes gin cannot hold next to the others, such
+// as a prefix sharing a segment with an exact route, are reported in the
+// error and left to a NoRoute fallback.
+func (s *ProxyServer) RegisterGin(router gin.IRouter) error {
+	basePath := ""
+	if group, ok := router.(interface{ BasePath() string }); ok {
+		basePath = group.BasePath()
+	}
+	handler := s.GinHandler(basePath)
+
+	table := s.routes()
+	paths := make([]string, 0, len(table.config.Routes))
+	for path := range table.config.Routes {
+		paths = append(paths, path)
+	}
+	// Register the most precise routes first, gin rejects the conflicting ones
+	sort.Slice(paths, func(i, j int) bool {
+		pi, pj := isPatternPath(paths[i]), isPatternPath(paths[j])
+		if pi != pj {
+			return !pi
+		}
+		return paths[i] < paths[j]
+	})
+
+	var conflicts []string
+	for _, path := range paths {
+		ginPath, err := ginPattern(path)
+		if err != nil {
+			conflicts = append(conflicts, fmt.Sprintf("%s: %v", path, err))
+			continue
+		}
+		if err := registerAny(router, ginPath, handler); err != nil {
+			conflicts = append(conflicts, fmt.Sprintf("%s: %v", path, err))
+		}
+	}
+	if len(conflicts) > 0 {
+		return fmt.Errorf("routes not registered on gin: %s", strings.Join(conflicts, "; "))
+	}
+	return nil
+}
+
+// registerAny turns gin's panic on conflicting routes into an error
+func registerAny(router gin.IRouter, path string, handler gin.HandlerFunc) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+	router.Any(path, handler)
+	return nil
+}
+
+// ginPattern converts a route path to gin syntax: {id} becomes :id, and
+// {rest...} or a trailing slash a catch-all parameter
+func ginPattern(path string) (string, error) {
+	if !isPatternPath(path) {
+		return path, nil
+	}
+	p, err := parsePattern(path)
+	if err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	for _, seg := range p.segments {
+		b.WriteString("/")
+		if seg.param != "" {
+			b.WriteString(":" + seg.param)
+		} else {
+			b.WriteString(seg.literal)
+		}
+	}
+	if p.prefix {
+		rest := p.rest
+		if rest == "" {
+			rest = "remainder"
+		}
+		b.WriteString("/*" + rest)
+	}
+	return b.String(), nil
+}
@@ -0,0 +1,53 @@
+package forward
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestRegisterGin(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.URL.Path)
+	}))
+	defer upstream.Close()
+
+	config := &Config{BaseURL: upstream.URL}
+	validator := &pathValueValidator{}
+	AddRoute(config, "/system/message/list", "/system/message/list", &pathValueValidator{})
+	AddRoute(config, "/session/{userId}/{lawyerId}", "/system/session/digital/{userId}/{lawyerId}", validator)
+	AddRoute(config, "/files/{path...}", "/static/{path...}", &pathValueValidator{})
+	config.Routes["/system/message/list"].Methods = []string{http.MethodGet}
+	proxy := NewProxyServer(config)
+
+	gin.SetMode(gin.TestMode)
+	engine := gin.New()
+	if err := proxy.RegisterGin(engine.Group("/api")); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		method, path string
+		code         int
+		body         string
+	}{
+		{http.MethodGet, "/api/system/message/list", http.StatusOK, "/system/message/list"},
+		{http.MethodGet, "/api/session/7/132", http.StatusOK, "/system/session/digital/7/132"},
+		{http.MethodGet, "/api/files/a/b.txt", http.StatusOK, "/static/a/b.txt"},
+		{http.MethodPost, "/api/system/message/list", http.StatusMethodNotAllowed, ""},
+		{http.MethodGet, "/system/message/list", http.StatusNotFound, ""},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		engine.ServeHTTP(rec, httptest.NewRequest(tt.method, tt.path, nil))
+		if rec.Code != tt.code || (tt.body != "" && rec.Body.String() != tt.body) {
+			t.Errorf("%s %s: got %d %q", tt.method, tt.path, rec.Code, rec.Body.String())
+		}
+	}
+	if validator.seen != "7" {
+		t.Errorf("validator saw userId %q", validator.seen)
+	}
+}
@@ -0,0 +1,246 @@
+package forward
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strings"
+)
+
+// RequestIDHeader correlates a request across the proxy and upstream logs. A
+// client supplied ID is kept, otherwise the proxy assigns one; either way it
+// is echoed in the response.
+const RequestIDHeader = "X-Request-ID"
+
+// HostPreserve as HeaderPolicy.Host forwards the Host the client asked for
+const HostPreserve = "preserve"
+
+// hopHeaders only apply to a single connection and are never forwarded, in
+// either direction (RFC 9110, section 7.6.1)
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// Forwarding headers, set by the proxy and only trusted from TrustedProxies
+var forwardingHeaders = []string{"X-Forwarded-For", "X-Forwarded-Host", "X-Forwarded-Proto", "X-Real-Ip"}
+
+// HeaderPolicy controls which headers a route exchanges with its upstream.
+// Header names are matched case-insensitively. Hop-by-hop headers are always
+// dropped and the forwarding headers and RequestIDHeader always set.
+type HeaderPolicy struct {
+	// Allow forwards only these client headers when set. List Authorization
+	// if the upstream needs the caller's token.
+	Allow []string `yaml:"allow"`
+	// Deny drops these client headers
+	Deny []string `yaml:"deny"`
+	// ResponseDeny drops these upstream headers from the response
+	ResponseDeny []string `yaml:"responseDeny"`
+	// Host is sent upstream: the upstream's own host when empty, the client's
+	// with HostPreserve, or the given value
+	Host string `yaml:"host"`
+}
+
+func containsHeader(list []string, name string) bool {
+	return slices.ContainsFunc(list, func(s string) bool { return strings.EqualFold(s, name) })
+}
+
+func (hp *HeaderPolicy) allows(name string) bool {
+	if len(hp.Allow) > 0 && !containsHeader(hp.Allow, name) {
+		return false
+	}
+	return !containsHeader(hp.Deny, name)
+}
+
+// upstreamHost returns the Host to send for a client request to clientHost,
+// empty for the upstream's own
+func (hp *HeaderPolicy) upstreamHost(clientHost string) string {
+	if hp.Host == HostPreserve {
+		return clientHost
+	}
+	return hp.Host
+}
+
+// removeHopHeaders deletes the hop-by-hop headers of h, including those the
+// Connection header names
+func removeHopHeaders(h http.Header) {
+	for _, value := range h["Connection"] {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				h.Del(name)
+			}
+		}
+	}
+	for _, name := range hopHeaders {
+		h.Del(name)
+	}
+}
+
+// outboundHeader returns the headers to send upstream for r
+func outboundHeader(r *http.Request, policy *HeaderPolicy, trusted []netip.Prefix) http.Header {
+	h := r.Header.Clone()
+	removeHopHeaders(h)
+	// Test credentials are for the proxy, not the upstream and its logs
+	h.Del(TestAccessHeader)
+	for name := range h {
+		if !policy.allows(name) {
+			delete(h, name)
+		}
+	}
+	// Ask for trailers only if the client did, as they are end-to-end
+	if slices.ContainsFunc(r.Header.Values("Te"), func(v string) bool { return strings.Contains(v, "trailers") }) {
+		h.Set("Te", "trailers")
+	}
+	setForwardingHeaders(h, r, trusted)
+	return h
+}
+
+// setForwardingHeaders records the client in h. The forwarding headers of r
+// are extended when r comes from a trusted proxy and replaced otherwise, so
+// clients cannot pose as someone else.
+func setForwardingHeaders(h http.Header, r *http.Request, trusted []netip.Prefix) {
+	fromProxy := isTrustedProxy(remoteIP(r), trusted)
+	for _, name := range forwardingHeaders {
+		h.Del(name)
+	}
+
+	chain := forwardedChain(r, trusted)
+	h.Set("X-Forwarded-For", strings.Join(chain, ", "))
+	h.Set("X-Real-IP", chainClient(chain, trusted))
+
+	host, proto := r.Host, "http"
+	if r.TLS != nil {
+		proto = "https"
+	}
+	if fromProxy {
+		if v := r.Header.Get("X-Forwarded-Host"); v != "" {
+			host = v
+		}
+		if v := r.Header.Get("X-Forwarded-Proto"); v != "" {
+			proto = v
+		}
+	}
+	h.Set("X-Forwarded-Host", host)
+	h.Set("X-Forwarded-Proto", proto)
+}
+
+// forwardedChain returns the addresses r passed through, the client first
+// and the directly connected peer last. X-Forwarded-For, or X-Real-IP from
+// proxies setting only that, counts only when the peer is trusted.
+func forwardedChain(r *http.Request, trusted []netip.Prefix) []string {
+	remote := remoteIP(r)
+	var chain []string
+	if isTrustedProxy(remote, trusted) {
+		for _, value := range r.Header.Values("X-Forwarded-For") {
+			for _, ip := range strings.Split(value, ",") {
+				if ip = strings.TrimSpace(ip); ip != "" {
+					chain = append(chain, ip)
+				}
+			}
+		}
+		if ip := strings.TrimSpace(r.Header.Get("X-Real-IP")); len(chain) == 0 && ip != "" {
+			chain = append(chain, ip)
+		}
+	}
+	return append(chain, remote)
+}
+
+// chainClient returns the last address of chain that is not one of our
+// proxies
+func chainClient(chain []string, trusted []netip.Prefix) string {
+	for i := len(chain) - 1; i >= 0; i-- {
+		if !isTrustedProxy(chain[i], trusted) {
+			return chain[i]
+		}
+	}
+	return chain[0]
+}
+
+func isTrustedProxy(ip string, trusted []netip.Prefix) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, prefix := range trusted {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseTrustedProxies parses CIDR prefixes and single addresses
+func ParseTrustedProxies(values []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(values))
+	for _, value := range values {
+		if !strings.Contains(value, "/") {
+			addr, err := netip.ParseAddr(value)
+			if err != nil {
+				return nil, err
+			}
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(value)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+// filterResponseHeader removes the headers of an upstream response that must
+// not reach the client
+func filterResponseHeader(h http.Header, policy *HeaderPolicy) {
+	removeHopHeaders(h)
+	for _, name := range policy.ResponseDeny {
+		h.Del(name)
+	}
+	// The proxy echoes its own
+	h.Del(RequestIDHeader)
+}
+
+// ensureRequestID makes sure r carries a request ID and echoes it to the
+// client
+func ensureRequestID(w http.ResponseWriter, r *http.Request) string {
+	id := r.Header.Get(RequestIDHeader)
+	if !validRequestID(id) {
+		id = newRequestID()
+		r.Header.Set(RequestIDHeader, id)
+	}
+	w.Header().Set(RequestIDHeader, id)
+	return id
+}
+
+// validRequestID accepts IDs of up to 128 printable ASCII characters
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+func newRequestID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(fmt.Sprintf("forward: reading random bytes: %v", err))
+	}
+	return hex.EncodeToString(b[:])
+}
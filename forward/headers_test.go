@@ -0,0 +1,78 @@
+package forward
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+)
+
+func TestForwardHeaders(t *testing.T) {
+	var got *http.Request
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r
+		w.Header().Set("Keep-Alive", "timeout=5")
+		w.Header().Set("X-Powered-By", "RuoYi")
+		w.Header().Set(RequestIDHeader, "upstream")
+	}))
+	defer upstream.Close()
+
+	config := &Config{BaseURL: upstream.URL, TrustedProxies: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}}
+	AddRoute(config, "/public", "/public", &RefererAuthValidator{})
+	config.Routes["/public"].Headers = HeaderPolicy{Deny: []string{"cookie"}, ResponseDeny: []string{"X-Powered-By"}, Host: "ruoyi.internal"}
+	proxy := NewProxyServer(config)
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		xff        string
+		realIP     string
+		wantXFF    string
+		wantRealIP string
+	}{
+		{"direct", "192.0.2.1:1234", "", "", "192.0.2.1", "192.0.2.1"},
+		{"spoofed", "192.0.2.1:1234", "1.2.3.4", "5.6.7.8", "192.0.2.1", "192.0.2.1"},
+		{"trusted proxy", "10.0.0.2:1234", "198.51.100.7, 10.0.0.3", "", "198.51.100.7, 10.0.0.3, 10.0.0.2", "198.51.100.7"},
+		{"trusted proxy setting X-Real-IP", "10.0.0.2:1234", "", "198.51.100.8", "198.51.100.8, 10.0.0.2", "198.51.100.8"},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/public", nil)
+		req.RemoteAddr = tt.remoteAddr
+		req.Header.Set("Referer", ValidReferer)
+		req.Header.Set("Connection", "X-Secret")
+		req.Header.Set("X-Secret", "1")
+		req.Header.Set("Cookie", "a=b")
+		req.Header.Set("Accept", "application/json")
+		if tt.xff != "" {
+			req.Header.Set("X-Forwarded-For", tt.xff)
+		}
+		if tt.realIP != "" {
+			req.Header.Set("X-Real-IP", tt.realIP)
+		}
+		rec := httptest.NewRecorder()
+		proxy.ServeHTTP(rec, req)
+
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s: got %d", tt.name, rec.Code)
+		}
+		if v := got.Header.Get("X-Forwarded-For"); v != tt.wantXFF {
+			t.Errorf("%s: X-Forwarded-For %q, want %q", tt.name, v, tt.wantXFF)
+		}
+		if v := got.Header.Get("X-Real-IP"); v != tt.wantRealIP {
+			t.Errorf("%s: X-Real-IP %q, want %q", tt.name, v, tt.wantRealIP)
+		}
+		if got.Header.Get("X-Secret") != "" || got.Header.Get("Cookie") != "" || got.Header.Get("Accept") == "" {
+			t.Errorf("%s: forwarded headers %v", tt.name, got.Header)
+		}
+		if got.Host != "ruoyi.internal" {
+			t.Errorf("%s: Host %q", tt.name, got.Host)
+		}
+		id := rec.Header().Get(RequestIDHeader)
+		if id == "" || id != got.Header.Get(RequestIDHeader) {
+			t.Errorf("%s: request ID %q sent upstream as %q", tt.name, id, got.Header.Get(RequestIDHeader))
+		}
+		if rec.Header().Get("Keep-Alive") != "" || rec.Header().Get("X-Powered-By") != "" {
+			t.Errorf("%s: response headers %v", tt.name, rec.Header())
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package forward
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// startServer serves handler until the test ends
+func startServer(t *testing.T, handler http.HandlerFunc) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	return server
+}
+
+// testProxy serves config until the test ends, in front of upstream when it
+// is not nil. Routes without an AuthValidator accept every request and routes
+// without a TargetPath forward to their own path.
+func testProxy(t *testing.T, config *Config, upstream http.HandlerFunc) *ProxyServer {
+	t.Helper()
+	if upstream != nil {
+		config.BaseURL = startServer(t, upstream).URL
+	}
+	for path, route := range config.Routes {
+		if route.AuthValidator == nil {
+			route.AuthValidator = &pathValueValidator{}
+		}
+		if route.TargetPath == "" {
+			route.TargetPath = path
+		}
+	}
+	proxy := NewProxyServer(config)
+	t.Cleanup(proxy.Close)
+	return proxy
+}
+
+// newRequest builds a request with header lines such as "Authorization: x"
+func newRequest(method, target, body string, header ...string) *http.Request {
+	var reader io.Reader
+	if body != "" {
+		reader = strings.NewReader(body)
+	}
+	req := httptest.NewRequest(method, target, reader)
+	for _, line := range header {
+		name, value, _ := strings.Cut(line, ": ")
+		req.Header.Set(name, value)
+	}
+	return req
+}
+
+// record passes req through handler
+func record(handler http.Handler, req *http.Request) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	return rec
+}
+
+// echo answers with the request body, appending it to received when not nil
+func echo(received *[]string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if received != nil {
+			*received = append(*received, string(body))
+		}
+		w.Write(body)
+	}
+}
@@ -0,0 +1,236 @@
+package forward
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"e.coding.net/Love54dj/weizhong/etc/cache"
+)
+
+// IdempotencyKeyHeader lets clients retry a POST without repeating its effect
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+// IdempotencyConfig enables Idempotency-Key handling on a route. The first
+// response for a key of a caller is stored in Redis for Window and replayed
+// to retries, while duplicates arriving before it is complete wait for it.
+type IdempotencyConfig struct {
+	Window  time.Duration `yaml:"window"`  // zero disables, e.g. 24h
+	MaxWait time.Duration `yaml:"maxWait"` // how long duplicates wait, 30s when zero
+}
+
+const (
+	idempotencyPrefix  = "forward:idempotency:"
+	idempotencyMaxBody = 1 << 20 // larger responses are not stored
+	idempotencyPoll    = 100 * time.Millisecond
+)
+
+// storedHeaders are the response headers kept with stored responses. They
+// describe the body, the others belong to the original exchange.
+var storedHeaders = []string{
+	"Content-Type", "Content-Encoding", "Content-Language", "Content-Disposition",
+	"Location", "ETag", "Last-Modified",
+}
+
+// storableHeader returns the storedHeaders of h
+func storableHeader(h http.Header) http.Header {
+	stored := http.Header{}
+	for _, name := range storedHeaders {
+		if values := h.Values(name); len(values) > 0 {
+			stored[name] = values
+		}
+	}
+	return stored
+}
+
+// storedResponse is what Redis holds under an idempotency key. Pending
+// entries mark a request still in flight.
+type storedResponse struct {
+	Pending     bool        `json:"pending,omitempty"`
+	Fingerprint string      `json:"fingerprint"`
+	Status      int         `json:"status,omitempty"`
+	Header      http.Header `json:"header,omitempty"`
+	Body        []byte      `json:"body,omitempty"`
+}
+
+// forwardIdempotent runs forward at most once per Idempotency-Key of a caller
+// within the route's window
+func (s *ProxyServer) forwardIdempotent(w http.ResponseWriter, r *http.Request, routeConfig *RouteConfig, auth string, forward func(http.ResponseWriter)) {
+	if !cache.Ready() {
+		forward(w)
+		return
+	}
+	config := routeConfig.Idempotency
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Error reading request body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	sum := sha256.Sum256(append([]byte(r.Method+" "+r.URL.RequestURI()+"\n"), body...))
+	fingerprint := hex.EncodeToString(sum[:])
+
+	keySum := sha256.Sum256([]byte(r.Header.Get(IdempotencyKeyHeader)))
+	key := idempotencyPrefix + RoutePattern(r) + ":" + callerSubject(r, auth) + ":" + hex.EncodeToString(keySum[:])
+
+	// Claim the key for as long as the request may take
+	timeout := routeConfig.Timeout
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+	pending, _ := json.Marshal(storedResponse{Pending: true, Fingerprint: fingerprint})
+	claimed, err := cache.SetNX(key, string(pending), time.Duration(routeConfig.Retries+1)*timeout+10*time.Second)
+	if err != nil {
+		// Better a possible duplicate than a failed message
+		log.Printf("[ERROR] Idempotency check failed for %s: %v", key, err)
+		forward(w)
+		return
+	}
+	if claimed {
+		s.forwardAndStore(w, key, fingerprint, config.Window, forward)
+		return
+	}
+
+	maxWait := config.MaxWait
+	if maxWait <= 0 {
+		maxWait = 30 * time.Second
+	}
+	deadline := time.Now().Add(maxWait)
+	for {
+		var stored storedResponse
+		raw := cache.Get(key)
+		if raw == "" {
+			// The first request failed and released the key, try again ourselves
+			s.forwardIdempotent(w, r, routeConfig, auth, forward)
+			return
+		}
+		if err := json.Unmarshal([]byte(raw), &stored); err != nil {
+			log.Printf("[ERROR] Invalid idempotency entry %s: %v", key, err)
+			forward(w)
+			return
+		}
+		if stored.Fingerprint != fingerprint {
+			http.Error(w, "Idempotency-Key reused with a different request", http.StatusUnprocessableEntity)
+			return
+		}
+		if !stored.Pending {
+			log.Printf("[INFO] Replaying stored response for %s", RoutePattern(r))
+			for name, values := range stored.Header {
+				w.Header()[name] = values
+			}
+			w.Header().Set("Idempotent-Replayed", "true")
+			w.Header().Set("Content-Length", strconv.Itoa(len(stored.Body)))
+			w.WriteHeader(stored.Status)
+			w.Write(stored.Body)
+			return
+		}
+		if time.Now().After(deadline) {
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "A request with this Idempotency-Key is still in progress", http.StatusConflict)
+			return
+		}
+		select {
+		case <-r.Context().Done():
+			return
+		case <-time.After(idempotencyPoll):
+		}
+	}
+}
+
+// forwardAndStore forwards the request that claimed key and stores its
+// response. Server errors release the key so the client can retry.
+func (s *ProxyServer) forwardAndStore(w http.ResponseWriter, key, fingerprint string, window time.Duration, forward func(http.ResponseWriter)) {
+	capture := &captureWriter{ResponseWriter: w, limit: idempotencyMaxBody}
+	forward(capture)
+
+	status := capture.statusCode()
+	if status >= http.StatusInternalServerError || capture.overflow {
+		if err := cache.Del(key); err != nil {
+			log.Printf("[ERROR] Releasing idempotency key failed: %v", err)
+		}
+		return
+	}
+	data, err := json.Marshal(storedResponse{
+		Fingerprint: fingerprint,
+		Status:      status,
+		Header:      storableHeader(capture.Header()),
+		Body:        capture.body.Bytes(),
+	})
+	if err == nil {
+		err = cache.SetEx(key, string(data), window)
+	}
+	if err != nil {
+		log.Printf("[ERROR] Storing idempotent response failed: %v", err)
+		cache.Del(key)
+	}
+}
+
+// callerSubject scopes Redis keys to the caller, so clients cannot replay
+// or read each other's responses
+func callerSubject(r *http.Request, auth string) string {
+	if c := TestCredentialFrom(r); c != nil {
+		return "test:" + c.Name
+	}
+	if auth != "" {
+		if identity, err := DefaultResolver.Resolve(r, auth); err == nil {
+			return "user:" + identity.UserID
+		}
+		sum := sha256.Sum256([]byte(auth))
+		return "token:" + hex.EncodeToString(sum[:])
+	}
+	return "ip:" + clientIP(r)
+}
+
+// captureWriter passes the response through while keeping a copy of it of up
+// to limit bytes
+type captureWriter struct {
+	http.ResponseWriter
+	limit    int
+	status   int
+	body     bytes.Buffer
+	overflow bool
+}
+
+func (cw *captureWriter) WriteHeader(status int) {
+	if cw.status == 0 {
+		cw.status = status
+	}
+	cw.ResponseWriter.WriteHeader(status)
+}
+
+func (cw *captureWriter) Write(b []byte) (int, error) {
+	if cw.status == 0 {
+		cw.status = http.StatusOK
+	}
+	if !cw.overflow {
+		if cw.body.Len()+len(b) > cw.limit {
+			cw.overflow = true
+			cw.body.Reset()
+		} else {
+			cw.body.Write(b)
+		}
+	}
+	return cw.ResponseWriter.Write(b)
+}
+
+func (cw *captureWriter) Flush() {
+	http.NewResponseController(cw.ResponseWriter).Flush()
+}
+
+func (cw *captureWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
+
+func (cw *captureWriter) statusCode() int {
+	if cw.status == 0 {
+		return http.StatusOK
+	}
+	return cw.status
+}
@@ -0,0 +1,192 @@
+package forward
+
+import (
+	"compress/gzip"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// orderUpstream creates orders, answering 201 with a Location, gzipped when
+// the request accepts it. It answers 500 while failing is set and holds each
+// request until release is closed when hold is set.
+type orderUpstream struct {
+	hits    atomic.Int32
+	failing atomic.Bool
+	hold    chan struct{} // receives each request while held, when not nil
+	release chan struct{}
+}
+
+func (u *orderUpstream) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	n := u.hits.Add(1)
+	if u.hold != nil {
+		u.hold <- struct{}{}
+		<-u.release
+	}
+	if u.failing.Load() {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", "/orders/1")
+	w.Header().Set("X-Upstream-Request", "1") // not kept for replays
+	body := `{"id": 1, "attempt": ` + strconv.Itoa(int(n)) + `}`
+	if strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+		w.Header().Set("Content-Encoding", "gzip")
+		w.WriteHeader(http.StatusCreated)
+		zw := gzip.NewWriter(w)
+		zw.Write([]byte(body))
+		zw.Close()
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+	w.Write([]byte(body))
+}
+
+// ordersConfig keeps the responses of /orders for a minute
+func ordersConfig(maxWait time.Duration) *Config {
+	return &Config{Routes: map[string]*RouteConfig{"/orders": {
+		Idempotency: IdempotencyConfig{Window: time.Minute, MaxWait: maxWait},
+	}}}
+}
+
+func postOrder(proxy *ProxyServer, key, body string, header ...string) *httptest.ResponseRecorder {
+	return record(proxy, newRequest(http.MethodPost, "/orders", body, append(header, IdempotencyKeyHeader+": "+key)...))
+}
+
+func TestIdempotencyStoresFirstResponse(t *testing.T) {
+	fr := startFakeRedis(t)
+	upstream := &orderUpstream{}
+	proxy := testProxy(t, ordersConfig(0), upstream.ServeHTTP)
+
+	first := postOrder(proxy, "k1", `{"item": 1}`, "Accept-Encoding: gzip")
+	if first.Code != http.StatusCreated || first.Body.String() != `{"id": 1, "attempt": 1}` {
+		t.Fatalf("got %d %q, want the plain upstream response", first.Code, first.Body)
+	}
+	if keys := fr.keys(idempotencyPrefix); len(keys) != 1 {
+		t.Fatalf("got stored keys %q, want one", keys)
+	}
+
+	// Replayed to a client that does not accept gzip
+	replay := postOrder(proxy, "k1", `{"item": 1}`)
+	if replay.Code != http.StatusCreated || replay.Body.String() != first.Body.String() {
+		t.Errorf("got %d %q, want the stored response", replay.Code, replay.Body)
+	}
+	if n := upstream.hits.Load(); n != 1 {
+		t.Errorf("upstream got %d requests, want 1", n)
+	}
+	h := replay.Header()
+	if h.Get("Idempotent-Replayed") != "true" || h.Get("Content-Type") != "application/json" || h.Get("Location") != "/orders/1" {
+		t.Errorf("replay is missing headers: %v", h)
+	}
+	if h.Get("Content-Encoding") != "" || h.Get("X-Upstream-Request") != "" {
+		t.Errorf("replay carries headers of the original exchange: %v", h)
+	}
+
+	// Another key is another request
+	if rec := postOrder(proxy, "k2", `{"item": 1}`); rec.Header().Get("Idempotent-Replayed") != "" {
+		t.Error("a new key was answered from the store")
+	}
+	if n := upstream.hits.Load(); n != 2 {
+		t.Errorf("upstream got %d requests, want 2", n)
+	}
+}
+
+func TestIdempotencyDuplicateWaitsForFirst(t *testing.T) {
+	startFakeRedis(t)
+	upstream := &orderUpstream{}
+	upstream.hold, upstream.release = make(chan struct{}, 2), make(chan struct{})
+	proxy := testProxy(t, ordersConfig(5*time.Second), upstream.ServeHTTP)
+
+	results := make(chan *httptest.ResponseRecorder, 2)
+	go func() { results <- postOrder(proxy, "k1", "{}") }()
+	<-upstream.hold
+	go func() { results <- postOrder(proxy, "k1", "{}") }()
+
+	// The duplicate polls the pending entry instead of reaching the upstream
+	select {
+	case rec := <-results:
+		t.Fatalf("got %d %q while the first request was pending", rec.Code, rec.Body)
+	case <-time.After(3 * idempotencyPoll):
+	}
+	close(upstream.release)
+
+	var replayed int
+	for i := 0; i < 2; i++ {
+		rec := <-results
+		if rec.Code != http.StatusCreated || rec.Body.String() != `{"id": 1, "attempt": 1}` {
+			t.Errorf("got %d %q", rec.Code, rec.Body)
+		}
+		if rec.Header().Get("Idempotent-Replayed") == "true" {
+			replayed++
+		}
+	}
+	if replayed != 1 {
+		t.Errorf("got %d replayed responses, want 1", replayed)
+	}
+	if n := upstream.hits.Load(); n != 1 {
+		t.Errorf("upstream got %d requests, want 1", n)
+	}
+}
+
+func TestIdempotencyDuplicateGivesUp(t *testing.T) {
+	startFakeRedis(t)
+	upstream := &orderUpstream{}
+	upstream.hold, upstream.release = make(chan struct{}, 2), make(chan struct{})
+	proxy := testProxy(t, ordersConfig(2*idempotencyPoll), upstream.ServeHTTP)
+
+	done := make(chan struct{})
+	go func() {
+		postOrder(proxy, "k1", "{}")
+		close(done)
+	}()
+	<-upstream.hold
+	rec := postOrder(proxy, "k1", "{}")
+	if rec.Code != http.StatusConflict || rec.Header().Get("Retry-After") == "" {
+		t.Errorf("got %d %v, want 409 with Retry-After", rec.Code, rec.Header())
+	}
+	close(upstream.release)
+	<-done
+}
+
+func TestIdempotencyKeyReuse(t *testing.T) {
+	startFakeRedis(t)
+	upstream := &orderUpstream{}
+	proxy := testProxy(t, ordersConfig(0), upstream.ServeHTTP)
+
+	postOrder(proxy, "k1", `{"item": 1}`)
+	rec := postOrder(proxy, "k1", `{"item": 2}`)
+	if rec.Code != http.StatusUnprocessableEntity {
+		t.Errorf("got %d %q, want 422", rec.Code, rec.Body)
+	}
+	if n := upstream.hits.Load(); n != 1 {
+		t.Errorf("upstream got %d requests, want 1", n)
+	}
+}
+
+func TestIdempotencyServerErrorReleasesKey(t *testing.T) {
+	fr := startFakeRedis(t)
+	upstream := &orderUpstream{}
+	proxy := testProxy(t, ordersConfig(0), upstream.ServeHTTP)
+
+	upstream.failing.Store(true)
+	if rec := postOrder(proxy, "k1", "{}"); rec.Code != http.StatusInternalServerError {
+		t.Fatalf("got %d, want the upstream 500", rec.Code)
+	}
+	if keys := fr.keys(idempotencyPrefix); len(keys) != 0 {
+		t.Fatalf("key %q still held after a 500", keys)
+	}
+
+	upstream.failing.Store(false)
+	rec := postOrder(proxy, "k1", "{}")
+	if rec.Code != http.StatusCreated || rec.Header().Get("Idempotent-Replayed") != "" {
+		t.Errorf("got %d %v, want the retry to reach the upstream", rec.Code, rec.Header())
+	}
+	if n := upstream.hits.Load(); n != 2 {
+		t.Errorf("upstream got %d requests, want 2", n)
+	}
+}
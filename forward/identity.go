@@ -0,0 +1,200 @@
+package forward
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"e.coding.net/Love54dj/weizhong/etc/cache"
+	"e.coding.net/Love54dj/weizhong/etc/metrics"
+	"e.coding.net/Love54dj/weizhong/etc/ryconn"
+)
+
+// Identity is what the proxy knows about the caller behind a token. Sender
+// IDs depend on the session a request addresses and are looked up by SenderID.
+type Identity struct {
+	Mobile    string `json:"mobile"`
+	UserID    string `json:"userId"`
+	LawyerID  int    `json:"lawyerId"`
+	MediateID int    `json:"mediateId"`
+	ChannelID int    `json:"channelId"`
+}
+
+// IdentityResolver turns Authorization tokens into identities. Results are
+// cached in Redis when the cache package is initialised, and concurrent
+// lookups of the same token share a single upstream round trip.
+type IdentityResolver struct {
+	TTL       time.Duration
+	KeyPrefix string
+
+	mu       sync.Mutex
+	inflight map[string]*identityCall
+}
+
+type identityCall struct {
+	done     chan struct{}
+	identity *Identity
+	err      error
+}
+
+// DefaultResolver is used by the built-in validators and middleware
+var DefaultResolver = &IdentityResolver{
+	TTL:       2 * time.Minute,
+	KeyPrefix: "forward:identity:",
+}
+
+// upstreamClient is shared by the lookups against the RuoYi backend
+var upstreamClient = metrics.InstrumentClient("ruoyi", &http.Client{Timeout: 10 * time.Second})
+
+// cacheKey hashes the token so raw credentials never end up in Redis. The
+// loginInfo of the proxy serving r is part of it, as a token means nothing
+// to another backend.
+func (res *IdentityResolver) cacheKey(r *http.Request, auth string) string {
+	sum := sha256.Sum256([]byte(requestRoutes(r).loginInfoURL() + "\n" + strings.TrimPrefix(auth, "Bearer ")))
+	return res.KeyPrefix + hex.EncodeToString(sum[:])
+}
+
+// Resolve returns the identity behind auth, checked with the loginInfo of the
+// proxy serving r, from cache when possible
+func (res *IdentityResolver) Resolve(r *http.Request, auth string) (*Identity, error) {
+	key := res.cacheKey(r, auth)
+	if cache.Ready() {
+		if cached := cache.Get(key); cached != "" {
+			var identity Identity
+			if err := json.Unmarshal([]byte(cached), &identity); err == nil {
+				return &identity, nil
+			}
+		}
+	}
+
+	res.mu.Lock()
+	if call, ok := res.inflight[key]; ok {
+		res.mu.Unlock()
+		<-call.done
+		return call.identity, call.err
+	}
+	call := &identityCall{done: make(chan struct{})}
+	if res.inflight == nil {
+		res.inflight = map[string]*identityCall{}
+	}
+	res.inflight[key] = call
+	res.mu.Unlock()
+
+	call.identity, call.err = res.fetch(r, auth)
+	if call.err == nil && cache.Ready() {
+		if data, err := json.Marshal(call.identity); err == nil {
+			if err := cache.SetEx(key, string(data), res.TTL); err != nil {
+				log.Printf("[ERROR] Caching identity failed: %v", err)
+			}
+		}
+	}
+
+	res.mu.Lock()
+	delete(res.inflight, key)
+	res.mu.Unlock()
+	close(call.done)
+	return call.identity, call.err
+}
+
+// Invalidate drops the cached identity for auth
+func (res *IdentityResolver) Invalidate(r *http.Request, auth string) {
+	if auth == "" || !cache.Ready() {
+		return
+	}
+	if err := cache.Del(res.cacheKey(r, auth)); err != nil {
+		log.Printf("[ERROR] Invalidating identity failed: %v", err)
+	}
+}
+
+// fetch checks auth against the loginInfo of the proxy serving r, on its
+// RuoYi nodes when loginInfo is below BaseURL
+func (res *IdentityResolver) fetch(r *http.Request, auth string) (*Identity, error) {
+	if !strings.HasPrefix(auth, "Bearer ") {
+		auth = "Bearer " + auth
+	}
+	table := requestRoutes(r)
+	body, err := table.lookup(table.loginInfoURL(), auth)
+	if err != nil {
+		return nil, err
+	}
+	user, err := ryconn.ParseLoginInfo(body)
+	if err != nil {
+		return nil, err
+	}
+	return &Identity{
+		Mobile:    user.Mobile,
+		UserID:    strconv.Itoa(user.ID),
+		LawyerID:  user.LawyerID,
+		MediateID: user.MediateID,
+		ChannelID: user.ChannelID,
+	}, nil
+}
+
+// SenderID returns the caller's sender ID in the session with the lawyer r
+// addresses, as determined by the LawyerResolver of the proxy serving r.
+// Sessions are looked up on first use and cached like identities.
+func (res *IdentityResolver) SenderID(r *http.Request, auth string) (string, error) {
+	identity, err := res.Resolve(r, auth)
+	if err != nil {
+		return "", err
+	}
+	table := requestRoutes(r)
+	config := table.config
+	counterpart, err := config.Lawyer.Resolve(r, identity)
+	if err != nil {
+		return "", err
+	}
+
+	// Sessions never change owner, so cache them for as long as identities
+	key := res.KeyPrefix + "session:" + config.BaseURL + counterpart.sessionPath(identity.UserID)
+	if cache.Ready() {
+		if senderId := cache.Get(key); senderId != "" {
+			return senderId, nil
+		}
+	}
+	senderId, err := lookupSenderId(table, identity.UserID, counterpart, auth)
+	if err != nil {
+		return "", err
+	}
+	if senderId != "" && cache.Ready() {
+		if err := cache.SetEx(key, senderId, res.TTL); err != nil {
+			log.Printf("[ERROR] Caching sender ID failed: %v", err)
+		}
+	}
+	return senderId, nil
+}
+
+// LogoutInvalidator drops the cached identity of the caller once the upstream
+// logout succeeded, for use on the logout route. Tokens that a JWTValidator
+// of the proxy verifies are revoked as well.
+type LogoutInvalidator struct{}
+
+func (m *LogoutInvalidator) Process(w http.ResponseWriter, r *http.Request, auth string) error {
+	return nil
+}
+
+func (m *LogoutInvalidator) Observe(r *http.Request, status int, auth string) {
+	if status < 200 || status >= 300 {
+		log.Printf("[ERROR] Logout failed upstream with status %d, keeping the login", status)
+		return
+	}
+	if auth == "" {
+		auth = r.Header.Get("Authorization")
+	}
+	DefaultResolver.Invalidate(r, auth)
+	for _, v := range requestRoutes(r).jwt {
+		revoked, err := v.Revoke(auth)
+		if err != nil {
+			log.Printf("[ERROR] Revoking token failed: %v", err)
+		}
+		if revoked || err != nil {
+			return
+		}
+	}
+}
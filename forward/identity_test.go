@@ -0,0 +1,165 @@
+package forward
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingRuoYi answers loginInfo and session lookups for user 7, counting
+// both. Session lookups fail while sessionsDown is set.
+type countingRuoYi struct {
+	*httptest.Server
+	logins, sessions atomic.Int32
+	sessionsDown     atomic.Bool
+	delay            time.Duration
+}
+
+func startCountingRuoYi(t *testing.T, delay time.Duration) *countingRuoYi {
+	t.Helper()
+	ry := &countingRuoYi{delay: delay}
+	ry.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/system/loginInfo":
+			ry.logins.Add(1)
+			time.Sleep(ry.delay)
+			io.WriteString(w, `{"code": 200, "data": {"id": 7, "mobile": "13800000007"}}`)
+		case "/system/session/digital/7/" + FixedLawyerId:
+			ry.sessions.Add(1)
+			if ry.sessionsDown.Load() {
+				w.WriteHeader(http.StatusBadGateway)
+				return
+			}
+			io.WriteString(w, `{"code": 200, "data": {"senderId": "s7"}}`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(ry.Close)
+	return ry
+}
+
+// request returns a message list request served by a proxy in front of ry
+func (ry *countingRuoYi) request() *http.Request {
+	req := httptest.NewRequest(http.MethodGet, "/system/message/list", nil)
+	return withRoutes(req, compileRoutes(&Config{BaseURL: ry.URL}, nil))
+}
+
+func TestIdentityResolverCache(t *testing.T) {
+	ry := startCountingRuoYi(t, 0)
+	fr := startFakeRedis(t)
+	res := &IdentityResolver{TTL: time.Minute, KeyPrefix: "test:identity:"}
+
+	for i := 0; i < 3; i++ {
+		identity, err := res.Resolve(ry.request(), "Bearer t7")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if identity.UserID != "7" || identity.Mobile != "13800000007" {
+			t.Fatalf("got %+v", identity)
+		}
+	}
+	if n := ry.logins.Load(); n != 1 {
+		t.Errorf("loginInfo called %d times, want 1", n)
+	}
+	if ttl := fr.ttl(res.cacheKey(ry.request(), "Bearer t7")); ttl <= 50*time.Second || ttl > time.Minute {
+		t.Errorf("identity cached for %v, want about %v", ttl, res.TTL)
+	}
+
+	// Resolving never looks up sessions; SenderID does so once
+	if n := ry.sessions.Load(); n != 0 {
+		t.Errorf("Resolve looked up %d sessions", n)
+	}
+	req := ry.request()
+	for i := 0; i < 2; i++ {
+		senderId, err := res.SenderID(req, "Bearer t7")
+		if err != nil || senderId != "s7" {
+			t.Fatalf("got %q, %v", senderId, err)
+		}
+	}
+	if n := ry.sessions.Load(); n != 1 {
+		t.Errorf("sessions looked up %d times, want 1", n)
+	}
+	if keys := fr.keys("test:identity:session:"); len(keys) != 1 {
+		t.Errorf("got session keys %v", keys)
+	}
+
+	// Entries expire with the TTL
+	short := &IdentityResolver{TTL: 50 * time.Millisecond, KeyPrefix: "test:short:"}
+	if _, err := short.Resolve(ry.request(), "Bearer t7"); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if _, err := short.Resolve(ry.request(), "Bearer t7"); err != nil {
+		t.Fatal(err)
+	}
+	if n := ry.logins.Load(); n != 3 {
+		t.Errorf("loginInfo called %d times after expiry, want 3", n)
+	}
+}
+
+func TestIdentityResolverSharesLookups(t *testing.T) {
+	ry := startCountingRuoYi(t, 100*time.Millisecond)
+	res := &IdentityResolver{TTL: time.Minute, KeyPrefix: "test:identity:"}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if identity, err := res.Resolve(ry.request(), "Bearer t7"); err != nil || identity.UserID != "7" {
+				t.Errorf("got %+v, %v", identity, err)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := ry.logins.Load(); n != 1 {
+		t.Errorf("loginInfo called %d times, want 1", n)
+	}
+}
+
+func TestIdentityResolverSessionFailure(t *testing.T) {
+	ry := startCountingRuoYi(t, 0)
+	ry.sessionsDown.Store(true)
+	res := &IdentityResolver{TTL: time.Minute, KeyPrefix: "test:identity:"}
+
+	if _, err := res.Resolve(ry.request(), "Bearer t7"); err != nil {
+		t.Fatalf("Resolve failed with the session lookup down: %v", err)
+	}
+	req := ry.request()
+	if senderId, err := res.SenderID(req, "Bearer t7"); err == nil && senderId != "" {
+		t.Errorf("got sender ID %q with the session lookup down", senderId)
+	}
+}
+
+func TestLogoutInvalidatesIdentity(t *testing.T) {
+	ry := startCountingRuoYi(t, 0)
+	startFakeRedis(t)
+
+	if _, err := DefaultResolver.Resolve(ry.request(), "Bearer t7"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := DefaultResolver.Resolve(ry.request(), "Bearer t7"); err != nil {
+		t.Fatal(err)
+	}
+	req := ry.request()
+	req.Header.Set("Authorization", "Bearer t7")
+	(&LogoutInvalidator{}).Observe(req, http.StatusBadGateway, "")
+	if _, err := DefaultResolver.Resolve(ry.request(), "Bearer t7"); err != nil {
+		t.Fatal(err)
+	}
+	if n := ry.logins.Load(); n != 1 {
+		t.Errorf("identity dropped after a failed logout")
+	}
+	(&LogoutInvalidator{}).Observe(req, http.StatusOK, "")
+	if _, err := DefaultResolver.Resolve(ry.request(), "Bearer t7"); err != nil {
+		t.Fatal(err)
+	}
+	if n := ry.logins.Load(); n != 2 {
+		t.Errorf("loginInfo called %d times, want 2", n)
+	}
+}
@@ -0,0 +1,243 @@
+package forward
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"e.coding.net/Love54dj/weizhong/etc/cache"
+)
+
+// LoginUserKeyClaim is the claim RuoYi stores the Redis key of a login in
+const LoginUserKeyClaim = "login_user_key"
+
+// jwtRevokedPrefix is the proxy's own list of logged out logins
+const jwtRevokedPrefix = "forward:jwt:revoked:"
+
+// JWTValidator checks RuoYi tokens locally instead of asking loginInfo. The
+// HMAC signature and the exp and nbf claims are verified with the configured
+// secret. A login is then live while RuoYi keeps its login_user_key in Redis
+// and the proxy has not seen it log out. Only tokens that neither Redis nor
+// an exp claim can vouch for are checked with loginInfo.
+type JWTValidator struct {
+	Secret    string `yaml:"secret"`    // RuoYi's token.secret
+	SecretEnv string `yaml:"secretEnv"` // environment variable holding the secret instead
+	// RawSecret signs with the secret bytes as they are. RuoYi's jjwt
+	// base64-decodes the secret first, which is the default.
+	RawSecret  bool          `yaml:"rawSecret"`
+	Algorithms []string      `yaml:"algorithms"` // accepted, HS512 when empty
+	Leeway     time.Duration `yaml:"leeway"`     // allowed clock skew for exp and nbf
+	// LoginTokenPrefix is the Redis key prefix RuoYi stores logins under,
+	// "login_tokens:" by default. The check needs the proxy to share RuoYi's
+	// Redis; set it to "-" to skip it.
+	LoginTokenPrefix string `yaml:"loginTokenPrefix"`
+
+	key []byte
+}
+
+func newJWTValidator(opts Options) (AuthValidator, error) {
+	v := &JWTValidator{Algorithms: []string{"HS512"}, LoginTokenPrefix: "login_tokens:"}
+	if err := opts.Decode(v); err != nil {
+		return nil, err
+	}
+	if err := v.init(); err != nil {
+		return nil, fmt.Errorf("jwt: %w", err)
+	}
+	return v, nil
+}
+
+// init resolves the signing key
+func (v *JWTValidator) init() error {
+	secret := v.Secret
+	if v.SecretEnv != "" {
+		secret = os.Getenv(v.SecretEnv)
+	}
+	if secret == "" {
+		return errors.New("secret or secretEnv is required")
+	}
+	if len(v.Algorithms) == 0 {
+		v.Algorithms = []string{"HS512"}
+	}
+	for _, alg := range v.Algorithms {
+		if jwtHash(alg) == nil {
+			return fmt.Errorf("unsupported algorithm %q", alg)
+		}
+	}
+	if v.RawSecret {
+		v.key = []byte(secret)
+		return nil
+	}
+	key, err := base64.RawStdEncoding.DecodeString(strings.TrimRight(secret, "="))
+	if err != nil {
+		return fmt.Errorf("secret is not base64, set rawSecret: %v", err)
+	}
+	v.key = key
+	return nil
+}
+
+func jwtHash(alg string) func() hash.Hash {
+	switch alg {
+	case "HS256":
+		return sha256.New
+	case "HS384":
+		return sha512.New384
+	case "HS512":
+		return sha512.New
+	}
+	return nil
+}
+
+func (v *JWTValidator) Validate(r *http.Request) (string, error) {
+	auth := r.Header.Get("Authorization")
+	if auth == "" {
+		return "", fmt.Errorf("unauthorized: missing authorization header")
+	}
+	claims, err := v.verify(strings.TrimPrefix(auth, "Bearer "), time.Now())
+	if err != nil {
+		return "", fmt.Errorf("unauthorized: %v", err)
+	}
+
+	loginKey, _ := claims[LoginUserKeyClaim].(string)
+	if loginKey != "" && cache.Ready() {
+		switch live, err := v.loginLive(loginKey); {
+		case err != nil:
+			log.Printf("[ERROR] Checking login %s in Redis failed: %v", loginKey, err)
+		case !live:
+			return "", fmt.Errorf("unauthorized: login expired")
+		case v.LoginTokenPrefix != "-":
+			// RuoYi still holds the login
+			return auth, nil
+		}
+	}
+	if _, ok := claims["exp"]; ok {
+		return auth, nil
+	}
+
+	// Nothing local says whether the login still exists
+	if _, err := DefaultResolver.Resolve(r, auth); err != nil {
+		return "", err
+	}
+	return auth, nil
+}
+
+// loginLive reports whether the login has neither logged out through the
+// proxy nor, when RuoYi's keys are checked, expired there
+func (v *JWTValidator) loginLive(loginKey string) (bool, error) {
+	revoked, err := cache.Exists(jwtRevokedPrefix + loginKey)
+	if err != nil || revoked {
+		return false, err
+	}
+	if v.LoginTokenPrefix == "-" {
+		return true, nil
+	}
+	return cache.Exists(v.LoginTokenPrefix + loginKey)
+}
+
+// verify checks the signature and time claims of token and returns its claims
+func (v *JWTValidator) verify(token string, now time.Time) (map[string]any, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, err
+	}
+	newHash := jwtHash(header.Alg)
+	if newHash == nil || !slices.Contains(v.Algorithms, header.Alg) {
+		return nil, fmt.Errorf("algorithm %q not accepted", header.Alg)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("malformed signature")
+	}
+	mac := hmac.New(newHash, v.key)
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+	if !hmac.Equal(signature, mac.Sum(nil)) {
+		return nil, errors.New("invalid signature")
+	}
+
+	var claims map[string]any
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return nil, err
+	}
+	if exp, ok := claims["exp"]; ok {
+		t, ok := jwtTime(exp)
+		if !ok {
+			return nil, errors.New("invalid exp claim")
+		}
+		if now.After(t.Add(v.Leeway)) {
+			return nil, errors.New("token expired")
+		}
+	}
+	if nbf, ok := claims["nbf"]; ok {
+		t, ok := jwtTime(nbf)
+		if !ok {
+			return nil, errors.New("invalid nbf claim")
+		}
+		if now.Add(v.Leeway).Before(t) {
+			return nil, errors.New("token not valid yet")
+		}
+	}
+	return claims, nil
+}
+
+func decodeJWTPart(part string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return errors.New("malformed token")
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return errors.New("malformed token")
+	}
+	return nil
+}
+
+// jwtTime converts a NumericDate claim
+func jwtTime(claim any) (time.Time, bool) {
+	seconds, ok := claim.(float64)
+	if !ok || math.IsNaN(seconds) || math.IsInf(seconds, 0) {
+		return time.Time{}, false
+	}
+	return time.Unix(int64(seconds), 0), true
+}
+
+// Revoke adds the login of a RuoYi token to the proxy's revocation list
+// until the token expires, or for a day when it does not, so the validator
+// rejects it even where RuoYi's Redis is not shared. It reports whether the
+// token was revoked; tokens that fail verification or carry no
+// login_user_key are left alone.
+func (v *JWTValidator) Revoke(auth string) (bool, error) {
+	if !cache.Ready() {
+		return false, nil
+	}
+	claims, err := v.verify(strings.TrimPrefix(auth, "Bearer "), time.Now())
+	if err != nil {
+		return false, nil
+	}
+	loginKey, _ := claims[LoginUserKeyClaim].(string)
+	if loginKey == "" {
+		return false, nil
+	}
+	ttl := 24 * time.Hour
+	if exp, ok := jwtTime(claims["exp"]); ok {
+		if ttl = time.Until(exp); ttl <= 0 {
+			return false, nil
+		}
+	}
+	return true, cache.SetEx(jwtRevokedPrefix+loginKey, "1", ttl)
+}
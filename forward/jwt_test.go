@@ -0,0 +1,133 @@
+package forward
+
+import (
+	"crypto/hmac"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"e.coding.net/Love54dj/weizhong/etc/ryconn"
+	"e.coding.net/Love54dj/weizhong/etc/ryfake"
+	"gopkg.in/yaml.v3"
+)
+
+// signJWT signs claims with HS512 like RuoYi does, whatever alg says
+func signJWT(alg string, claims map[string]any, key []byte) string {
+	header, _ := json.Marshal(map[string]string{"alg": alg})
+	payload, _ := json.Marshal(claims)
+	unsigned := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	mac := hmac.New(sha512.New, key)
+	mac.Write([]byte(unsigned))
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func TestJWTValidator(t *testing.T) {
+	ry := ryfake.NewServer()
+	defer ry.Close()
+	routes := compileRoutes(&Config{BaseURL: ry.URL}, nil)
+
+	// RuoYi's default token.secret, which jjwt base64-decodes
+	var spec PluginSpec
+	if err := yaml.Unmarshal([]byte(`{name: jwt, options: {secret: abcdefghijklmnopqrstuvwxyz}}`), &spec); err != nil {
+		t.Fatal(err)
+	}
+	v, err := newJWTValidator(&spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, _ := base64.RawStdEncoding.DecodeString("abcdefghijklmnopqrstuvwxyz")
+
+	// Without exp only loginInfo knows whether the login is live
+	live := signJWT("HS512", map[string]any{LoginUserKeyClaim: "a1"}, key)
+	ry.Backend.AddUser(ryfake.User{Token: live, RuoyiUserData: ryconn.RuoyiUserData{ID: 7, Mobile: "13800000007"}})
+
+	now := time.Now().Unix()
+	tests := []struct {
+		name  string
+		token string
+		ok    bool
+	}{
+		{"exp in the future", signJWT("HS512", map[string]any{LoginUserKeyClaim: "a2", "exp": now + 60}, key), true},
+		{"expired", signJWT("HS512", map[string]any{"exp": now - 60}, key), false},
+		{"not valid yet", signJWT("HS512", map[string]any{"exp": now + 60, "nbf": now + 60}, key), false},
+		{"wrong key", signJWT("HS512", map[string]any{"exp": now + 60}, []byte("other")), false},
+		{"other algorithm", signJWT("HS256", map[string]any{"exp": now + 60}, key), false},
+		{"alg none", signJWT("none", map[string]any{"exp": now + 60}, key), false},
+		{"malformed", "not-a-jwt", false},
+		{"remote fallback", live, true},
+		{"remote unknown", signJWT("HS512", map[string]any{LoginUserKeyClaim: "gone"}, key), false},
+	}
+	for _, tt := range tests {
+		req := withRoutes(httptest.NewRequest(http.MethodGet, "/", nil), routes)
+		req.Header.Set("Authorization", "Bearer "+tt.token)
+		auth, err := v.Validate(req)
+		if (err == nil) != tt.ok || (tt.ok && auth != "Bearer "+tt.token) {
+			t.Errorf("%s: got %q, %v", tt.name, auth, err)
+		}
+	}
+}
+
+func TestLogoutRevokesVerifiedTokens(t *testing.T) {
+	fr := startFakeRedis(t)
+	var logoutStatus atomic.Int32
+	logoutStatus.Store(http.StatusOK)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/logout" {
+			w.WriteHeader(int(logoutStatus.Load()))
+		}
+	}))
+	defer upstream.Close()
+	config, err := ParseConfig([]byte(`
+baseUrl: ` + upstream.URL + `
+routes:
+  - path: /me
+    auth: {name: jwt, options: {secret: abcdefghijklmnopqrstuvwxyz, loginTokenPrefix: "-"}}
+  - {path: /logout, auth: referer, middleware: [invalidateIdentity]}
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := NewProxyServer(config)
+	defer proxy.Close()
+
+	key, _ := base64.RawStdEncoding.DecodeString("abcdefghijklmnopqrstuvwxyz")
+	claims := map[string]any{LoginUserKeyClaim: "a1", "exp": time.Now().Unix() + 60}
+	token := signJWT("HS512", claims, key)
+	forged := signJWT("HS512", claims, []byte("other"))
+	send := func(method, path, token string) int {
+		req := httptest.NewRequest(method, path, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		req.Header.Set("Referer", ValidReferer+"wx/page")
+		rec := httptest.NewRecorder()
+		proxy.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	if code := send("GET", "/me", token); code != 200 {
+		t.Fatalf("got %d before logout", code)
+	}
+
+	// A forged token naming the same login does not log it out
+	send("POST", "/logout", forged)
+	if keys := fr.keys(jwtRevokedPrefix); len(keys) != 0 {
+		t.Errorf("forged token revoked %q", keys)
+	}
+
+	// Neither does a logout the upstream failed
+	logoutStatus.Store(http.StatusInternalServerError)
+	send("POST", "/logout", token)
+	if code := send("GET", "/me", token); code != 200 {
+		t.Errorf("got %d after a failed logout", code)
+	}
+
+	logoutStatus.Store(http.StatusOK)
+	send("POST", "/logout", token)
+	if code := send("GET", "/me", token); code != 401 {
+		t.Errorf("got %d after logout, want 401", code)
+	}
+}
@@ -0,0 +1,158 @@
+package forward
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// DefaultSessionPath is the RuoYi endpoint returning a user's digital session
+// with a lawyer
+const DefaultSessionPath = "/system/session/digital/{userId}/{lawyerId}"
+
+// LawyerResolver determines which lawyer (or mediator) a request talks to, and
+// so which digital session the caller's sender ID belongs to. Sources are
+// tried in order; the first one yielding a value wins, otherwise Default is
+// used. The zero value always resolves to FixedLawyerId.
+type LawyerResolver struct {
+	Sources     []LawyerSource `yaml:"sources"`
+	Default     string         `yaml:"default"`
+	SessionPath string         `yaml:"sessionPath"` // DefaultSessionPath when empty
+}
+
+// LawyerSource reads a lawyer ID from one place:
+//
+//	param   the route parameter Name, e.g. {lawyerId}
+//	query   the query parameter Name
+//	header  the request header Name
+//	user    the caller's RuoYi user data, Name is lawyerId, mediateId or channelId
+//
+// With a Mapping only mapped values count, so a channel ID can be mapped to the
+// lawyer serving that channel. SessionPath overrides the resolver's, e.g. for
+// mediation sessions.
+type LawyerSource struct {
+	From        string            `yaml:"from"`
+	Name        string            `yaml:"name"`
+	Mapping     map[string]string `yaml:"mapping"`
+	SessionPath string            `yaml:"sessionPath"`
+}
+
+// Counterpart is the lawyer or mediator a request resolved to
+type Counterpart struct {
+	ID          string
+	SessionPath string
+}
+
+// sessionPath returns the session endpoint of userId with the counterpart
+func (c Counterpart) sessionPath(userId string) string {
+	return strings.NewReplacer(
+		"{userId}", url.PathEscape(userId),
+		"{lawyerId}", url.PathEscape(c.ID),
+	).Replace(c.SessionPath)
+}
+
+// validate checks the resolver configuration
+func (lr *LawyerResolver) validate() error {
+	var errs []error
+	for i, src := range lr.Sources {
+		switch src.From {
+		case "param", "query", "header":
+			if src.Name == "" {
+				errs = append(errs, fmt.Errorf("sources[%d]: name is required", i))
+			}
+		case "user":
+			switch src.Name {
+			case "lawyerId", "mediateId", "channelId":
+			default:
+				errs = append(errs, fmt.Errorf("sources[%d]: user field must be lawyerId, mediateId or channelId, got %q", i, src.Name))
+			}
+		default:
+			errs = append(errs, fmt.Errorf("sources[%d]: from must be param, query, header or user, got %q", i, src.From))
+		}
+		if err := checkSessionPath(src.SessionPath); err != nil {
+			errs = append(errs, fmt.Errorf("sources[%d]: %w", i, err))
+		}
+	}
+	if err := checkSessionPath(lr.SessionPath); err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+func checkSessionPath(path string) error {
+	if path == "" {
+		return nil
+	}
+	if !strings.HasPrefix(path, "/") || !strings.Contains(path, "{userId}") || !strings.Contains(path, "{lawyerId}") {
+		return fmt.Errorf("sessionPath %q must start with / and contain {userId} and {lawyerId}", path)
+	}
+	return nil
+}
+
+// Resolve returns the counterpart of r. r may be nil to only consult the
+// identity, and identity may be nil before the caller is known.
+func (lr *LawyerResolver) Resolve(r *http.Request, identity *Identity) (Counterpart, error) {
+	sessionPath := lr.SessionPath
+	if sessionPath == "" {
+		sessionPath = DefaultSessionPath
+	}
+	for _, src := range lr.Sources {
+		value := src.value(r, identity)
+		if value == "" {
+			continue
+		}
+		if src.Mapping != nil {
+			if value = src.Mapping[value]; value == "" {
+				continue
+			}
+		}
+		c := Counterpart{ID: value, SessionPath: sessionPath}
+		if src.SessionPath != "" {
+			c.SessionPath = src.SessionPath
+		}
+		return c, nil
+	}
+	if lr.Default != "" {
+		return Counterpart{ID: lr.Default, SessionPath: sessionPath}, nil
+	}
+	if len(lr.Sources) > 0 {
+		return Counterpart{}, errors.New("unable to determine lawyer for request")
+	}
+	return Counterpart{ID: FixedLawyerId, SessionPath: sessionPath}, nil
+}
+
+func (src *LawyerSource) value(r *http.Request, identity *Identity) string {
+	if src.From == "user" {
+		if identity == nil {
+			return ""
+		}
+		var id int
+		switch src.Name {
+		case "lawyerId":
+			id = identity.LawyerID
+		case "mediateId":
+			id = identity.MediateID
+		case "channelId":
+			id = identity.ChannelID
+		}
+		if id == 0 {
+			return ""
+		}
+		return strconv.Itoa(id)
+	}
+	if r == nil {
+		return ""
+	}
+	switch src.From {
+	case "param":
+		return r.PathValue(src.Name)
+	case "query":
+		return r.URL.Query().Get(src.Name)
+	case "header":
+		return r.Header.Get(src.Name)
+	}
+	return ""
+}
@@ -0,0 +1,58 @@
+package forward
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestLawyerResolver(t *testing.T) {
+	lr := &LawyerResolver{
+		Sources: []LawyerSource{
+			{From: "param", Name: "lawyerId"},
+			{From: "header", Name: "X-Lawyer-Id"},
+			{From: "user", Name: "channelId", Mapping: map[string]string{"3": "140"}},
+			{From: "user", Name: "mediateId", SessionPath: "/system/session/mediate/{userId}/{lawyerId}"},
+		},
+		Default: "132",
+	}
+	if err := lr.validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	withParam := httptest.NewRequest(http.MethodGet, "/session/7/150", nil)
+	withParam.SetPathValue("lawyerId", "150")
+	withHeader := httptest.NewRequest(http.MethodGet, "/", nil)
+	withHeader.Header.Set("X-Lawyer-Id", "160")
+
+	tests := []struct {
+		name     string
+		r        *http.Request
+		identity *Identity
+		session  string
+	}{
+		{"param", withParam, &Identity{ChannelID: 3}, "/system/session/digital/7/150"},
+		{"header", withHeader, nil, "/system/session/digital/7/160"},
+		{"mapped channel", nil, &Identity{ChannelID: 3}, "/system/session/digital/7/140"},
+		{"unmapped channel", nil, &Identity{ChannelID: 4, MediateID: 9}, "/system/session/mediate/7/9"},
+		{"default", nil, &Identity{ChannelID: 4}, "/system/session/digital/7/132"},
+	}
+	for _, tt := range tests {
+		c, err := lr.Resolve(tt.r, tt.identity)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if got := c.sessionPath("7"); got != tt.session {
+			t.Errorf("%s: session %s, want %s", tt.name, got, tt.session)
+		}
+	}
+
+	var zero LawyerResolver
+	if c, _ := zero.Resolve(nil, nil); c.ID != FixedLawyerId {
+		t.Errorf("zero resolver resolved to %q", c.ID)
+	}
+	if err := (&LawyerResolver{Sources: []LawyerSource{{From: "cookie"}}}).validate(); err == nil {
+		t.Error("expected unknown source to be rejected")
+	}
+}
@@ -0,0 +1,54 @@
+package forward
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMessageHandlerInjectIdentity(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/system/loginInfo":
+			io.WriteString(w, `{"code": 200, "data": {"id": 7, "mobile": "13800000000"}}`)
+		case "/system/session/digital/7/132":
+			io.WriteString(w, `{"code": 200, "data": {"senderId": "s7"}}`)
+		default:
+			body, _ := io.ReadAll(r.Body)
+			fmt.Fprintf(w, "%d %s", r.ContentLength, body)
+		}
+	}))
+	defer upstream.Close()
+
+	config := &Config{BaseURL: upstream.URL, LoginInfoURL: upstream.URL + "/system/loginInfo"}
+	AddRoute(config, "/system/message", "/system/message", &MessageAuthValidator{}, &MessageHandler{InjectIdentity: true})
+	proxy := NewProxyServer(config)
+
+	tests := []struct {
+		body string
+		code int
+		want string
+	}{
+		{`{"msgText": "hi", "msgType": 1, "userId": 99, "senderId": "spoofed"}`, http.StatusOK,
+			`{"msgText":"hi","msgType":1,"senderId":"s7","sourceType":0,"userId":7}`},
+		{`{"msgText": "hi"}`, http.StatusOK, `{"msgText":"hi","msgType":0,"senderId":"s7","sourceType":0,"userId":7}`},
+		{`{"msgText": "hi", "admin": true}`, http.StatusBadRequest, ""},
+		{`{"msgText": "hi"} {}`, http.StatusBadRequest, ""},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodPost, "/system/message", strings.NewReader(tt.body))
+		req.Header.Set("Authorization", "Bearer token")
+		rec := httptest.NewRecorder()
+		proxy.ServeHTTP(rec, req)
+		if rec.Code != tt.code {
+			t.Errorf("%s: got %d %s", tt.body, rec.Code, rec.Body.String())
+			continue
+		}
+		if want := fmt.Sprintf("%d %s", len(tt.want), tt.want); tt.want != "" && rec.Body.String() != want {
+			t.Errorf("%s: upstream got %s, want %s", tt.body, rec.Body.String(), want)
+		}
+	}
+}
@@ -0,0 +1,42 @@
+package forward
+
+import (
+	"strconv"
+	"time"
+
+	"e.coding.net/Love54dj/weizhong/etc/metrics"
+)
+
+var (
+	routeRequests = metrics.Counter("forward_requests_total",
+		"Requests answered by the proxy, by route, method and status code.",
+		"route", "method", "code")
+	routeDuration = metrics.Histogram("forward_request_duration_seconds",
+		"Time the proxy took to answer requests, by route and method.",
+		metrics.DefBuckets, "route", "method")
+)
+
+// breakerStateValues are the values of forward_breaker_state
+var breakerStateValues = map[string]float64{BreakerClosed: 0, BreakerHalfOpen: 1, BreakerOpen: 2}
+
+// observeRequest records a request answered on route
+func observeRequest(route, method string, status int, elapsed time.Duration) {
+	// Clients choose the method, so keep the label set bounded
+	if !knownMethods[method] {
+		method = "OTHER"
+	}
+	routeRequests.Inc(route, method, strconv.Itoa(status))
+	routeDuration.Observe(elapsed.Seconds(), route, method)
+}
+
+// exportBreakers reports the circuit breakers of s as forward_breaker_state,
+// replacing those of any earlier proxy server
+func (s *ProxyServer) exportBreakers() {
+	metrics.GaugeFunc("forward_breaker_state",
+		"Circuit breaker state of each route: 0 closed, 1 half-open, 2 open.",
+		func(set func(float64, ...string)) {
+			for route, state := range s.BreakerStatus() {
+				set(breakerStateValues[state], route)
+			}
+		}, "route")
+}
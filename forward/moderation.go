@@ -0,0 +1,200 @@
+package forward
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"e.coding.net/Love54dj/weizhong/etc/sensitive"
+	"e.coding.net/Love54dj/weizhong/etc/wechat"
+)
+
+// Moderation actions, chosen per dictionary category
+const (
+	ModerationReject = "reject" // answer 400, nothing reaches the upstream
+	ModerationMask   = "mask"   // replace the words with * and forward
+	ModerationFlag   = "flag"   // forward unchanged, log and alert
+)
+
+// Moderator is a Middleware that scans the text of posted messages against a
+// sensitive word dictionary. What happens to a match depends on the action of
+// its category; when categories disagree reject wins, and masking and flagging
+// combine. The dictionary file is reloaded when it changes.
+type Moderator struct {
+	Dictionary    string            `yaml:"dictionary"`    // word list, see sensitive.ParseDictionary
+	Actions       map[string]string `yaml:"actions"`       // category -> reject, mask or flag
+	DefaultAction string            `yaml:"defaultAction"` // for other categories, reject when empty
+	Field         string            `yaml:"field"`         // JSON field scanned, msgText when empty
+	Reload        time.Duration     `yaml:"reload"`        // how often the file is checked, 30s when zero
+	Alert         bool              `yaml:"alert"`         // report flagged words, not the message, to WeCom
+
+	matcher atomic.Pointer[sensitive.Matcher]
+	mu      sync.Mutex
+	checked time.Time
+	modTime time.Time
+}
+
+// sendAlert queues a WeCom message; replaced in tests
+var sendAlert = wechat.SendLogAsync
+
+func newModerator(opts Options) (Middleware, error) {
+	m := &Moderator{DefaultAction: ModerationReject, Field: "msgText", Reload: 30 * time.Second}
+	if err := opts.Decode(m); err != nil {
+		return nil, err
+	}
+	if m.Dictionary == "" {
+		return nil, fmt.Errorf("moderate: dictionary is required")
+	}
+	for category, action := range m.Actions {
+		if !validModerationAction(action) {
+			return nil, fmt.Errorf("moderate: unknown action %q for %s", action, category)
+		}
+	}
+	if !validModerationAction(m.DefaultAction) {
+		return nil, fmt.Errorf("moderate: unknown defaultAction %q", m.DefaultAction)
+	}
+	if err := m.load(); err != nil {
+		return nil, fmt.Errorf("moderate: %w", err)
+	}
+	return m, nil
+}
+
+func validModerationAction(action string) bool {
+	return action == ModerationReject || action == ModerationMask || action == ModerationFlag
+}
+
+func (m *Moderator) load() error {
+	info, err := os.Stat(m.Dictionary)
+	if err != nil {
+		return err
+	}
+	matcher, err := sensitive.LoadFile(m.Dictionary)
+	if err != nil {
+		return err
+	}
+	m.matcher.Store(matcher)
+	m.modTime = info.ModTime()
+	log.Printf("[INFO] Loaded %d sensitive words from %s", matcher.Len(), m.Dictionary)
+	return nil
+}
+
+// reloadIfChanged reloads the dictionary at most once per Reload interval. A
+// broken file keeps the previous words in use.
+func (m *Moderator) reloadIfChanged() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if time.Since(m.checked) < m.Reload {
+		return
+	}
+	m.checked = time.Now()
+	info, err := os.Stat(m.Dictionary)
+	if err != nil || info.ModTime().Equal(m.modTime) {
+		return
+	}
+	if err := m.load(); err != nil {
+		log.Printf("[ERROR] Reloading sensitive words failed: %v", err)
+	}
+}
+
+func (m *Moderator) action(category string) string {
+	if action, ok := m.Actions[category]; ok {
+		return action
+	}
+	return m.DefaultAction
+}
+
+func (m *Moderator) Process(w http.ResponseWriter, r *http.Request, auth string) error {
+	if r.Method != http.MethodPost || r.Body == nil {
+		return nil
+	}
+	m.reloadIfChanged()
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return fmt.Errorf("error reading request body: %v", err)
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+
+	// Leave malformed bodies to the message middleware
+	var fields map[string]json.RawMessage
+	var text string
+	if json.Unmarshal(body, &fields) != nil || json.Unmarshal(fields[m.Field], &text) != nil {
+		return nil
+	}
+	matches := m.matcher.Load().FindAll(text)
+	if len(matches) == 0 {
+		return nil
+	}
+
+	var rejected, flagged, flaggedWords []string
+	var masked []sensitive.Match
+	for _, match := range matches {
+		switch m.action(match.Category) {
+		case ModerationReject:
+			rejected = appendUnique(rejected, match.Category)
+		case ModerationMask:
+			masked = append(masked, match)
+		case ModerationFlag:
+			flagged = appendUnique(flagged, match.Category)
+			flaggedWords = appendUnique(flaggedWords, match.Word)
+		}
+	}
+	route := RoutePattern(r)
+	if len(rejected) > 0 {
+		log.Printf("[ERROR] Rejected message on %s from %s: sensitive content (%s)", route, m.caller(r, auth), strings.Join(rejected, ", "))
+		return NewStatusError(http.StatusBadRequest, "message contains sensitive content")
+	}
+
+	if len(masked) > 0 {
+		text = sensitive.Mask(text, masked, '*')
+		encoded, err := marshalJSON(text)
+		if err != nil {
+			return err
+		}
+		fields[m.Field] = encoded
+		if body, err = marshalJSON(fields); err != nil {
+			return err
+		}
+		setRequestBody(r, body)
+		log.Printf("[INFO] Masked %d sensitive words in message on %s", len(masked), route)
+	}
+
+	if len(flagged) > 0 {
+		caller := m.caller(r, auth)
+		log.Printf("[ERROR] Flagged message on %s from %s: sensitive content (%s)", route, caller, strings.Join(flagged, ", "))
+		if m.Alert {
+			// The message itself may hold phone numbers and stays out of chat
+			sendAlert(fmt.Sprintf("**敏感内容提醒**\n> 路由: %s\n> 用户: %s\n> 类别: %s\n> 词语: %s",
+				route, caller, strings.Join(flagged, ", "), strings.Join(flaggedWords, ", ")))
+		}
+	}
+	return nil
+}
+
+// caller names the sender in logs and alerts
+func (m *Moderator) caller(r *http.Request, auth string) string {
+	if auth == "" {
+		return "anonymous"
+	}
+	identity, err := DefaultResolver.Resolve(r, auth)
+	if err != nil {
+		return "unknown"
+	}
+	return "user " + identity.UserID
+}
+
+func appendUnique(list []string, s string) []string {
+	if slices.Contains(list, s) {
+		return list
+	}
+	return append(list, s)
+}
@@ -0,0 +1,142 @@
+package forward
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// moderatedConfig serves /m, moderating msgText with m against a test
+// dictionary. Alerts are collected instead of sent.
+func moderatedConfig(t *testing.T, m *Moderator) (config *Config, alerts *[]string) {
+	t.Helper()
+	dictionary := filepath.Join(t.TempDir(), "words.txt")
+	if err := os.WriteFile(dictionary, []byte("[abuse]\n傻瓜\n[ad]\n加微信\n[politics]\n敏感词\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	m.Dictionary, m.Field, m.Reload = dictionary, "msgText", time.Minute
+	if m.DefaultAction == "" {
+		m.DefaultAction = ModerationReject
+	}
+	if err := m.load(); err != nil {
+		t.Fatal(err)
+	}
+
+	alerts = new([]string)
+	prev := sendAlert
+	sendAlert = func(msg string) { *alerts = append(*alerts, msg) }
+	t.Cleanup(func() { sendAlert = prev })
+	return &Config{Routes: map[string]*RouteConfig{"/m": {Middleware: []Middleware{m}}}}, alerts
+}
+
+func postMessage(proxy *ProxyServer, body string) *httptest.ResponseRecorder {
+	return record(proxy, newRequest(http.MethodPost, "/m", body, "Content-Type: application/json"))
+}
+
+func TestModerationActions(t *testing.T) {
+	actions := map[string]string{"abuse": ModerationReject, "ad": ModerationMask, "politics": ModerationFlag}
+	tests := []struct {
+		name     string
+		body     string
+		code     int
+		received string // body reaching the upstream, empty when none
+	}{
+		{"clean", `{"msgText":"你好"}`, 200, `{"msgText":"你好"}`},
+		{"reject", `{"msgText":"你是傻瓜"}`, 400, ""},
+		{"mask", `{"msgText":"加微信聊","to":"1"}`, 200, `{"msgText":"***聊","to":"1"}`},
+		{"flag", `{"msgText":"说个敏感词"}`, 200, `{"msgText":"说个敏感词"}`},
+		{"reject wins", `{"msgText":"傻瓜加微信"}`, 400, ""},
+		{"mask and flag", `{"msgText":"加微信说敏感词"}`, 200, `{"msgText":"***说敏感词"}`},
+		{"other field", `{"title":"傻瓜","msgText":"你好"}`, 200, `{"title":"傻瓜","msgText":"你好"}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config, _ := moderatedConfig(t, &Moderator{Actions: actions})
+			var received []string
+			proxy := testProxy(t, config, echo(&received))
+			rec := postMessage(proxy, tt.body)
+			if rec.Code != tt.code {
+				t.Fatalf("got %d %q, want %d", rec.Code, rec.Body, tt.code)
+			}
+			if tt.received == "" {
+				if len(received) != 0 {
+					t.Errorf("upstream got %q, want nothing", received)
+				}
+				if !strings.Contains(rec.Body.String(), "sensitive content") {
+					t.Errorf("got body %q", rec.Body)
+				}
+				return
+			}
+			if len(received) != 1 || received[0] != tt.received {
+				t.Errorf("upstream got %q, want %q", received, tt.received)
+			}
+		})
+	}
+}
+
+func TestModerationDefaultAction(t *testing.T) {
+	config, _ := moderatedConfig(t, &Moderator{Actions: map[string]string{"ad": ModerationFlag}, DefaultAction: ModerationMask})
+	var received []string
+	proxy := testProxy(t, config, echo(&received))
+	if rec := postMessage(proxy, `{"msgText":"傻瓜加微信"}`); rec.Code != 200 {
+		t.Fatalf("got %d %q", rec.Code, rec.Body)
+	}
+	if want := `{"msgText":"**加微信"}`; len(received) != 1 || received[0] != want {
+		t.Errorf("upstream got %q, want %q", received, want)
+	}
+}
+
+func TestModerationAlert(t *testing.T) {
+	actions := map[string]string{"ad": ModerationMask, "politics": ModerationFlag}
+
+	config, alerts := moderatedConfig(t, &Moderator{Actions: actions, Alert: true})
+	proxy := testProxy(t, config, echo(nil))
+	postMessage(proxy, `{"msgText":"你好"}`)
+	postMessage(proxy, `{"msgText":"加微信"}`)
+	if len(*alerts) != 0 {
+		t.Fatalf("got alerts %q for messages that were not flagged", *alerts)
+	}
+	postMessage(proxy, `{"msgText":"加微信说敏感词，电话13800001234"}`)
+	if len(*alerts) != 1 {
+		t.Fatalf("got %d alerts, want 1", len(*alerts))
+	}
+	for _, want := range []string{"敏感内容提醒", "路由: /m", "用户: anonymous", "类别: politics", "词语: 敏感词"} {
+		if !strings.Contains((*alerts)[0], want) {
+			t.Errorf("alert %q does not contain %q", (*alerts)[0], want)
+		}
+	}
+	if strings.Contains((*alerts)[0], "13800001234") || strings.Contains((*alerts)[0], "电话") {
+		t.Errorf("alert %q carries the message", (*alerts)[0])
+	}
+
+	// Without Alert flagged messages are only logged
+	config, alerts = moderatedConfig(t, &Moderator{Actions: actions})
+	proxy = testProxy(t, config, echo(nil))
+	postMessage(proxy, `{"msgText":"说个敏感词"}`)
+	if len(*alerts) != 0 {
+		t.Errorf("got alerts %q with Alert off", *alerts)
+	}
+}
+
+func TestModerationReload(t *testing.T) {
+	m := &Moderator{Actions: map[string]string{"ad": ModerationReject}}
+	config, _ := moderatedConfig(t, m)
+	proxy := testProxy(t, config, echo(nil))
+	if rec := postMessage(proxy, `{"msgText":"买房"}`); rec.Code != 200 {
+		t.Fatalf("got %d before the word was added", rec.Code)
+	}
+	if err := os.WriteFile(m.Dictionary, []byte("[ad]\n买房\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	os.Chtimes(m.Dictionary, time.Now(), time.Now().Add(time.Second))
+	m.mu.Lock()
+	m.checked = time.Time{}
+	m.mu.Unlock()
+	if rec := postMessage(proxy, `{"msgText":"买房"}`); rec.Code != 400 {
+		t.Errorf("got %d after the reload, want 400", rec.Code)
+	}
+}
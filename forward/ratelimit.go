@@ -0,0 +1,171 @@
+package forward
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"e.coding.net/Love54dj/weizhong/etc/cache"
+	"github.com/redis/go-redis/v9"
+)
+
+// RateLimiter is a Middleware that allows at most Limit requests per key
+// within a sliding Window and answers 429 with Retry-After beyond that.
+// Counters are kept in Redis when the cache package is initialised, so the
+// limit holds across proxy instances, and in process memory otherwise.
+type RateLimiter struct {
+	Key    string        `yaml:"key"` // user, token or ip
+	Limit  int           `yaml:"limit"`
+	Window time.Duration `yaml:"window"`
+
+	mu     sync.Mutex
+	local  map[string][]time.Time
+	pruned time.Time
+}
+
+const rateLimitPrefix = "forward:ratelimit:"
+
+// slidingWindowScript records a hit in a sorted set unless the window is full.
+// It returns {allowed, milliseconds until the oldest hit leaves the window}.
+var slidingWindowScript = redis.NewScript(`
+local now = tonumber(ARGV[1])
+local window = tonumber(ARGV[2])
+local limit = tonumber(ARGV[3])
+redis.call('ZREMRANGEBYSCORE', KEYS[1], 0, now - window)
+if redis.call('ZCARD', KEYS[1]) < limit then
+	redis.call('ZADD', KEYS[1], now, ARGV[4])
+	redis.call('PEXPIRE', KEYS[1], window)
+	return {1, 0}
+end
+local oldest = redis.call('ZRANGE', KEYS[1], 0, 0, 'WITHSCORES')
+return {0, tonumber(oldest[2]) + window - now}
+`)
+
+func newRateLimiter(opts Options) (Middleware, error) {
+	m := &RateLimiter{Key: "user"}
+	if err := opts.Decode(m); err != nil {
+		return nil, err
+	}
+	switch m.Key {
+	case "user", "token", "ip":
+	default:
+		return nil, fmt.Errorf("rateLimit: key must be user, token or ip, got %q", m.Key)
+	}
+	if m.Limit <= 0 || m.Window <= 0 {
+		return nil, fmt.Errorf("rateLimit: limit and window must be positive")
+	}
+	return m, nil
+}
+
+func (m *RateLimiter) Process(w http.ResponseWriter, r *http.Request, auth string) error {
+	key := rateLimitPrefix + RoutePattern(r) + ":" + m.subject(r, auth)
+
+	var allowed bool
+	var retryAfter time.Duration
+	if cache.Ready() {
+		var err error
+		allowed, retryAfter, err = m.hitRedis(r.Context(), key)
+		if err != nil {
+			// Fail open rather than take the route down with Redis
+			log.Printf("[ERROR] Rate limit check failed for %s: %v", key, err)
+			return nil
+		}
+	} else {
+		allowed, retryAfter = m.hitLocal(key)
+	}
+	if allowed {
+		return nil
+	}
+
+	seconds := int((retryAfter + time.Second - 1) / time.Second)
+	if seconds < 1 {
+		seconds = 1
+	}
+	return &StatusError{
+		Code:   http.StatusTooManyRequests,
+		Msg:    "too many requests",
+		Header: http.Header{"Retry-After": {strconv.Itoa(seconds)}},
+	}
+}
+
+// subject returns the identifier requests are counted against
+func (m *RateLimiter) subject(r *http.Request, auth string) string {
+	if auth == "" {
+		auth = r.Header.Get("Authorization")
+	}
+	switch {
+	case m.Key == "user" && auth != "":
+		if identity, err := DefaultResolver.Resolve(r, auth); err == nil {
+			return "user:" + identity.UserID
+		}
+	case m.Key == "token" && auth != "":
+		sum := sha256.Sum256([]byte(strings.TrimPrefix(auth, "Bearer ")))
+		return "token:" + hex.EncodeToString(sum[:])
+	}
+	return "ip:" + clientIP(r)
+}
+
+func (m *RateLimiter) hitRedis(ctx context.Context, key string) (bool, time.Duration, error) {
+	now := time.Now().UnixMilli()
+	member := strconv.FormatInt(now, 10) + "-" + strconv.FormatInt(rand.Int63(), 36)
+	res, err := slidingWindowScript.Run(ctx, cache.Client, []string{key},
+		now, m.Window.Milliseconds(), m.Limit, member).Int64Slice()
+	if err != nil {
+		return false, 0, err
+	}
+	return res[0] == 1, time.Duration(res[1]) * time.Millisecond, nil
+}
+
+func (m *RateLimiter) hitLocal(key string) (bool, time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	if m.local == nil {
+		m.local = map[string][]time.Time{}
+	}
+	// Forget idle keys once per window so the map does not grow forever
+	if now.Sub(m.pruned) > m.Window {
+		for k, hits := range m.local {
+			if len(hits) == 0 || now.Sub(hits[len(hits)-1]) > m.Window {
+				delete(m.local, k)
+			}
+		}
+		m.pruned = now
+	}
+
+	hits := m.local[key]
+	for len(hits) > 0 && now.Sub(hits[0]) > m.Window {
+		hits = hits[1:]
+	}
+	if len(hits) >= m.Limit {
+		m.local[key] = hits
+		return false, hits[0].Add(m.Window).Sub(now)
+	}
+	m.local[key] = append(hits, now)
+	return true, 0
+}
+
+// clientIP returns the address of the client behind r, looking through the
+// trusted proxies of the configuration serving r as the forwarding headers do
+func clientIP(r *http.Request) string {
+	trusted := requestConfig(r).TrustedProxies
+	return chainClient(forwardedChain(r, trusted), trusted)
+}
+
+// remoteIP returns the address of the directly connected peer
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,92 @@
+package forward
+
+import (
+	"net/http"
+	"net/netip"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// limitedConfig allows one request to /limited per minute and key, behind a
+// load balancer in 10.0.0.0/8
+func limitedConfig(key string) *Config {
+	return &Config{
+		TrustedProxies: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")},
+		Routes: map[string]*RouteConfig{"/limited": {
+			Middleware: []Middleware{&RateLimiter{Key: key, Limit: 1, Window: time.Minute}},
+		}},
+	}
+}
+
+func TestRateLimitByIP(t *testing.T) {
+	proxy := testProxy(t, limitedConfig("ip"), func(w http.ResponseWriter, r *http.Request) {})
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		xff        string
+		code       int
+	}{
+		{"client A via balancer", "10.0.0.2:1000", "198.51.100.1", 200},
+		{"client B via balancer", "10.0.0.2:1001", "198.51.100.2", 200},
+		{"client A via other balancer", "10.0.0.3:1000", "198.51.100.1", 429},
+		{"direct client", "192.0.2.1:1000", "", 200},
+		{"direct client spoofing", "192.0.2.1:1001", "198.51.100.3", 429},
+	}
+	for _, tt := range tests {
+		req := newRequest(http.MethodGet, "/limited", "")
+		req.RemoteAddr = tt.remoteAddr
+		if tt.xff != "" {
+			req.Header.Set("X-Forwarded-For", tt.xff)
+		}
+		if rec := record(proxy, req); rec.Code != tt.code {
+			t.Errorf("%s: got %d %s, want %d", tt.name, rec.Code, rec.Body, tt.code)
+		}
+	}
+}
+
+func TestRateLimitByUser(t *testing.T) {
+	ry := startCountingRuoYi(t, 0) // every token belongs to user 7
+	config := limitedConfig("user")
+	config.LoginInfoURL = ry.URL + "/system/loginInfo"
+	proxy := testProxy(t, config, func(w http.ResponseWriter, r *http.Request) {})
+
+	tests := []struct {
+		name string
+		xff  string
+		auth string
+		code int
+	}{
+		{"user 7", "198.51.100.1", "Bearer a", 200},
+		{"user 7 with another token and address", "198.51.100.2", "Bearer b", 429},
+		{"anonymous from the same address", "198.51.100.1", "", 200},
+		{"anonymous again", "198.51.100.1", "", 429},
+	}
+	for _, tt := range tests {
+		req := newRequest(http.MethodGet, "/limited", "", "X-Forwarded-For: "+tt.xff)
+		req.RemoteAddr = "10.0.0.2:1000"
+		if tt.auth != "" {
+			req.Header.Set("Authorization", tt.auth)
+		}
+		if rec := record(proxy, req); rec.Code != tt.code {
+			t.Errorf("%s: got %d %s, want %d", tt.name, rec.Code, rec.Body, tt.code)
+		}
+	}
+}
+
+func TestRateLimitResponse(t *testing.T) {
+	proxy := testProxy(t, limitedConfig("ip"), func(w http.ResponseWriter, r *http.Request) {})
+	record(proxy, newRequest(http.MethodGet, "/limited", ""))
+	rec := record(proxy, newRequest(http.MethodGet, "/limited", ""))
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("got %d", rec.Code)
+	}
+	seconds, err := strconv.Atoi(rec.Header().Get("Retry-After"))
+	if err != nil || seconds < 59 || seconds > 60 {
+		t.Errorf("got Retry-After %q, want about a minute", rec.Header().Get("Retry-After"))
+	}
+	if body := rec.Body.String(); body != "too many requests\n" {
+		t.Errorf("got body %q", body)
+	}
+}
@@ -0,0 +1,245 @@
+package forward
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// RecordingConfig enables the traffic recorder. Routes opt in with Record.
+type RecordingConfig struct {
+	Path     string `yaml:"path"`     // JSONL file, rotated to path.1, path.2, ...
+	MaxSize  int64  `yaml:"maxSize"`  // bytes per file, 10MB when zero
+	MaxFiles int    `yaml:"maxFiles"` // rotated files kept, 5 when zero
+	MaxBody  int    `yaml:"maxBody"`  // bytes kept of each body, 64KB when zero
+}
+
+func (rc RecordingConfig) withDefaults() RecordingConfig {
+	if rc.MaxSize <= 0 {
+		rc.MaxSize = 10 << 20
+	}
+	if rc.MaxFiles <= 0 {
+		rc.MaxFiles = 5
+	}
+	if rc.MaxBody <= 0 {
+		rc.MaxBody = 64 << 10
+	}
+	return rc
+}
+
+// Recording is one request and the response the proxy gave, as one line of
+// the recorder's file. Credentials and mobile numbers are redacted.
+type Recording struct {
+	Time           time.Time   `json:"time"`
+	RequestID      string      `json:"requestId"`
+	Route          string      `json:"route"`
+	Method         string      `json:"method"`
+	URI            string      `json:"uri"`              // as the client sent it
+	Target         string      `json:"target,omitempty"` // as forwarded upstream
+	RequestHeader  http.Header `json:"requestHeader"`
+	RequestBody    string      `json:"requestBody,omitempty"`
+	Status         int         `json:"status"`
+	ResponseHeader http.Header `json:"responseHeader"`
+	ResponseBody   string      `json:"responseBody,omitempty"`
+	Truncated      bool        `json:"truncated,omitempty"` // a body was cut at maxBody, or left out for responses
+	DurationMs     int64       `json:"durationMs"`
+}
+
+// redactedHeaders never reach a recording
+var redactedHeaders = []string{"Authorization", "Cookie", "Set-Cookie", "Proxy-Authorization", TestAccessHeader}
+
+// Redacted replaces recorded credentials
+const Redacted = "[REDACTED]"
+
+// Recorder appends recordings to a JSONL file, starting a new one when it
+// reaches MaxSize. It is safe for concurrent use.
+type Recorder struct {
+	config RecordingConfig
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+var (
+	recordersMu sync.Mutex
+	recorders   = map[string]*Recorder{}
+)
+
+// NewRecorder returns the recorder writing to config.Path. Configurations
+// naming the same file share one recorder, so reloads keep appending to it.
+func NewRecorder(config RecordingConfig) *Recorder {
+	config = config.withDefaults()
+	recordersMu.Lock()
+	defer recordersMu.Unlock()
+	rec := recorders[config.Path]
+	if rec == nil {
+		rec = &Recorder{}
+		recorders[config.Path] = rec
+	}
+	rec.mu.Lock()
+	rec.config = config
+	rec.mu.Unlock()
+	return rec
+}
+
+// Record appends entry to the file
+func (rec *Recorder) Record(entry *Recording) error {
+	line, err := marshalJSON(entry)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	if rec.file == nil {
+		if err := rec.open(); err != nil {
+			return err
+		}
+	}
+	if rec.size > 0 && rec.size+int64(len(line)) > rec.config.MaxSize {
+		if err := rec.rotate(); err != nil {
+			return err
+		}
+		if err := rec.open(); err != nil {
+			return err
+		}
+	}
+	n, err := rec.file.Write(line)
+	rec.size += int64(n)
+	return err
+}
+
+func (rec *Recorder) open() error {
+	file, err := os.OpenFile(rec.config.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	rec.file, rec.size = file, info.Size()
+	return nil
+}
+
+// rotate closes the current file and shifts path to path.1, path.1 to
+// path.2 and so on, dropping the oldest
+func (rec *Recorder) rotate() error {
+	rec.file.Close()
+	rec.file, rec.size = nil, 0
+	path := rec.config.Path
+	os.Remove(fmt.Sprintf("%s.%d", path, rec.config.MaxFiles))
+	for i := rec.config.MaxFiles - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", path, i), fmt.Sprintf("%s.%d", path, i+1))
+	}
+	return os.Rename(path, path+".1")
+}
+
+// Close closes the current file; the next recording opens it again
+func (rec *Recorder) Close() error {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	if rec.file == nil {
+		return nil
+	}
+	err := rec.file.Close()
+	rec.file = nil
+	return err
+}
+
+// startRecording captures the request r as it arrived, before validators and
+// middleware see it, and wraps w to capture the response. finish writes the
+// recording once the response is complete.
+func (rec *Recorder) startRecording(w http.ResponseWriter, r *http.Request, route string) (http.ResponseWriter, *Recording, func()) {
+	maxBody := rec.config.MaxBody
+	entry := &Recording{
+		Time:          time.Now(),
+		RequestID:     r.Header.Get(RequestIDHeader),
+		Route:         route,
+		Method:        r.Method,
+		URI:           maskMobiles(r.URL.RequestURI(), ""),
+		RequestHeader: redactHeader(r.Header),
+	}
+	if r.Body != nil && r.Body != http.NoBody {
+		head, _ := io.ReadAll(io.LimitReader(r.Body, int64(maxBody)+1))
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(head), r.Body), r.Body}
+		entry.RequestBody, entry.Truncated = recordedBody(head, maxBody)
+	}
+
+	capture := &captureWriter{ResponseWriter: w, limit: maxBody}
+	finish := func() {
+		entry.Status = capture.statusCode()
+		entry.ResponseHeader = redactHeader(capture.Header())
+		entry.ResponseBody, _ = recordedBody(capture.body.Bytes(), maxBody)
+		entry.Truncated = entry.Truncated || capture.overflow
+		entry.DurationMs = time.Since(entry.Time).Milliseconds()
+		if err := rec.Record(entry); err != nil {
+			log.Printf("[ERROR] Recording request %s failed: %v", entry.RequestID, err)
+		}
+	}
+	return capture, entry, finish
+}
+
+func redactHeader(h http.Header) http.Header {
+	h = h.Clone()
+	for _, name := range redactedHeaders {
+		if h.Get(name) != "" {
+			h.Set(name, Redacted)
+		}
+	}
+	for _, values := range h {
+		for i, value := range values {
+			values[i] = maskMobiles(value, "")
+		}
+	}
+	return h
+}
+
+// recordedBody returns body, cut to max bytes, with its mobile numbers
+// masked. Binary bodies are summarised.
+func recordedBody(body []byte, max int) (string, bool) {
+	truncated := len(body) > max
+	if truncated {
+		body = body[:max]
+		// Drop a character cut in half
+		for i := 0; i < utf8.UTFMax-1 && len(body) > 0 && !utf8.Valid(body); i++ {
+			body = body[:len(body)-1]
+		}
+	}
+	if !utf8.Valid(body) {
+		return fmt.Sprintf("<%d bytes of binary data>", len(body)), truncated
+	}
+	return maskMobiles(string(body), ""), truncated
+}
+
+// ReadRecordings decodes a recorder file
+func ReadRecordings(r io.Reader) ([]Recording, error) {
+	var recordings []Recording
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64<<10), 16<<20)
+	for line := 1; scanner.Scan(); line++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var entry Recording
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		recordings = append(recordings, entry)
+	}
+	return recordings, scanner.Err()
+}
@@ -0,0 +1,113 @@
+package forward
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"e.coding.net/Love54dj/weizhong/etc/ryfake"
+)
+
+func TestRecordAndReplay(t *testing.T) {
+	ry := ryfake.NewServer()
+	defer ry.Close()
+
+	path := filepath.Join(t.TempDir(), "traffic.jsonl")
+	config, err := ParseConfig([]byte(`
+baseUrl: ` + ry.URL + `
+recording: {path: ` + path + `, maxSize: 2000, maxFiles: 2}
+routes:
+  - {path: /me, targetPath: /system/loginInfo, auth: token, record: true}
+  - {path: /system/message/list, auth: messageList, middleware: [messageList], record: true}
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := NewProxyServer(config)
+	defer proxy.Close()
+
+	send := func(target string) {
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		req.Header.Set("Authorization", "Bearer token-1001")
+		proxy.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	send("/me")
+	sender := ryfake.SenderID("digital", 1001, FixedLawyerId)
+	send("/system/message/list?senderId=" + sender)
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recordings, err := ReadRecordings(f)
+	f.Close()
+	if err != nil || len(recordings) != 2 {
+		t.Fatalf("got %d recordings, %v", len(recordings), err)
+	}
+	me := recordings[0]
+	if me.Route != "/me" || me.Target != "/system/loginInfo" || me.Status != http.StatusOK || me.RequestID == "" {
+		t.Errorf("recorded %+v", me)
+	}
+	if me.RequestHeader.Get("Authorization") != Redacted || strings.Contains(me.ResponseBody, "13800001001") ||
+		!strings.Contains(me.ResponseBody, "138****1001") {
+		t.Errorf("not redacted: %v %s", me.RequestHeader, me.ResponseBody)
+	}
+
+	// Replaying against the same backend matches, until it changes
+	opts := ReplayOptions{Upstream: ry.URL, Authorization: "Bearer token-1001", Ignore: []string{"createdAt"}}
+	for _, rec := range recordings {
+		result, err := Replay(context.Background(), &rec, opts)
+		if err != nil || len(result.Diffs) > 0 {
+			t.Errorf("replay %s: %v %v", rec.URI, result, err)
+		}
+	}
+
+	// A truncated recording would send a prefix of its body
+	cut := me
+	cut.Truncated = true
+	sent := len(ry.Backend.Requests())
+	if _, err := Replay(context.Background(), &cut, opts); !errors.Is(err, ErrTruncated) || len(ry.Backend.Requests()) != sent {
+		t.Errorf("replayed a truncated recording: %v", err)
+	}
+
+	ry.Backend.AddUser(ryfake.User{Token: "token-1001"})
+	result, err := Replay(context.Background(), &me, opts)
+	if err != nil || len(result.Diffs) == 0 || !strings.Contains(strings.Join(result.Diffs, "\n"), "$.data.mobile") {
+		t.Errorf("replay after change: %v %v", result, err)
+	}
+
+	// Further traffic rotates the file, keeping two old ones
+	for i := 0; i < 10; i++ {
+		send("/me")
+	}
+	for _, name := range []string{path, path + ".1", path + ".2"} {
+		if info, err := os.Stat(name); err != nil || info.Size() > 2000 {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); err == nil {
+		t.Error("kept more than maxFiles rotated files")
+	}
+}
+
+func TestDiffBodies(t *testing.T) {
+	diffs := DiffBodies(`{"code":200,"rows":[{"id":1,"createdAt":"a"}],"gone":true}`,
+		`{"code":200,"rows":[{"id":2,"createdAt":"b"},{"id":3}],"new":1}`, []string{"createdAt"})
+	want := []string{
+		"$.gone: missing, recorded true",
+		"$.new: added 1",
+		"$.rows: 2 elements, recorded 1",
+		"$.rows[0].id: 2, recorded 1",
+	}
+	if strings.Join(diffs, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got %q", diffs)
+	}
+	if diffs := DiffBodies("ok", "ok", nil); len(diffs) != 0 {
+		t.Errorf("equal text: %q", diffs)
+	}
+}
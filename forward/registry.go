@@ -0,0 +1,191 @@
+package forward
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// Options gives a factory access to the options block of a route file entry.
+// Decode is a no-op when the entry has no options.
+type Options interface {
+	Decode(v any) error
+}
+
+// ValidatorFactory builds an AuthValidator from its route file options
+type ValidatorFactory func(opts Options) (AuthValidator, error)
+
+// MiddlewareFactory builds a Middleware from its route file options
+type MiddlewareFactory func(opts Options) (Middleware, error)
+
+// SchemaFactory returns a pointer to a new value of a struct that request
+// bodies are decoded into and checked with its validate tags
+type SchemaFactory func() any
+
+// ResponseMiddlewareFactory builds a ResponseMiddleware from its route file options
+type ResponseMiddlewareFactory func(opts Options) (ResponseMiddleware, error)
+
+var (
+	registryMu          sync.RWMutex
+	validators          = map[string]ValidatorFactory{}
+	middlewares         = map[string]MiddlewareFactory{}
+	responseMiddlewares = map[string]ResponseMiddlewareFactory{}
+	schemas             = map[string]SchemaFactory{}
+)
+
+func init() {
+	RegisterValidator("token", func(Options) (AuthValidator, error) { return &TokenAuthValidator{}, nil })
+	RegisterValidator("referer", func(Options) (AuthValidator, error) { return &RefererAuthValidator{}, nil })
+	RegisterValidator("messageList", func(Options) (AuthValidator, error) { return &MessageListAuthValidator{}, nil })
+	RegisterValidator("message", func(Options) (AuthValidator, error) { return &MessageAuthValidator{}, nil })
+	RegisterValidator("jwt", newJWTValidator)
+
+	RegisterMiddleware("senderId", func(Options) (Middleware, error) { return &SenderIDValidator{}, nil })
+	RegisterMiddleware("messageList", func(Options) (Middleware, error) { return &MessageListHandler{}, nil })
+	RegisterMiddleware("message", newMessageHandler)
+	RegisterMiddleware("invalidateIdentity", func(Options) (Middleware, error) { return &LogoutInvalidator{}, nil })
+	RegisterMiddleware("rateLimit", newRateLimiter)
+	RegisterMiddleware("moderate", newModerator)
+
+	RegisterResponseMiddleware("redactMobile", newMobileRedactor)
+	RegisterResponseMiddleware("errorEnvelope", newErrorEnvelope)
+
+	RegisterSchema("message", func() any { return &messageSchema{} })
+}
+
+// RegisterValidator makes an AuthValidator available to route files under name.
+// It panics if name is empty or already registered.
+func RegisterValidator(name string, factory ValidatorFactory) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	if name == "" || factory == nil {
+		panic("forward: RegisterValidator needs a name and a factory")
+	}
+	if _, dup := validators[name]; dup {
+		panic("forward: RegisterValidator called twice for " + name)
+	}
+	validators[name] = factory
+}
+
+// RegisterMiddleware makes a Middleware available to route files under name.
+// It panics if name is empty or already registered.
+func RegisterMiddleware(name string, factory MiddlewareFactory) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	if name == "" || factory == nil {
+		panic("forward: RegisterMiddleware needs a name and a factory")
+	}
+	if _, dup := middlewares[name]; dup {
+		panic("forward: RegisterMiddleware called twice for " + name)
+	}
+	middlewares[name] = factory
+}
+
+// RegisterResponseMiddleware makes a ResponseMiddleware available to route
+// files under name. It panics if name is empty or already registered.
+func RegisterResponseMiddleware(name string, factory ResponseMiddlewareFactory) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	if name == "" || factory == nil {
+		panic("forward: RegisterResponseMiddleware needs a name and a factory")
+	}
+	if _, dup := responseMiddlewares[name]; dup {
+		panic("forward: RegisterResponseMiddleware called twice for " + name)
+	}
+	responseMiddlewares[name] = factory
+}
+
+// RegisterSchema makes a request body schema available to route files under
+// name. It panics if name is empty or already registered.
+func RegisterSchema(name string, factory SchemaFactory) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	if name == "" || factory == nil {
+		panic("forward: RegisterSchema needs a name and a factory")
+	}
+	if _, dup := schemas[name]; dup {
+		panic("forward: RegisterSchema called twice for " + name)
+	}
+	schemas[name] = factory
+}
+
+// NewValidator builds the AuthValidator registered under name
+func NewValidator(name string, opts Options) (AuthValidator, error) {
+	registryMu.RLock()
+	factory, ok := validators[name]
+	registryMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown auth validator %q", name)
+	}
+	return factory(optionsOrEmpty(opts))
+}
+
+// NewMiddleware builds the Middleware registered under name
+func NewMiddleware(name string, opts Options) (Middleware, error) {
+	registryMu.RLock()
+	factory, ok := middlewares[name]
+	registryMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown middleware %q", name)
+	}
+	return factory(optionsOrEmpty(opts))
+}
+
+// NewResponseMiddleware builds the ResponseMiddleware registered under name
+func NewResponseMiddleware(name string, opts Options) (ResponseMiddleware, error) {
+	registryMu.RLock()
+	factory, ok := responseMiddlewares[name]
+	registryMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown response middleware %q", name)
+	}
+	return factory(optionsOrEmpty(opts))
+}
+
+// Validators returns the registered validator names in sorted order
+func Validators() []string {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	return sortedKeys(validators)
+}
+
+// Middlewares returns the registered middleware names in sorted order
+func Middlewares() []string {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	return sortedKeys(middlewares)
+}
+
+// ResponseMiddlewares returns the registered response middleware names in sorted order
+func ResponseMiddlewares() []string {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	return sortedKeys(responseMiddlewares)
+}
+
+// Schemas returns the registered schema names in sorted order
+func Schemas() []string {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	return sortedKeys(schemas)
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+type noOptions struct{}
+
+func (noOptions) Decode(any) error { return nil }
+
+func optionsOrEmpty(opts Options) Options {
+	if opts == nil {
+		return noOptions{}
+	}
+	return opts
+}
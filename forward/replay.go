@@ -0,0 +1,183 @@
+package forward
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// ReplayOptions says where and how recordings are sent again
+type ReplayOptions struct {
+	// Upstream is the base URL requests are sent to, e.g. a staging RuoYi
+	Upstream string
+	// ThroughProxy sends the URI the client used instead of the upstream
+	// target, for replaying against another proxy
+	ThroughProxy bool
+	// Authorization replaces the redacted credentials of the recordings
+	Authorization string
+	// Ignore names JSON keys left out of the comparison, such as createdAt
+	Ignore []string
+	// Client sends the requests, http.DefaultClient when nil
+	Client *http.Client
+}
+
+// ReplayResult is the response to a replayed recording and how it differs
+// from the recorded one
+type ReplayResult struct {
+	Status int
+	Body   string // with mobile numbers masked like in recordings
+	Diffs  []string
+}
+
+// ErrTruncated is returned for recordings whose bodies were cut at maxBody.
+// Sending such a request again would send only part of its body.
+var ErrTruncated = errors.New("recording is truncated, not replayable")
+
+// replayedHeaders are set by the proxy or the transport and not replayed
+var replayedHeaders = []string{
+	"Accept-Encoding", "Content-Length", "Forwarded", "X-Forwarded-For",
+	"X-Forwarded-Host", "X-Forwarded-Proto", "X-Real-Ip",
+}
+
+// Replay sends rec again and compares the response with the recorded one.
+// Truncated recordings are not sent and fail with ErrTruncated.
+func Replay(ctx context.Context, rec *Recording, opts ReplayOptions) (*ReplayResult, error) {
+	if rec.Truncated {
+		return nil, ErrTruncated
+	}
+	uri := rec.Target
+	if opts.ThroughProxy || uri == "" {
+		uri = rec.URI
+	}
+	var body io.Reader
+	if rec.RequestBody != "" {
+		body = strings.NewReader(rec.RequestBody)
+	}
+	req, err := http.NewRequestWithContext(ctx, rec.Method, strings.TrimSuffix(opts.Upstream, "/")+uri, body)
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range rec.RequestHeader {
+		if !slices.Contains(values, Redacted) {
+			req.Header[name] = values
+		}
+	}
+	removeHopHeaders(req.Header)
+	for _, name := range replayedHeaders {
+		req.Header.Del(name)
+	}
+	if rec.RequestHeader.Get("Authorization") != "" && opts.Authorization != "" {
+		req.Header.Set("Authorization", opts.Authorization)
+	}
+
+	client := opts.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &ReplayResult{Status: resp.StatusCode}
+	result.Body, _ = recordedBody(data, len(data))
+	if resp.StatusCode != rec.Status {
+		result.Diffs = append(result.Diffs, fmt.Sprintf("status: %d, recorded %d", resp.StatusCode, rec.Status))
+	}
+	result.Diffs = append(result.Diffs, DiffBodies(rec.ResponseBody, result.Body, opts.Ignore)...)
+	return result, nil
+}
+
+// DiffBodies lists the differences between two response bodies. JSON bodies
+// are compared value by value, skipping the keys in ignore at any depth.
+func DiffBodies(recorded, replayed string, ignore []string) []string {
+	var a, b any
+	if json.Unmarshal([]byte(recorded), &a) != nil || json.Unmarshal([]byte(replayed), &b) != nil {
+		if recorded == replayed {
+			return nil
+		}
+		return []string{fmt.Sprintf("body: %q, recorded %q", clip(replayed), clip(recorded))}
+	}
+	var diffs []string
+	diffJSON("$", a, b, ignore, &diffs)
+	return diffs
+}
+
+func diffJSON(path string, recorded, replayed any, ignore []string, diffs *[]string) {
+	switch a := recorded.(type) {
+	case map[string]any:
+		b, ok := replayed.(map[string]any)
+		if !ok {
+			break
+		}
+		keys := map[string]bool{}
+		for k := range a {
+			keys[k] = true
+		}
+		for k := range b {
+			keys[k] = true
+		}
+		sorted := make([]string, 0, len(keys))
+		for k := range keys {
+			if !slices.Contains(ignore, k) {
+				sorted = append(sorted, k)
+			}
+		}
+		sort.Strings(sorted)
+		for _, k := range sorted {
+			av, inA := a[k]
+			bv, inB := b[k]
+			switch {
+			case !inA:
+				*diffs = append(*diffs, fmt.Sprintf("%s.%s: added %s", path, k, jsonText(bv)))
+			case !inB:
+				*diffs = append(*diffs, fmt.Sprintf("%s.%s: missing, recorded %s", path, k, jsonText(av)))
+			default:
+				diffJSON(path+"."+k, av, bv, ignore, diffs)
+			}
+		}
+		return
+	case []any:
+		b, ok := replayed.([]any)
+		if !ok {
+			break
+		}
+		if len(a) != len(b) {
+			*diffs = append(*diffs, fmt.Sprintf("%s: %d elements, recorded %d", path, len(b), len(a)))
+		}
+		for i := 0; i < min(len(a), len(b)); i++ {
+			diffJSON(fmt.Sprintf("%s[%d]", path, i), a[i], b[i], ignore, diffs)
+		}
+		return
+	}
+	if !reflect.DeepEqual(recorded, replayed) {
+		*diffs = append(*diffs, fmt.Sprintf("%s: %s, recorded %s", path, jsonText(replayed), jsonText(recorded)))
+	}
+}
+
+func jsonText(v any) string {
+	data, _ := marshalJSON(v)
+	return clip(string(data))
+}
+
+// clip shortens s for a diff line
+func clip(s string) string {
+	const max = 200
+	if len(s) <= max {
+		return s
+	}
+	return string(bytes.ToValidUTF8([]byte(s[:max]), nil)) + "..."
+}
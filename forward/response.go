@@ -0,0 +1,171 @@
+package forward
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// MobileRedactor masks mainland mobile numbers in JSON responses, such as the
+// numbers of other users in /system/message/list
+type MobileRedactor struct {
+	Fields  []string `yaml:"fields"`  // only mask values of these keys, all strings when empty
+	KeepOwn bool     `yaml:"keepOwn"` // leave the caller's own number readable
+}
+
+func newMobileRedactor(opts Options) (ResponseMiddleware, error) {
+	m := &MobileRedactor{}
+	if err := opts.Decode(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (m *MobileRedactor) ProcessResponse(r *http.Request, resp *UpstreamResponse, auth string) error {
+	dec := json.NewDecoder(bytes.NewReader(resp.Body))
+	dec.UseNumber()
+	var doc any
+	if err := dec.Decode(&doc); err != nil {
+		return nil // Not JSON, leave untouched
+	}
+
+	own := ""
+	if m.KeepOwn && auth != "" {
+		// Failing to learn the caller's number only means it gets masked too
+		if identity, err := DefaultResolver.Resolve(r, auth); err == nil {
+			own = identity.Mobile
+		}
+	}
+
+	var fields map[string]bool
+	if len(m.Fields) > 0 {
+		fields = make(map[string]bool, len(m.Fields))
+		for _, f := range m.Fields {
+			fields[f] = true
+		}
+	}
+
+	changed := false
+	var walk func(v any, key string) any
+	walk = func(v any, key string) any {
+		switch v := v.(type) {
+		case map[string]any:
+			for k, child := range v {
+				v[k] = walk(child, k)
+			}
+		case []any:
+			for i, child := range v {
+				v[i] = walk(child, key)
+			}
+		case string:
+			if fields == nil || fields[key] {
+				if masked := maskMobiles(v, own); masked != v {
+					changed = true
+					return masked
+				}
+			}
+		}
+		return v
+	}
+	doc = walk(doc, "")
+	if !changed {
+		return nil
+	}
+
+	body, err := marshalJSON(doc)
+	if err != nil {
+		return err
+	}
+	resp.Body = body
+	return nil
+}
+
+// maskMobiles replaces the middle four digits of every mobile number in s
+// except own
+func maskMobiles(s string, own string) string {
+	var b []byte
+	start := -1
+	for i := 0; i <= len(s); i++ {
+		if i < len(s) && s[i] >= '0' && s[i] <= '9' {
+			if start < 0 {
+				start = i
+			}
+			continue
+		}
+		if start >= 0 && i-start == 11 && isMobile(s[start:i]) && s[start:i] != own {
+			if b == nil {
+				b = []byte(s)
+			}
+			copy(b[start+3:start+7], "****")
+		}
+		start = -1
+	}
+	if b == nil {
+		return s
+	}
+	return string(b)
+}
+
+func isMobile(digits string) bool {
+	return len(digits) == 11 && digits[0] == '1' && digits[1] >= '3' && digits[1] <= '9'
+}
+
+// marshalJSON encodes v without escaping HTML characters
+func marshalJSON(v any) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
+
+// ErrorEnvelope rewrites upstream error responses that are not already in
+// RuoYi's {code,msg} format, so clients only ever see one error shape
+type ErrorEnvelope struct {
+	HideDetails bool `yaml:"hideDetails"` // replace 5xx messages with the status text
+}
+
+func newErrorEnvelope(opts Options) (ResponseMiddleware, error) {
+	m := &ErrorEnvelope{}
+	if err := opts.Decode(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// ruoyiEnvelope is the common RuoYi response shape
+type ruoyiEnvelope struct {
+	Code int    `json:"code"`
+	Msg  string `json:"msg"`
+}
+
+func (m *ErrorEnvelope) ProcessResponse(r *http.Request, resp *UpstreamResponse, auth string) error {
+	if resp.StatusCode < http.StatusBadRequest {
+		return nil
+	}
+	hide := m.HideDetails && resp.StatusCode >= http.StatusInternalServerError
+
+	var existing struct {
+		Code *int    `json:"code"`
+		Msg  *string `json:"msg"`
+	}
+	isJSON := json.Unmarshal(resp.Body, &existing) == nil
+	if isJSON && existing.Code != nil && existing.Msg != nil && !hide {
+		return nil
+	}
+
+	msg := http.StatusText(resp.StatusCode)
+	if text := strings.TrimSpace(string(resp.Body)); !isJSON && !hide && text != "" {
+		msg = text
+	}
+	body, err := marshalJSON(ruoyiEnvelope{Code: resp.StatusCode, Msg: msg})
+	if err != nil {
+		return err
+	}
+	resp.Body = body
+	resp.Header.Set("Content-Type", "application/json;charset=UTF-8")
+	return nil
+}
@@ -0,0 +1,167 @@
+package forward
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"e.coding.net/Love54dj/weizhong/etc/cache"
+)
+
+// ResponseCacheConfig caches the successful GET responses of a route in Redis,
+// separately for every caller and query. The upstream may shorten the TTL or
+// forbid caching with Cache-Control.
+type ResponseCacheConfig struct {
+	TTL time.Duration `yaml:"ttl"` // zero disables, e.g. 5s
+
+	// InvalidatedBy lists route paths; any other request a caller makes on
+	// one of them drops the caller's cached responses of this route
+	InvalidatedBy []string `yaml:"invalidatedBy"`
+}
+
+const (
+	responseCachePrefix  = "forward:cache:"
+	responseCacheMaxBody = 1 << 20 // larger responses are not cached
+)
+
+// cachedResponse is a response stored in the Redis hash of a route and caller
+type cachedResponse struct {
+	Status  int         `json:"status"`
+	Header  http.Header `json:"header,omitempty"` // see storedHeaders
+	Body    []byte      `json:"body"`
+	Stored  time.Time   `json:"stored"`
+	Expires time.Time   `json:"expires"`
+}
+
+// responseCacheKey names the hash holding the cached responses of route for
+// a caller, one field per query
+func responseCacheKey(route, subject string) string {
+	return responseCachePrefix + route + ":" + subject
+}
+
+// forwardCached answers a GET from the cache or forwards it and caches the
+// response. Clients sending Cache-Control: no-cache skip the lookup.
+func (s *ProxyServer) forwardCached(w http.ResponseWriter, r *http.Request, routeConfig *RouteConfig, auth string, forward func(http.ResponseWriter)) {
+	config := routeConfig.Cache
+	key := responseCacheKey(RoutePattern(r), callerSubject(r, auth))
+	sum := sha256.Sum256([]byte(r.URL.Path + "?" + r.URL.Query().Encode()))
+	field := hex.EncodeToString(sum[:])
+
+	if !strings.Contains(r.Header.Get("Cache-Control"), "no-cache") {
+		var stored cachedResponse
+		if raw := cache.HGet(key, field); raw != "" && json.Unmarshal([]byte(raw), &stored) == nil && time.Now().Before(stored.Expires) {
+			log.Printf("[INFO] Serving cached response for %s", r.URL.Path)
+			for name, values := range stored.Header {
+				w.Header()[name] = values
+			}
+			w.Header().Set("Age", strconv.Itoa(int(time.Since(stored.Stored)/time.Second)))
+			w.Header().Set("X-Cache", "HIT")
+			w.Header().Set("Content-Length", strconv.Itoa(len(stored.Body)))
+			w.WriteHeader(stored.Status)
+			w.Write(stored.Body)
+			return
+		}
+	}
+
+	w.Header().Set("X-Cache", "MISS")
+	capture := &captureWriter{ResponseWriter: w, limit: responseCacheMaxBody}
+	forward(capture)
+	if capture.statusCode() != http.StatusOK || capture.overflow || capture.Header().Get("Set-Cookie") != "" {
+		return
+	}
+	if ruoyiFailed(capture.Header(), capture.body.Bytes()) {
+		return
+	}
+	ttl, ok := cacheLifetime(capture.Header(), config.TTL)
+	if !ok {
+		return
+	}
+	now := time.Now()
+	data, err := json.Marshal(cachedResponse{
+		Status:  http.StatusOK,
+		Header:  storableHeader(capture.Header()),
+		Body:    capture.body.Bytes(),
+		Stored:  now,
+		Expires: now.Add(ttl),
+	})
+	if err == nil {
+		// Entries expire on their own, the hash once none can be live
+		err = cache.HSetEx(key, field, string(data), config.TTL)
+	}
+	if err != nil {
+		log.Printf("[ERROR] Caching response for %s failed: %v", r.URL.Path, err)
+	}
+}
+
+// ruoyiFailed reports whether a JSON body carries a RuoYi code other than
+// 200, which RuoYi sends with HTTP 200 for errors such as an expired login
+func ruoyiFailed(h http.Header, body []byte) bool {
+	if !strings.Contains(h.Get("Content-Type"), "json") {
+		return false
+	}
+	var envelope struct {
+		Code *int `json:"code"`
+	}
+	if json.Unmarshal(body, &envelope) != nil {
+		return false
+	}
+	return envelope.Code != nil && *envelope.Code != http.StatusOK
+}
+
+// invalidateResponses drops the caller's cached responses of routes
+func invalidateResponses(r *http.Request, auth string, routes []string) {
+	subject := callerSubject(r, auth)
+	keys := make([]string, len(routes))
+	for i, route := range routes {
+		keys[i] = responseCacheKey(route, subject)
+	}
+	if err := cache.Del(keys...); err != nil {
+		log.Printf("[ERROR] Invalidating cached responses of %s failed: %v", strings.Join(routes, ", "), err)
+	}
+}
+
+// cacheLifetime returns how long a response with header h may be cached, at
+// most max, and whether it may be cached at all
+func cacheLifetime(h http.Header, max time.Duration) (time.Duration, bool) {
+	ttl := max
+	maxAge, sharedMaxAge := -1, -1
+	for _, value := range h.Values("Cache-Control") {
+		for _, directive := range strings.Split(value, ",") {
+			name, arg, _ := strings.Cut(strings.TrimSpace(directive), "=")
+			switch strings.ToLower(name) {
+			case "no-store", "no-cache":
+				return 0, false
+			case "max-age":
+				if n, err := strconv.Atoi(strings.Trim(arg, `"`)); err == nil {
+					maxAge = n
+				}
+			case "s-maxage":
+				if n, err := strconv.Atoi(strings.Trim(arg, `"`)); err == nil {
+					sharedMaxAge = n
+				}
+			}
+		}
+	}
+	// The proxy is a shared cache, so s-maxage takes precedence
+	if sharedMaxAge >= 0 {
+		maxAge = sharedMaxAge
+	}
+	if maxAge >= 0 && time.Duration(maxAge)*time.Second < ttl {
+		ttl = time.Duration(maxAge) * time.Second
+	}
+	return ttl, ttl > 0
+}
+
+// isSafeMethod reports whether method only reads (RFC 9110, section 9.2.1)
+func isSafeMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return true
+	}
+	return false
+}
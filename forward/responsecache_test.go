@@ -0,0 +1,187 @@
+package forward
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCacheLifetime(t *testing.T) {
+	tests := []struct {
+		cacheControl string
+		want         time.Duration
+		ok           bool
+	}{
+		{"", 10 * time.Second, true},
+		{"max-age=3", 3 * time.Second, true},
+		{"max-age=60", 10 * time.Second, true},
+		{"private, max-age=60, s-maxage=2", 2 * time.Second, true},
+		{"max-age=0", 0, false},
+		{"no-store", 0, false},
+		{"No-Cache", 0, false},
+	}
+	for _, tt := range tests {
+		h := http.Header{}
+		if tt.cacheControl != "" {
+			h.Set("Cache-Control", tt.cacheControl)
+		}
+		got, ok := cacheLifetime(h, 10*time.Second)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("%q: got %v %v, want %v %v", tt.cacheControl, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+// itemsUpstream lists items at /items, gzipped when the request accepts it,
+// and adds one on POST /items/add. The query may set Cache-Control and
+// Set-Cookie on the listing, or turn it into a RuoYi {code} body.
+type itemsUpstream struct {
+	lists atomic.Int32
+	added atomic.Int32
+}
+
+func (u *itemsUpstream) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		u.added.Add(1)
+		return
+	}
+	u.lists.Add(1)
+	query := r.URL.Query()
+	if cc := query.Get("cc"); cc != "" {
+		w.Header().Set("Cache-Control", cc)
+	}
+	if query.Has("cookie") {
+		w.Header().Set("Set-Cookie", "a=b")
+	}
+	if code := query.Get("code"); code != "" {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"code":%s,"msg":"m"}`, code)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	body := fmt.Sprintf("items=%d page=%s", u.added.Load(), query.Get("page"))
+	if strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+		w.Header().Set("Content-Encoding", "gzip")
+		zw := gzip.NewWriter(w)
+		io.WriteString(zw, body)
+		zw.Close()
+		return
+	}
+	io.WriteString(w, body)
+}
+
+// itemsConfig caches /items for a minute and drops it on POST /items/add
+func itemsConfig() *Config {
+	return &Config{Routes: map[string]*RouteConfig{
+		"/items":     {Cache: ResponseCacheConfig{TTL: time.Minute, InvalidatedBy: []string{"/items/add"}}},
+		"/items/add": {},
+	}}
+}
+
+// getItems sends a GET from client, an address such as "192.0.2.1:1"
+func getItems(proxy *ProxyServer, target, client string, header ...string) *httptest.ResponseRecorder {
+	req := newRequest(http.MethodGet, target, "", header...)
+	req.RemoteAddr = client
+	return record(proxy, req)
+}
+
+func TestResponseCacheHit(t *testing.T) {
+	startFakeRedis(t)
+	upstream := &itemsUpstream{}
+	proxy := testProxy(t, itemsConfig(), upstream.ServeHTTP)
+
+	for i, tt := range []struct{ acceptEncoding, xCache string }{{"gzip", "MISS"}, {"", "HIT"}, {"gzip", "HIT"}} {
+		rec := getItems(proxy, "/items?page=1", "192.0.2.1:1", "Accept-Encoding: "+tt.acceptEncoding)
+		if rec.Header().Get("X-Cache") != tt.xCache || rec.Body.String() != "items=0 page=1" {
+			t.Errorf("request %d: got %s %q, want %s", i, rec.Header().Get("X-Cache"), rec.Body, tt.xCache)
+		}
+		if h := rec.Header(); h.Get("Content-Type") != "text/plain" || h.Get("Content-Encoding") != "" || (i > 0 && h.Get("Age") == "") {
+			t.Errorf("request %d: got headers %v", i, h)
+		}
+	}
+	if n := upstream.lists.Load(); n != 1 {
+		t.Errorf("upstream got %d listings, want 1", n)
+	}
+
+	// no-cache skips the lookup and refreshes the entry
+	if rec := getItems(proxy, "/items?page=1", "192.0.2.1:1", "Cache-Control: no-cache"); rec.Header().Get("X-Cache") != "MISS" {
+		t.Errorf("no-cache: got X-Cache %q", rec.Header().Get("X-Cache"))
+	}
+	if n := upstream.lists.Load(); n != 2 {
+		t.Errorf("upstream got %d listings, want 2", n)
+	}
+}
+
+func TestResponseCacheKeys(t *testing.T) {
+	startFakeRedis(t)
+	upstream := &itemsUpstream{}
+	proxy := testProxy(t, itemsConfig(), upstream.ServeHTTP)
+
+	tests := []struct {
+		target, client, xCache string
+	}{
+		{"/items?page=1&size=10", "192.0.2.1:1", "MISS"},
+		{"/items?size=10&page=1", "192.0.2.1:2", "HIT"},
+		{"/items?page=2&size=10", "192.0.2.1:1", "MISS"},
+		{"/items?page=1&size=10", "192.0.2.2:1", "MISS"},
+	}
+	for _, tt := range tests {
+		if rec := getItems(proxy, tt.target, tt.client); rec.Header().Get("X-Cache") != tt.xCache {
+			t.Errorf("%s from %s: got X-Cache %q, want %q", tt.target, tt.client, rec.Header().Get("X-Cache"), tt.xCache)
+		}
+	}
+	if n := upstream.lists.Load(); n != 3 {
+		t.Errorf("upstream got %d listings, want 3", n)
+	}
+}
+
+func TestResponseCacheRespectsUpstream(t *testing.T) {
+	startFakeRedis(t)
+	upstream := &itemsUpstream{}
+	proxy := testProxy(t, itemsConfig(), upstream.ServeHTTP)
+
+	// RuoYi reports errors such as an expired login with HTTP 200
+	for _, target := range []string{"/items?cc=no-store", "/items?cookie", "/items?code=401"} {
+		for i := 0; i < 2; i++ {
+			if rec := getItems(proxy, target, "192.0.2.1:1"); rec.Code != http.StatusOK || rec.Header().Get("X-Cache") != "MISS" {
+				t.Errorf("%s request %d: got %d X-Cache %q, want MISS", target, i, rec.Code, rec.Header().Get("X-Cache"))
+			}
+		}
+	}
+	if n := upstream.lists.Load(); n != 6 {
+		t.Errorf("upstream got %d listings, want 6", n)
+	}
+	getItems(proxy, "/items?code=200", "192.0.2.1:1")
+	if rec := getItems(proxy, "/items?code=200", "192.0.2.1:1"); rec.Header().Get("X-Cache") != "HIT" || rec.Body.String() != `{"code":200,"msg":"m"}` {
+		t.Errorf("code 200: got X-Cache %q %q, want HIT", rec.Header().Get("X-Cache"), rec.Body)
+	}
+}
+
+func TestResponseCacheInvalidation(t *testing.T) {
+	fr := startFakeRedis(t)
+	upstream := &itemsUpstream{}
+	proxy := testProxy(t, itemsConfig(), upstream.ServeHTTP)
+
+	getItems(proxy, "/items", "192.0.2.1:1")
+	getItems(proxy, "/items", "192.0.2.2:1")
+	add := newRequest(http.MethodPost, "/items/add", "")
+	add.RemoteAddr = "192.0.2.1:1"
+	if rec := record(proxy, add); rec.Code != http.StatusOK {
+		t.Fatalf("add: got %d", rec.Code)
+	}
+	if keys := fr.keys(responseCachePrefix); len(keys) != 1 || !strings.HasSuffix(keys[0], ":ip:192.0.2.2") {
+		t.Fatalf("got cached keys %q, want only the other client's", keys)
+	}
+	if rec := getItems(proxy, "/items", "192.0.2.1:1"); rec.Header().Get("X-Cache") != "MISS" || rec.Body.String() != "items=1 page=" {
+		t.Errorf("invalidated client: got %s %q", rec.Header().Get("X-Cache"), rec.Body)
+	}
+	if rec := getItems(proxy, "/items", "192.0.2.2:1"); rec.Header().Get("X-Cache") != "HIT" || rec.Body.String() != "items=0 page=" {
+		t.Errorf("other client: got %s %q", rec.Header().Get("X-Cache"), rec.Body)
+	}
+}
@@ -0,0 +1,199 @@
+package forward
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// DefaultTimeout applies to routes without a Timeout
+const DefaultTimeout = 30 * time.Second
+
+var (
+	errUpstreamTimeout = errors.New("upstream timed out")
+	errBreakerOpen     = errors.New("circuit breaker open")
+)
+
+func isIdempotent(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+// upstreamCall is an upstream response together with what must be released
+// once the body has been consumed
+type upstreamCall struct {
+	resp   *http.Response
+	target *upstream
+	ctx    context.Context
+	timer  *time.Timer
+	cancel context.CancelCauseFunc
+}
+
+// timedOut reports whether the route timeout cut the exchange short
+func (c *upstreamCall) timedOut() bool {
+	return errors.Is(context.Cause(c.ctx), errUpstreamTimeout)
+}
+
+// headersReceived stops the timeout, so that streamed bodies may take as long
+// as they need
+func (c *upstreamCall) headersReceived() {
+	c.timer.Stop()
+}
+
+func (c *upstreamCall) close() {
+	c.timer.Stop()
+	c.resp.Body.Close()
+	c.cancel(nil)
+	c.target.active.Add(-1)
+}
+
+// send performs the upstream request for a route. Idempotent requests are
+// retried on other upstreams after transport errors and gateway statuses,
+// replaying the buffered body. Each attempt is bounded by the route timeout
+// until close or headersReceived is called.
+func (s *ProxyServer) send(r *http.Request, pool *upstreamPool, breaker *circuitBreaker, targetPath string, routeConfig *RouteConfig) (*upstreamCall, error) {
+	attempts := 1
+	var body []byte
+	if routeConfig.Retries > 0 && isIdempotent(r.Method) {
+		attempts += routeConfig.Retries
+		if r.Body != nil && r.Body != http.NoBody {
+			var err error
+			if body, err = io.ReadAll(r.Body); err != nil {
+				return nil, NewStatusError(http.StatusBadRequest, "Error reading request body: %v", err)
+			}
+			r.Body = io.NopCloser(bytes.NewReader(body))
+		}
+	}
+	timeout := routeConfig.Timeout
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+
+	tried := map[*upstream]bool{}
+	var lastErr error
+	var last *upstreamCall // a gateway status kept until it is retried
+	for attempt := 1; attempt <= attempts; attempt++ {
+		// Every attempt asks, so a probe that reopens the breaker ends the retries
+		if ok, wait := breaker.allow(); !ok {
+			if last != nil {
+				return last, nil
+			}
+			if lastErr != nil {
+				return nil, lastErr
+			}
+			return nil, &StatusError{
+				Code:   http.StatusServiceUnavailable,
+				Msg:    errBreakerOpen.Error(),
+				Header: http.Header{"Retry-After": {strconv.Itoa(int(wait/time.Second) + 1)}},
+			}
+		}
+		if last != nil {
+			last.close()
+			last = nil
+		}
+
+		target := pool.pick(tried)
+		if target == nil {
+			// Every upstream has had a go, start over
+			tried = map[*upstream]bool{}
+			target = pool.pick(tried)
+		}
+		tried[target] = true
+
+		if attempt > 1 {
+			log.Printf("[INFO] Retrying %s %s on %s (attempt %d/%d)", r.Method, targetPath, target.url, attempt, attempts)
+			if body != nil {
+				r.Body = io.NopCloser(bytes.NewReader(body))
+			}
+		}
+
+		call, err := s.attempt(r, target, targetPath, routeConfig, timeout)
+		if err != nil {
+			if r.Context().Err() != nil {
+				// The client went away, this says nothing about the upstream
+				return nil, err
+			}
+			pool.report(target, 0, err)
+			breaker.record(true)
+			lastErr = err
+			continue
+		}
+
+		status := call.resp.StatusCode
+		pool.report(target, status, nil)
+		breaker.record(status >= http.StatusInternalServerError)
+		retryable := status == http.StatusBadGateway || status == http.StatusServiceUnavailable ||
+			status == http.StatusGatewayTimeout
+		if !retryable || attempt == attempts {
+			return call, nil
+		}
+		last = call
+		lastErr = fmt.Errorf("upstream %s answered %s", target.url, call.resp.Status)
+	}
+	return nil, lastErr
+}
+
+// attempt sends one request to target
+func (s *ProxyServer) attempt(r *http.Request, target *upstream, targetPath string, routeConfig *RouteConfig, timeout time.Duration) (*upstreamCall, error) {
+	targetURL := target.url + targetPath
+	if r.URL.RawQuery != "" {
+		targetURL += "?" + r.URL.RawQuery
+	}
+
+	// Cancelled when the client goes away or the timeout fires
+	ctx, cancel := context.WithCancelCause(r.Context())
+	timer := time.AfterFunc(timeout, func() { cancel(errUpstreamTimeout) })
+	req, err := http.NewRequestWithContext(ctx, r.Method, targetURL, r.Body)
+	if err != nil {
+		timer.Stop()
+		cancel(nil)
+		return nil, err
+	}
+	req.ContentLength = r.ContentLength
+
+	req.Header = outboundHeader(r, &routeConfig.Headers, s.routes().config.TrustedProxies)
+	req.Host = routeConfig.Headers.upstreamHost(r.Host)
+	if len(routeConfig.ResponseMiddleware) > 0 || routeConfig.Idempotency.Window > 0 || routeConfig.Cache.TTL > 0 {
+		// Let the transport negotiate compression so middleware sees plain
+		// bodies, and stored responses suit any client
+		req.Header.Del("Accept-Encoding")
+	}
+
+	target.active.Add(1)
+	resp, err := s.Client.Do(req)
+	if err != nil {
+		target.active.Add(-1)
+		timer.Stop()
+		if errors.Is(context.Cause(ctx), errUpstreamTimeout) {
+			err = errUpstreamTimeout
+		}
+		cancel(nil)
+		log.Printf("Error making request to %s: %v", targetURL, err)
+		return nil, err
+	}
+	return &upstreamCall{resp: resp, target: target, ctx: ctx, timer: timer, cancel: cancel}, nil
+}
+
+// writeUpstreamError replies to the client after send or reading the body failed
+func writeUpstreamError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, errUpstreamTimeout):
+		http.Error(w, "Error making request: "+err.Error(), http.StatusGatewayTimeout)
+	default:
+		var statusErr *StatusError
+		if errors.As(err, &statusErr) {
+			writeError(w, err, statusErr.Code)
+			return
+		}
+		http.Error(w, "Error making request: "+err.Error(), http.StatusBadGateway)
+	}
+}
@@ -0,0 +1,137 @@
+package forward
+
+import (
+	"io"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+// flakyUpstream fails the first failures requests with 502 and echoes the
+// body of the rest. It records every body it receives.
+type flakyUpstream struct {
+	mu       sync.Mutex
+	failures int
+	bodies   []string
+}
+
+func (u *flakyUpstream) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	u.mu.Lock()
+	u.bodies = append(u.bodies, string(body))
+	fail := len(u.bodies) <= u.failures
+	u.mu.Unlock()
+	if fail {
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	w.Write(body)
+}
+
+func (u *flakyUpstream) received() []string {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return append([]string(nil), u.bodies...)
+}
+
+func TestRetriesReplayBody(t *testing.T) {
+	tests := []struct {
+		name      string
+		upstreams []*flakyUpstream
+		want      []int // requests each upstream receives
+	}{
+		{"same upstream", []*flakyUpstream{{failures: 2}}, []int{3}},
+		{"next upstream", []*flakyUpstream{{failures: 5}, {}}, []int{1, 1}},
+	}
+	for _, tt := range tests {
+		var urls []string
+		for _, u := range tt.upstreams {
+			urls = append(urls, startServer(t, u.ServeHTTP).URL)
+		}
+		proxy := testProxy(t, &Config{Routes: map[string]*RouteConfig{"/r": {Upstreams: urls, Retries: 2}}}, nil)
+
+		rec := record(proxy, newRequest(http.MethodPut, "/r", "payload"))
+		if rec.Code != http.StatusOK || rec.Body.String() != "payload" {
+			t.Errorf("%s: got %d %q", tt.name, rec.Code, rec.Body)
+		}
+		for i, u := range tt.upstreams {
+			bodies := u.received()
+			if len(bodies) != tt.want[i] {
+				t.Errorf("%s: upstream %d got %d requests, want %d", tt.name, i, len(bodies), tt.want[i])
+			}
+			for _, body := range bodies {
+				if body != "payload" {
+					t.Errorf("%s: upstream %d got body %q", tt.name, i, body)
+				}
+			}
+		}
+	}
+}
+
+func TestRetriesGiveUp(t *testing.T) {
+	upstream := &flakyUpstream{failures: 10}
+	proxy := testProxy(t, &Config{Routes: map[string]*RouteConfig{"/r": {Retries: 2}}}, upstream.ServeHTTP)
+
+	rec := record(proxy, newRequest(http.MethodGet, "/r", ""))
+	if rec.Code != http.StatusBadGateway {
+		t.Errorf("got %d, want the last upstream status", rec.Code)
+	}
+	if n := len(upstream.received()); n != 3 {
+		t.Errorf("upstream got %d requests, want 3", n)
+	}
+}
+
+func TestPostIsNotRetried(t *testing.T) {
+	upstream := &flakyUpstream{failures: 1}
+	proxy := testProxy(t, &Config{Routes: map[string]*RouteConfig{"/r": {Retries: 3}}}, upstream.ServeHTTP)
+
+	rec := record(proxy, newRequest(http.MethodPost, "/r", "payload"))
+	if rec.Code != http.StatusBadGateway {
+		t.Errorf("got %d, want 502", rec.Code)
+	}
+	if bodies := upstream.received(); len(bodies) != 1 || bodies[0] != "payload" {
+		t.Errorf("upstream got %q, want a single request", bodies)
+	}
+}
+
+func TestRouteTimeout(t *testing.T) {
+	upstream := func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	}
+	proxy := testProxy(t, &Config{Routes: map[string]*RouteConfig{"/r": {Timeout: 50 * time.Millisecond}}}, upstream)
+
+	start := time.Now()
+	rec := record(proxy, newRequest(http.MethodGet, "/r", ""))
+	if rec.Code != http.StatusGatewayTimeout {
+		t.Errorf("got %d %q, want 504", rec.Code, rec.Body)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("took %v despite the 50ms timeout", elapsed)
+	}
+}
+
+func TestOpenBreakerStopsRetries(t *testing.T) {
+	upstream := &flakyUpstream{failures: 100}
+	proxy := testProxy(t, &Config{Routes: map[string]*RouteConfig{"/r": {
+		Retries: 3,
+		Breaker: BreakerConfig{MinRequests: 1, Window: time.Minute, OpenFor: 50 * time.Millisecond},
+	}}}, upstream.ServeHTTP)
+
+	// The first failure opens the breaker, the second comes from the probe
+	for i, want := range []int{1, 2} {
+		if i > 0 {
+			time.Sleep(60 * time.Millisecond)
+		}
+		rec := record(proxy, newRequest(http.MethodGet, "/r", ""))
+		if rec.Code != http.StatusBadGateway {
+			t.Errorf("request %d: got %d, want the upstream 502", i, rec.Code)
+		}
+		if n := len(upstream.received()); n != want {
+			t.Errorf("request %d: upstream got %d requests in all, want %d", i, n, want)
+		}
+	}
+}
@@ -0,0 +1,463 @@
+package forward
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Route paths come in three forms:
+//
+//	/system/message/list                    exact match
+//	/system/session/digital/{userId}/{id}   template, {name} matches one segment
+//	/files/{path...}  or  /files/           prefix, matches everything below
+//
+// Exact routes win over templates, templates over prefixes. Between two
+// templates or two prefixes the one with a literal segment at the first
+// position where they differ wins, then the longer one, then the one that
+// sorts first. Captured parameters are available to validators and middleware
+// through r.PathValue, and may be referenced as {name} in TargetPath.
+
+// routeTable is the compiled form of a Config: the routes used for matching
+// and the upstreams they are forwarded to
+type routeTable struct {
+	config   *Config
+	exact    map[string]*RouteConfig
+	patterns []*routePattern
+
+	upstreams map[string]*upstream
+	pools     map[*RouteConfig]*upstreamPool
+	lookups   *upstreamPool              // Config.Upstreams, for the proxy's own requests
+	breakers  map[string]*circuitBreaker // by route path
+
+	// invalidates maps a route path to the cached routes its requests clear
+	invalidates map[string][]string
+	// jwt holds the JWT validators of the routes, to check tokens on logout
+	jwt []*JWTValidator
+
+	stopOnce sync.Once
+	stop     chan struct{}
+}
+
+type routePattern struct {
+	path     string
+	segments []patternSegment
+	prefix   bool   // matches any remainder after the segments
+	rest     string // parameter capturing the remainder, empty for trailing-slash prefixes
+	route    *RouteConfig
+}
+
+type patternSegment struct {
+	literal string
+	param   string // non-empty when the segment is a parameter
+}
+
+// routeMatch is the result of matching a request path against a routeTable
+type routeMatch struct {
+	pattern   *routePattern // nil for exact matches
+	path      string
+	route     *RouteConfig
+	params    map[string]string
+	remainder string
+}
+
+func isPatternPath(path string) bool {
+	return strings.Contains(path, "{") || (len(path) > 1 && strings.HasSuffix(path, "/"))
+}
+
+// parsePattern parses a route path, which must start with a slash
+func parsePattern(path string) (*routePattern, error) {
+	if !strings.HasPrefix(path, "/") {
+		return nil, fmt.Errorf("path must start with /")
+	}
+	p := &routePattern{path: path}
+	parts := strings.Split(path[1:], "/")
+	if len(parts) > 1 && parts[len(parts)-1] == "" {
+		p.prefix = true
+		parts = parts[:len(parts)-1]
+	}
+	seen := map[string]bool{}
+	for i, part := range parts {
+		if !strings.ContainsAny(part, "{}") {
+			p.segments = append(p.segments, patternSegment{literal: part})
+			continue
+		}
+		if !strings.HasPrefix(part, "{") || !strings.HasSuffix(part, "}") {
+			return nil, fmt.Errorf("parameter must be a whole path segment: %q", part)
+		}
+		name := part[1 : len(part)-1]
+		isRest := strings.HasSuffix(name, "...")
+		name = strings.TrimSuffix(name, "...")
+		if !validParamName(name) {
+			return nil, fmt.Errorf("invalid parameter name %q", name)
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("duplicate parameter %q", name)
+		}
+		seen[name] = true
+		if isRest {
+			if i != len(parts)-1 || p.prefix {
+				return nil, fmt.Errorf("{%s...} must be the last segment", name)
+			}
+			p.prefix = true
+			p.rest = name
+			continue
+		}
+		p.segments = append(p.segments, patternSegment{param: name})
+	}
+	return p, nil
+}
+
+func validParamName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, c := range name {
+		if !(c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9') {
+			return false
+		}
+	}
+	return true
+}
+
+// params returns the names of all parameters the pattern captures
+func (p *routePattern) params() map[string]bool {
+	names := map[string]bool{}
+	for _, seg := range p.segments {
+		if seg.param != "" {
+			names[seg.param] = true
+		}
+	}
+	if p.rest != "" {
+		names[p.rest] = true
+	}
+	return names
+}
+
+// checkTarget verifies that every placeholder in targetPath is captured by p
+func (p *routePattern) checkTarget(targetPath string) error {
+	names := p.params()
+	for _, name := range placeholders(targetPath) {
+		if !names[name] {
+			return fmt.Errorf("targetPath references unknown parameter %q", name)
+		}
+	}
+	return nil
+}
+
+func placeholders(s string) []string {
+	var names []string
+	for {
+		start := strings.Index(s, "{")
+		if start < 0 {
+			return names
+		}
+		end := strings.Index(s[start:], "}")
+		if end < 0 {
+			return append(names, s[start+1:])
+		}
+		names = append(names, strings.TrimSuffix(s[start+1:start+end], "..."))
+		s = s[start+end+1:]
+	}
+}
+
+// morePrecise reports whether p takes precedence over q
+func (p *routePattern) morePrecise(q *routePattern) bool {
+	if p.prefix != q.prefix {
+		return !p.prefix
+	}
+	for i := 0; i < len(p.segments) && i < len(q.segments); i++ {
+		pLit, qLit := p.segments[i].param == "", q.segments[i].param == ""
+		if pLit != qLit {
+			return pLit
+		}
+	}
+	if len(p.segments) != len(q.segments) {
+		return len(p.segments) > len(q.segments)
+	}
+	return p.path < q.path
+}
+
+func (p *routePattern) match(parts []string) (map[string]string, string, bool) {
+	if len(parts) < len(p.segments) || (!p.prefix && len(parts) != len(p.segments)) {
+		return nil, "", false
+	}
+	// A prefix needs the slash after its last segment
+	if p.prefix && len(parts) == len(p.segments) {
+		return nil, "", false
+	}
+	var params map[string]string
+	for i, seg := range p.segments {
+		if seg.param == "" {
+			if parts[i] != seg.literal {
+				return nil, "", false
+			}
+			continue
+		}
+		if parts[i] == "" || isDotSegment(parts[i]) {
+			return nil, "", false
+		}
+		if params == nil {
+			params = map[string]string{}
+		}
+		params[seg.param] = parts[i]
+	}
+	var remainder string
+	if p.prefix {
+		rest := parts[len(p.segments):]
+		for i, part := range rest {
+			// Only a trailing slash may leave a segment empty
+			if part == "" && i < len(rest)-1 || isDotSegment(part) {
+				return nil, "", false
+			}
+		}
+		remainder = strings.Join(rest, "/")
+		if p.rest != "" {
+			if params == nil {
+				params = map[string]string{}
+			}
+			params[p.rest] = remainder
+		}
+	}
+	return params, remainder, true
+}
+
+// isDotSegment reports whether a path segment would make the upstream climb
+// out of the target path once it normalises the path, as with a decoded
+// %2e%2e
+func isDotSegment(part string) bool {
+	return part == "." || part == ".."
+}
+
+// compileRoutes builds the routeTable for config. Routes with invalid paths
+// are logged and left out. Upstreams already known to prev keep their health
+// state, and unchanged routes their circuit breaker.
+func compileRoutes(config *Config, prev *routeTable) *routeTable {
+	t := &routeTable{
+		config:    config,
+		exact:     map[string]*RouteConfig{},
+		upstreams: map[string]*upstream{},
+		pools:     map[*RouteConfig]*upstreamPool{},
+		breakers:  map[string]*circuitBreaker{},
+		stop:      make(chan struct{}),
+
+		invalidates: map[string][]string{},
+	}
+	check := config.HealthCheck.withDefaults()
+	defaults := config.Upstreams
+	if len(defaults) == 0 {
+		defaults = []string{config.BaseURL}
+	}
+	t.lookups = t.pool(defaults, config.Balance, check, prev)
+	for path, route := range config.Routes {
+		if len(route.Upstreams) > 0 {
+			t.pools[route] = t.pool(route.Upstreams, route.Balance, check, prev)
+		} else {
+			balance := route.Balance
+			if balance == "" {
+				balance = config.Balance
+			}
+			t.pools[route] = t.pool(defaults, balance, check, prev)
+		}
+
+		// Route files compile schemas when loaded, configs built in code here
+		if route.Schema != nil && route.Schema.factory == nil {
+			if err := route.Schema.compile(); err != nil {
+				log.Printf("[ERROR] Invalid schema for path: %s, error: %v", path, err)
+			}
+		}
+	}
+	if check.Interval > 0 && len(t.upstreams) > 0 {
+		upstreams := make([]*upstream, 0, len(t.upstreams))
+		for _, u := range t.upstreams {
+			upstreams = append(upstreams, u)
+		}
+		go probeLoop(upstreams, check, t.stop)
+	}
+
+	for path, route := range config.Routes {
+		breaker := newCircuitBreaker(path, route.Breaker)
+		if old := prev.breaker(path); old != nil && old.config == breaker.config {
+			breaker = old
+		}
+		t.breakers[path] = breaker
+		t.addJWTValidator(route.AuthValidator)
+		for _, chain := range route.MethodChains {
+			t.addJWTValidator(chain.AuthValidator)
+		}
+		if route.Cache.TTL > 0 {
+			for _, by := range route.Cache.InvalidatedBy {
+				t.invalidates[by] = append(t.invalidates[by], path)
+			}
+		}
+
+		if !isPatternPath(path) {
+			t.exact[path] = route
+			continue
+		}
+		p, err := parsePattern(path)
+		if err == nil {
+			err = p.checkTarget(route.TargetPath)
+		}
+		if err != nil {
+			log.Printf("[ERROR] Skipping route %s: %v", path, err)
+			continue
+		}
+		p.route = route
+		t.patterns = append(t.patterns, p)
+	}
+	sort.Slice(t.patterns, func(i, j int) bool {
+		return t.patterns[i].morePrecise(t.patterns[j])
+	})
+	return t
+}
+
+// pool returns a pool over urls. Upstreams are shared by every pool of the
+// table using them, and carried over from prev.
+func (t *routeTable) pool(urls []string, balance string, check HealthCheck, prev *routeTable) *upstreamPool {
+	pool := &upstreamPool{balance: balance, check: check}
+	for _, url := range urls {
+		url = strings.TrimSuffix(url, "/")
+		u := t.upstreams[url]
+		if u == nil && prev != nil {
+			u = prev.upstreams[url]
+		}
+		if u == nil {
+			u = newUpstream(url)
+		}
+		t.upstreams[url] = u
+		pool.upstreams = append(pool.upstreams, u)
+	}
+	return pool
+}
+
+// loginInfoURL is where tokens of the table's callers are checked
+func (t *routeTable) loginInfoURL() string {
+	if t.config.LoginInfoURL != "" {
+		return t.config.LoginInfoURL
+	}
+	return t.config.BaseURL + "/system/loginInfo"
+}
+
+// lookup sends a GET for rawURL on behalf of auth. URLs below BaseURL go
+// to the RuoYi nodes of the table, others straight to their host.
+func (t *routeTable) lookup(rawURL, auth string) ([]byte, error) {
+	if path, ok := strings.CutPrefix(rawURL, t.config.BaseURL); ok && strings.HasPrefix(path, "/") {
+		return t.lookups.get(path, auth)
+	}
+	body, _, err := getWithAuth(rawURL, auth)
+	return body, err
+}
+
+// breaker returns the circuit breaker of the route at path, if any
+func (t *routeTable) breaker(path string) *circuitBreaker {
+	if t == nil {
+		return nil
+	}
+	return t.breakers[path]
+}
+
+// close stops the active health checks of the table
+func (t *routeTable) close() {
+	t.stopOnce.Do(func() { close(t.stop) })
+}
+
+// match finds the route for a request path
+func (t *routeTable) match(path string) *routeMatch {
+	if route, ok := t.exact[path]; ok {
+		return &routeMatch{path: path, route: route}
+	}
+	if !strings.HasPrefix(path, "/") {
+		return nil
+	}
+	parts := strings.Split(path[1:], "/")
+	for _, p := range t.patterns {
+		if params, remainder, ok := p.match(parts); ok {
+			return &routeMatch{pattern: p, path: p.path, route: p.route, params: params, remainder: remainder}
+		}
+	}
+	return nil
+}
+
+// targetPath expands the parameters of the match into the route's TargetPath
+func (m *routeMatch) targetPath() string {
+	target := m.route.TargetPath
+	if m.pattern == nil {
+		return target
+	}
+	for name, value := range m.params {
+		if m.pattern.rest == name {
+			target = strings.ReplaceAll(target, "{"+name+"...}", escapeSegments(value))
+		}
+		target = strings.ReplaceAll(target, "{"+name+"}", url.PathEscape(value))
+	}
+	if m.pattern.prefix && m.pattern.rest == "" {
+		target = strings.TrimSuffix(target, "/") + "/" + escapeSegments(m.remainder)
+	}
+	return target
+}
+
+func escapeSegments(path string) string {
+	parts := strings.Split(path, "/")
+	for i, part := range parts {
+		parts[i] = url.PathEscape(part)
+	}
+	return strings.Join(parts, "/")
+}
+
+type routePatternKey struct{}
+
+// withRoutePattern records the matched route path in the request context
+func withRoutePattern(r *http.Request, path string) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), routePatternKey{}, path))
+}
+
+// RoutePattern returns the configured path of the route a request matched,
+// such as /system/message/{id}, or the request path outside the proxy
+func RoutePattern(r *http.Request) string {
+	if path, ok := r.Context().Value(routePatternKey{}).(string); ok {
+		return path
+	}
+	return r.URL.Path
+}
+
+func (t *routeTable) addJWTValidator(v AuthValidator) {
+	if jv, ok := v.(*JWTValidator); ok && !slices.Contains(t.jwt, jv) {
+		t.jwt = append(t.jwt, jv)
+	}
+}
+
+type routeTableKey struct{}
+
+// withRoutes records the routes serving r in its context, so lookups made
+// on behalf of r use the configuration of the proxy that received it
+func withRoutes(r *http.Request, table *routeTable) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), routeTableKey{}, table))
+}
+
+// defaultRoutes serves requests handled outside a proxy server
+var defaultRoutes = sync.OnceValue(func() *routeTable {
+	return compileRoutes(DefaultConfig(), nil)
+})
+
+// requestRoutes returns the routes serving r, those of DefaultConfig when r
+// did not come through a proxy server
+func requestRoutes(r *http.Request) *routeTable {
+	if r != nil {
+		if table, ok := r.Context().Value(routeTableKey{}).(*routeTable); ok {
+			return table
+		}
+	}
+	return defaultRoutes()
+}
+
+// requestConfig returns the configuration serving r
+func requestConfig(r *http.Request) *Config {
+	return requestRoutes(r).config
+}
@@ -0,0 +1,150 @@
+package forward
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRouteMatching(t *testing.T) {
+	route := func(target string) *RouteConfig { return &RouteConfig{TargetPath: target} }
+	table := compileRoutes(&Config{Routes: map[string]*RouteConfig{
+		"/system/message/list":                      route("/system/message/list"),
+		"/system/message/{id}":                      route("/system/message/{id}"),
+		"/system/session/digital/{userId}/{lawyer}": route("/system/session/digital/{userId}/{lawyer}"),
+		"/system/session/{kind}/{userId}/{lawyer}":  route("/system/session/{kind}/{userId}/{lawyer}"),
+		"/system/{rest...}":                         route("/api/{rest...}"),
+		"/system/session/":                          route("/session/"),
+	}}, nil)
+
+	tests := []struct {
+		path    string
+		pattern string
+		target  string
+		params  map[string]string
+	}{
+		{"/system/message/list", "/system/message/list", "/system/message/list", nil},
+		{"/system/message/42", "/system/message/{id}", "/system/message/42", map[string]string{"id": "42"}},
+		{"/system/session/digital/7/132", "/system/session/digital/{userId}/{lawyer}", "/system/session/digital/7/132", map[string]string{"userId": "7", "lawyer": "132"}},
+		{"/system/session/mediate/7/9", "/system/session/{kind}/{userId}/{lawyer}", "/system/session/mediate/7/9", map[string]string{"kind": "mediate", "userId": "7", "lawyer": "9"}},
+		{"/system/session/a/b", "/system/session/", "/session/a/b", nil},
+		{"/system/message/42/read", "/system/{rest...}", "/api/message/42/read", map[string]string{"rest": "message/42/read"}},
+		{"/system/", "/system/{rest...}", "/api/", map[string]string{"rest": ""}},
+		{"/system", "", "", nil},
+		{"/system/message/", "/system/{rest...}", "/api/message/", map[string]string{"rest": "message/"}},
+		{"/other", "", "", nil},
+	}
+	for _, tt := range tests {
+		m := table.match(tt.path)
+		if tt.pattern == "" {
+			if m != nil {
+				t.Errorf("%s: expected no match, got %s", tt.path, m.path)
+			}
+			continue
+		}
+		if m == nil {
+			t.Errorf("%s: expected %s, got no match", tt.path, tt.pattern)
+			continue
+		}
+		if m.path != tt.pattern {
+			t.Errorf("%s: matched %s, want %s", tt.path, m.path, tt.pattern)
+		}
+		if got := m.targetPath(); got != tt.target {
+			t.Errorf("%s: target %s, want %s", tt.path, got, tt.target)
+		}
+		for name, want := range tt.params {
+			if m.params[name] != want {
+				t.Errorf("%s: param %s = %q, want %q", tt.path, name, m.params[name], want)
+			}
+		}
+	}
+}
+
+func TestParsePatternErrors(t *testing.T) {
+	for _, path := range []string{
+		"system/x",
+		"/a/b{id}",
+		"/a/{id}/{id}",
+		"/a/{rest...}/b",
+		"/a/{bad-name}",
+	} {
+		if _, err := parsePattern(path); err == nil {
+			t.Errorf("%s: expected an error", path)
+		}
+	}
+	p, _ := parsePattern("/a/{id}")
+	if err := p.checkTarget("/b/{other}"); err == nil {
+		t.Error("expected unknown target parameter to be rejected")
+	}
+}
+
+func TestRoutesRejectTraversal(t *testing.T) {
+	var hits []string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits = append(hits, r.URL.Path)
+	}))
+	defer upstream.Close()
+
+	config := &Config{BaseURL: upstream.URL}
+	validator := &pathValueValidator{}
+	AddRoute(config, "/files/{path...}", "/static/{path...}", validator)
+	AddRoute(config, "/docs/", "/static/docs/", validator)
+	AddRoute(config, "/session/{userId}/{lawyerId}", "/system/session/digital/{userId}/{lawyerId}", validator)
+	proxy := NewProxyServer(config)
+
+	for _, target := range []string{
+		"/files/%2e%2e/%2e%2e/system/user",
+		"/files/a/../../system/user",
+		"/files/./system/user",
+		"/files/a//b",
+		"/docs/%2E%2E/system/user",
+		"/docs/a/..",
+		"/session/%2e%2e/%2e%2e",
+		"/session/7/.",
+	} {
+		rec := httptest.NewRecorder()
+		proxy.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, target, nil))
+		if rec.Code != http.StatusNotFound {
+			t.Errorf("%s: got %d, want 404", target, rec.Code)
+		}
+	}
+	if len(hits) > 0 {
+		t.Errorf("upstream received %v", hits)
+	}
+
+	// Dots within a segment are fine
+	rec := httptest.NewRecorder()
+	proxy.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/files/a/..b/report.v2.pdf", nil))
+	if rec.Code != http.StatusOK || len(hits) != 1 || hits[0] != "/static/a/..b/report.v2.pdf" {
+		t.Errorf("got %d, upstream saw %v", rec.Code, hits)
+	}
+}
+
+type pathValueValidator struct{ seen string }
+
+func (v *pathValueValidator) Validate(r *http.Request) (string, error) {
+	v.seen = r.PathValue("userId")
+	return "", nil
+}
+
+func TestPathValuesReachValidators(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.URL.Path)
+	}))
+	defer upstream.Close()
+
+	validator := &pathValueValidator{}
+	config := &Config{BaseURL: upstream.URL}
+	AddRoute(config, "/session/{userId}/{lawyerId}", "/system/session/digital/{userId}/{lawyerId}", validator)
+	proxy := NewProxyServer(config)
+
+	rec := httptest.NewRecorder()
+	proxy.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/session/7/132", nil))
+	if rec.Code != http.StatusOK || rec.Body.String() != "/system/session/digital/7/132" {
+		t.Fatalf("unexpected response %d %q", rec.Code, rec.Body.String())
+	}
+	if validator.seen != "7" {
+		t.Errorf("validator saw userId %q", validator.seen)
+	}
+}
@@ -0,0 +1,271 @@
+package forward
+
+import (
+	"io"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"e.coding.net/Love54dj/weizhong/etc/ryconn"
+	"e.coding.net/Love54dj/weizhong/etc/ryfake"
+)
+
+// fakeRuoYiProxy starts a RuoYi stand-in and a proxy in front of it with
+// every built-in validator and middleware on some route
+func fakeRuoYiProxy(t *testing.T) (*ryfake.Server, *ProxyServer) {
+	t.Helper()
+	ry := ryfake.NewServer()
+	t.Cleanup(ry.Close)
+
+	dictionary := filepath.Join(t.TempDir(), "words.txt")
+	if err := os.WriteFile(dictionary, []byte("[abuse]\n傻瓜\n[ad]\n加微信\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	config, err := ParseConfig([]byte(`
+baseUrl: ` + ry.URL + `
+routes:
+  - {path: /system/message/list, auth: messageList, middleware: [messageList]}
+  - {path: /system/message, auth: message, middleware: [message]}
+  - path: /inject/message
+    targetPath: /system/message
+    auth: message
+    middleware: [{name: message, options: {injectIdentity: true}}]
+  - path: /moderated/message
+    targetPath: /system/message
+    auth: message
+    middleware:
+      - {name: moderate, options: {dictionary: ` + dictionary + `, actions: {ad: mask}}}
+      - message
+  - {path: /checked/message/list, targetPath: /system/message/list, auth: token, middleware: [senderId]}
+  - {path: /me, targetPath: /system/loginInfo, auth: token, responseMiddleware: [redactMobile]}
+  - path: /me/own
+    targetPath: /system/loginInfo
+    auth: token
+    responseMiddleware: [{name: redactMobile, options: {keepOwn: true}}]
+  - {path: /public/loginInfo, targetPath: /system/loginInfo, auth: referer}
+  - {path: /missing, targetPath: /nope, auth: referer, responseMiddleware: [errorEnvelope]}
+  - path: /limited
+    targetPath: /system/loginInfo
+    auth: token
+    middleware: [{name: rateLimit, options: {key: user, limit: 1, window: 1m}}]
+  - {path: /logout, auth: referer, middleware: [invalidateIdentity]}
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := NewProxyServer(config)
+	t.Cleanup(proxy.Close)
+	return ry, proxy
+}
+
+// sendRuoYi sends a request to proxy with the token and a valid referer
+// when given
+func sendRuoYi(proxy *ProxyServer, method, target, token string, referer bool, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	if referer {
+		req.Header.Set("Referer", ValidReferer+"wx/page")
+	}
+	rec := httptest.NewRecorder()
+	proxy.ServeHTTP(rec, req)
+	return rec
+}
+
+// lastMessage returns the message the backend stored last
+func lastMessage(ry *ryfake.Server) ryfake.Message {
+	messages := ry.Backend.Messages("")
+	if len(messages) == 0 {
+		return ryfake.Message{}
+	}
+	return messages[len(messages)-1]
+}
+
+// TestAgainstFakeRuoYi runs every built-in validator and middleware against
+// the RuoYi stand-in. Each case gets a backend and proxy of its own.
+func TestAgainstFakeRuoYi(t *testing.T) {
+	sender1001 := ryfake.SenderID("digital", 1001, FixedLawyerId)
+	sender1002 := ryfake.SenderID("digital", 1002, FixedLawyerId)
+
+	tests := []struct {
+		name    string
+		method  string
+		target  string
+		token   string
+		referer bool
+		body    string
+		code    int
+		want    string // contained in the response body
+		check   func(ry *ryfake.Server) string
+	}{
+		{"list own session", "GET", "/system/message/list?senderId=" + sender1001, "token-1001", false, "", 200, `"code":200`, nil},
+		{"list other session", "GET", "/system/message/list?senderId=" + sender1002, "token-1001", false, "", 400, "invalid senderId", nil},
+		{"list empty senderId", "GET", "/system/message/list?senderId=", "token-1001", false, "", 400, "invalid URL format", nil},
+		{"list without token", "GET", "/system/message/list?senderId=" + sender1001, "", false, "", 401, "missing authorization", nil},
+		{"list unknown token", "GET", "/system/message/list?senderId=" + sender1001, "nobody", false, "", 401, "认证失败", nil},
+		{"list by POST", "POST", "/system/message/list", "token-1001", false, "{}", 400, "unsupported HTTP method", nil},
+
+		{"post own message", "POST", "/system/message", "token-1001", false,
+			`{"msgText": "你好", "senderId": "` + sender1001 + `", "userId": 1001}`, 200, `"code":200`,
+			func(ry *ryfake.Server) string {
+				if m := lastMessage(ry); m.MsgText != "你好" || m.SenderID != sender1001 {
+					return "stored " + m.SenderID + " " + m.MsgText
+				}
+				return ""
+			}},
+		{"post as other sender", "POST", "/system/message", "token-1001", false,
+			`{"msgText": "hi", "senderId": "` + sender1002 + `", "userId": 1001}`, 400, "invalid senderId", nil},
+		{"post as other user", "POST", "/system/message", "token-1001", false,
+			`{"msgText": "hi", "senderId": "` + sender1002 + `", "userId": 1002}`, 400, "invalid senderId", nil},
+		{"post without senderId", "POST", "/system/message", "token-1001", false, `{"msgText": "hi", "userId": 1001}`, 400, "missing senderId", nil},
+		{"post malformed", "POST", "/system/message", "token-1001", false, `{"msgText":`, 400, "invalid JSON", nil},
+		{"get message", "GET", "/system/message", "token-1001", false, "", 400, "unsupported HTTP method", nil},
+
+		{"inject identity", "POST", "/inject/message", "token-1001", false, `{"msgText": "injected", "senderId": "x", "userId": 1002}`, 200, `"code":200`,
+			func(ry *ryfake.Server) string {
+				if m := lastMessage(ry); m.MsgText != "injected" || m.SenderID != sender1001 || m.UserID != 1001 {
+					return "stored " + m.SenderID + " " + m.MsgText
+				}
+				return ""
+			}},
+		{"inject unknown field", "POST", "/inject/message", "token-1001", false, `{"msgText": "hi", "admin": true}`, 400, "unknown field", nil},
+
+		{"moderate reject", "POST", "/moderated/message", "token-1001", false,
+			`{"msgText": "你这个傻瓜", "senderId": "` + sender1001 + `", "userId": 1001}`, 400, "sensitive content", nil},
+		{"moderate mask", "POST", "/moderated/message", "token-1001", false,
+			`{"msgText": "加微信聊", "senderId": "` + sender1001 + `", "userId": 1001}`, 200, `"code":200`,
+			func(ry *ryfake.Server) string {
+				if m := lastMessage(ry); m.MsgText != "***聊" {
+					return "stored " + m.MsgText
+				}
+				return ""
+			}},
+
+		{"senderId own", "GET", "/checked/message/list?senderId=" + sender1002, "token-1002", false, "", 200, `"total":0`, nil},
+		{"senderId other", "GET", "/checked/message/list?senderId=" + sender1001, "token-1002", false, "", 400, "invalid senderId", nil},
+
+		{"redact mobile", "GET", "/me", "token-1001", false, "", 200, `"mobile":"138****1001"`, nil},
+		{"redact keeps own", "GET", "/me/own", "token-1001", false, "", 200, `"mobile":"13800001001"`, nil},
+
+		{"referer", "GET", "/public/loginInfo", "", true, "", 200, `"code":401`, nil},
+		{"referer missing", "GET", "/public/loginInfo", "", false, "", 401, "invalid referer", nil},
+		{"error envelope", "GET", "/missing", "", true, "", 404, `{"code":404,"msg":"404 page not found"}`, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ry, proxy := fakeRuoYiProxy(t)
+			rec := sendRuoYi(proxy, tt.method, tt.target, tt.token, tt.referer, tt.body)
+			body, _ := io.ReadAll(rec.Body)
+			if rec.Code != tt.code || !strings.Contains(string(body), tt.want) {
+				t.Fatalf("got %d %s, want %d containing %s", rec.Code, body, tt.code, tt.want)
+			}
+			if tt.check != nil {
+				if problem := tt.check(ry); problem != "" {
+					t.Error(problem)
+				}
+			}
+
+			// The upstream learns who the caller is, not the proxy's address
+			for _, r := range ry.Backend.Requests() {
+				if r.Path == "/system/message" && r.Header.Get("X-Real-IP") != "192.0.2.1" {
+					t.Errorf("upstream saw X-Real-IP %q", r.Header.Get("X-Real-IP"))
+					break
+				}
+			}
+		})
+	}
+}
+
+func TestFakeRuoYiRateLimit(t *testing.T) {
+	_, proxy := fakeRuoYiProxy(t)
+	if rec := sendRuoYi(proxy, "GET", "/limited", "token-1001", false, ""); rec.Code != 200 || !strings.Contains(rec.Body.String(), `"id":1001`) {
+		t.Fatalf("first request: got %d %s", rec.Code, rec.Body)
+	}
+	if rec := sendRuoYi(proxy, "GET", "/limited", "token-1001", false, ""); rec.Code != 429 || !strings.Contains(rec.Body.String(), "too many requests") {
+		t.Errorf("second request: got %d %s, want 429", rec.Code, rec.Body)
+	}
+	if rec := sendRuoYi(proxy, "GET", "/limited", "token-1002", false, ""); rec.Code != 200 {
+		t.Errorf("other user: got %d %s", rec.Code, rec.Body)
+	}
+}
+
+func TestFakeRuoYiLogout(t *testing.T) {
+	_, proxy := fakeRuoYiProxy(t)
+	if rec := sendRuoYi(proxy, "GET", "/me", "token-1002", false, ""); rec.Code != 200 {
+		t.Fatalf("before logout: got %d %s", rec.Code, rec.Body)
+	}
+	if rec := sendRuoYi(proxy, "POST", "/logout", "token-1002", true, ""); rec.Code != 200 || !strings.Contains(rec.Body.String(), "退出成功") {
+		t.Fatalf("logout: got %d %s", rec.Code, rec.Body)
+	}
+	if rec := sendRuoYi(proxy, "GET", "/me", "token-1002", false, ""); rec.Code != 401 || !strings.Contains(rec.Body.String(), "认证失败") {
+		t.Errorf("after logout: got %d %s, want 401", rec.Code, rec.Body)
+	}
+}
+
+// TestProxiesKeepTheirConfig runs two proxies side by side, sharing Redis:
+// tokens are checked and lookups made with the backend and lawyer of the
+// proxy that received the request. The same token belongs to user 1001 on
+// the first backend and to user 2001 on the second.
+func TestProxiesKeepTheirConfig(t *testing.T) {
+	startFakeRedis(t)
+	newProxy := func(lawyer string) (*ryfake.Server, *ProxyServer) {
+		ry := ryfake.NewServer()
+		t.Cleanup(ry.Close)
+		config, err := ParseConfig([]byte(`
+baseUrl: ` + ry.URL + `
+lawyer: {default: "` + lawyer + `"}
+routes:
+  - {path: /system/message/list, auth: token, middleware: [senderId]}
+`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		proxy := NewProxyServer(config)
+		t.Cleanup(proxy.Close)
+		return ry, proxy
+	}
+	ry1, proxy1 := newProxy("132")
+	ry2, proxy2 := newProxy("200")
+	ry2.Backend.AddUser(ryfake.User{Token: "token-1001", RuoyiUserData: ryconn.RuoyiUserData{ID: 2001, Mobile: "13800002001"}})
+
+	for _, tt := range []struct {
+		proxy  *ProxyServer
+		user   int
+		lawyer string
+		code   int
+	}{
+		{proxy1, 1001, "132", 200},
+		{proxy2, 2001, "200", 200},
+		{proxy1, 1001, "132", 200},
+		{proxy1, 1001, "200", 400},
+		{proxy2, 2001, "132", 400},
+		{proxy2, 1001, "200", 400},
+	} {
+		req := httptest.NewRequest("GET", "/system/message/list?senderId="+ryfake.SenderID("digital", tt.user, tt.lawyer), nil)
+		req.Header.Set("Authorization", "Bearer token-1001")
+		rec := httptest.NewRecorder()
+		tt.proxy.ServeHTTP(rec, req)
+		if rec.Code != tt.code {
+			t.Errorf("user %d, lawyer %s: got %d %s, want %d", tt.user, tt.lawyer, rec.Code, rec.Body, tt.code)
+		}
+	}
+
+	for i, ry := range []*ryfake.Server{ry1, ry2} {
+		logins := 0
+		for _, r := range ry.Backend.Requests() {
+			if r.Path == "/system/loginInfo" {
+				logins++
+			}
+			if strings.HasPrefix(r.Path, "/system/session/") && strings.HasSuffix(r.Path, []string{"/132", "/200"}[1-i]) {
+				t.Errorf("backend %d looked up %s for the other proxy", i+1, r.Path)
+			}
+		}
+		// Once, then from the cache of that backend's identities
+		if logins != 1 {
+			t.Errorf("backend %d checked the token %d times, want 1", i+1, logins)
+		}
+	}
+}
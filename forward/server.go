@@ -0,0 +1,208 @@
+package forward
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"e.coding.net/Love54dj/weizhong/etc/metrics"
+)
+
+// Server runs a ProxyServer on its own listener and mux. The proxy is mounted
+// at "/"; further handlers can be added to Mux before Start.
+//
+// Operator endpoints, such as AdminHandler and UpstreamStatusHandler, belong
+// on InternalMux instead. It is served on InternalAddr, when set, which
+// should only be reachable from the internal network. The Prometheus metrics
+// are mounted there at "GET /metrics" when Config.Metrics is set.
+type Server struct {
+	Addr  string
+	Proxy *ProxyServer
+	Mux   *http.ServeMux
+
+	InternalAddr string
+	InternalMux  *http.ServeMux
+
+	ReadHeaderTimeout time.Duration
+	ReadTimeout       time.Duration
+	WriteTimeout      time.Duration // zero by default, as responses may be streamed
+	IdleTimeout       time.Duration
+	ShutdownTimeout   time.Duration // how long Run lets active requests drain
+
+	// TLSCertFile and TLSKeyFile switch the listener to HTTPS when both are set
+	TLSCertFile string
+	TLSKeyFile  string
+
+	mu       sync.Mutex
+	srv      *http.Server
+	listener net.Listener
+	done     chan error
+
+	internal         *http.Server
+	internalListener net.Listener
+}
+
+// NewServer returns a Server for proxy listening on addr, such as ":9304"
+func NewServer(addr string, proxy *ProxyServer) *Server {
+	mux := http.NewServeMux()
+	// Routes may change at runtime, so the proxy does its own matching
+	mux.Handle("/", proxy)
+	internal := http.NewServeMux()
+	if proxy.routes().config.Metrics {
+		internal.Handle("GET /metrics", metrics.Handler())
+	}
+	return &Server{
+		Addr:              addr,
+		Proxy:             proxy,
+		Mux:               mux,
+		InternalMux:       internal,
+		ReadHeaderTimeout: 10 * time.Second,
+		ReadTimeout:       60 * time.Second,
+		IdleTimeout:       120 * time.Second,
+		ShutdownTimeout:   30 * time.Second,
+	}
+}
+
+// Start listens on Addr, and InternalAddr when set, and serves in the
+// background. Listen errors are returned directly, later serve errors of the
+// public listener by Wait.
+func (s *Server) Start() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.srv != nil {
+		return errors.New("server already started")
+	}
+
+	ln, err := net.Listen("tcp", s.Addr)
+	if err != nil {
+		return err
+	}
+	if s.InternalAddr != "" {
+		internalLn, err := net.Listen("tcp", s.InternalAddr)
+		if err != nil {
+			ln.Close()
+			return err
+		}
+		s.internal, s.internalListener = s.httpServer(s.InternalMux), internalLn
+		log.Printf("Starting internal server on %s", internalLn.Addr())
+		go func() {
+			if err := s.internal.Serve(internalLn); !errors.Is(err, http.ErrServerClosed) {
+				log.Printf("[ERROR] Internal server stopped: %v", err)
+			}
+		}()
+	}
+	srv := s.httpServer(s.Mux)
+	useTLS := s.TLSCertFile != "" && s.TLSKeyFile != ""
+	if useTLS {
+		srv.TLSConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+	}
+	s.srv, s.listener, s.done = srv, ln, make(chan error, 1)
+
+	log.Printf("Starting proxy server on %s (tls: %v)", ln.Addr(), useTLS)
+	go func() {
+		var err error
+		if useTLS {
+			err = srv.ServeTLS(ln, s.TLSCertFile, s.TLSKeyFile)
+		} else {
+			err = srv.Serve(ln)
+		}
+		if errors.Is(err, http.ErrServerClosed) {
+			err = nil
+		}
+		s.done <- err
+	}()
+	return nil
+}
+
+func (s *Server) httpServer(handler http.Handler) *http.Server {
+	return &http.Server{
+		Handler:           handler,
+		ReadHeaderTimeout: s.ReadHeaderTimeout,
+		ReadTimeout:       s.ReadTimeout,
+		WriteTimeout:      s.WriteTimeout,
+		IdleTimeout:       s.IdleTimeout,
+	}
+}
+
+// ListenAddr returns the address the server listens on, nil before Start
+func (s *Server) ListenAddr() net.Addr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.listener == nil {
+		return nil
+	}
+	return s.listener.Addr()
+}
+
+// InternalListenAddr returns the address of the internal listener, nil
+// before Start or without InternalAddr
+func (s *Server) InternalListenAddr() net.Addr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.internalListener == nil {
+		return nil
+	}
+	return s.internalListener.Addr()
+}
+
+// Wait blocks until the server stops serving
+func (s *Server) Wait() error {
+	s.mu.Lock()
+	done := s.done
+	s.mu.Unlock()
+	if done == nil {
+		return errors.New("server not started")
+	}
+	err := <-done
+	done <- err // let later callers see it too
+	return err
+}
+
+// Shutdown stops accepting connections and waits for active requests to
+// finish, or for ctx to expire. Health checks of the proxy are stopped too.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	srv, internal := s.srv, s.internal
+	s.mu.Unlock()
+	if srv == nil {
+		return errors.New("server not started")
+	}
+	err := srv.Shutdown(ctx)
+	if internal != nil {
+		err = errors.Join(err, internal.Shutdown(ctx))
+	}
+	s.Proxy.Close()
+	return err
+}
+
+// Run starts the server and shuts it down gracefully on SIGINT or SIGTERM,
+// giving active requests ShutdownTimeout to complete
+func (s *Server) Run() error {
+	if err := s.Start(); err != nil {
+		return err
+	}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(signals)
+
+	select {
+	case err := <-s.done:
+		return err
+	case sig := <-signals:
+		log.Printf("[INFO] Received %s, draining active requests", sig)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), s.ShutdownTimeout)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		return err
+	}
+	return s.Wait()
+}
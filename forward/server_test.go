@@ -0,0 +1,145 @@
+package forward
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServerDrainsOnShutdown(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(100 * time.Millisecond)
+		io.WriteString(w, "sent")
+	}))
+	defer upstream.Close()
+
+	config := &Config{BaseURL: upstream.URL}
+	AddRoute(config, "/system/message", "/system/message", &pathValueValidator{})
+	server := NewServer("127.0.0.1:0", NewProxyServer(config))
+	if err := server.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	type result struct {
+		body string
+		err  error
+	}
+	results := make(chan result, 1)
+	go func() {
+		resp, err := http.Post("http://"+server.ListenAddr().String()+"/system/message", "application/json", nil)
+		if err != nil {
+			results <- result{err: err}
+			return
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		results <- result{string(body), err}
+	}()
+
+	time.Sleep(30 * time.Millisecond)
+	if err := server.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if res := <-results; res.err != nil || res.body != "sent" {
+		t.Fatalf("in-flight request was not drained: %q %v", res.body, res.err)
+	}
+	if err := server.Wait(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestServerExportsMetrics(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer upstream.Close()
+
+	config := &Config{BaseURL: upstream.URL, Metrics: true}
+	AddRoute(config, "/metrics-test/{id}", "/system/message", &pathValueValidator{})
+	server := NewServer("127.0.0.1:0", NewProxyServer(config))
+	for _, method := range []string{http.MethodPost, "BREW"} {
+		server.Mux.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(method, "/metrics-test/7", nil))
+	}
+
+	rec := httptest.NewRecorder()
+	server.InternalMux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	for _, want := range []string{
+		`forward_requests_total{route="/metrics-test/{id}",method="POST",code="201"} 1`,
+		`forward_requests_total{route="/metrics-test/{id}",method="OTHER",code="201"} 1`,
+		`forward_request_duration_seconds_count{route="/metrics-test/{id}",method="POST"} 1`,
+		`forward_breaker_state{route="/metrics-test/{id}"} 0`,
+		`outbound_requests_total{client="forward",method="POST",code="201"}`,
+	} {
+		if !strings.Contains(rec.Body.String(), want) {
+			t.Errorf("missing %s in\n%s", want, rec.Body)
+		}
+	}
+}
+
+func TestServerMetricsAreOptIn(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "upstream "+r.URL.Path)
+	}))
+	defer upstream.Close()
+
+	for _, enabled := range []bool{false, true} {
+		config := &Config{BaseURL: upstream.URL, Metrics: enabled}
+		AddRoute(config, "/metrics", "/metrics", &pathValueValidator{})
+		server := NewServer("127.0.0.1:0", NewProxyServer(config))
+
+		// The public listener proxies /metrics like any other route
+		rec := httptest.NewRecorder()
+		server.Mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+		if rec.Body.String() != "upstream /metrics" {
+			t.Errorf("metrics %v: public /metrics answered %d %q", enabled, rec.Code, rec.Body)
+		}
+
+		rec = httptest.NewRecorder()
+		server.InternalMux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+		if exported := rec.Code == http.StatusOK; exported != enabled {
+			t.Errorf("metrics %v: internal /metrics answered %d", enabled, rec.Code)
+		}
+		server.Proxy.Close()
+	}
+}
+
+func TestServerKeepsInternalEndpointsOffPublicListener(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "upstream")
+	}))
+	defer upstream.Close()
+
+	config := &Config{BaseURL: upstream.URL}
+	AddRoute(config, "/admin/", "/admin/", &pathValueValidator{})
+	proxy := NewProxyServer(config)
+	server := NewServer("127.0.0.1:0", proxy)
+	server.InternalAddr = "127.0.0.1:0"
+	server.InternalMux.Handle("/admin/", http.StripPrefix("/admin", proxy.AdminHandler(map[string]string{"ops": "secret"})))
+	if err := server.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer server.Shutdown(context.Background())
+
+	get := func(addr string) (int, string) {
+		req, _ := http.NewRequest(http.MethodGet, "http://"+addr+"/admin/routes", nil)
+		req.Header.Set("Authorization", "Bearer secret")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+	// The public listener proxies the path like any other
+	if code, body := get(server.ListenAddr().String()); code != http.StatusOK || body != "upstream" {
+		t.Errorf("public listener answered %d %q", code, body)
+	}
+	if code, body := get(server.InternalListenAddr().String()); code != http.StatusOK || !strings.Contains(body, `"/admin/"`) {
+		t.Errorf("internal listener answered %d %q", code, body)
+	}
+}
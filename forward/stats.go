@@ -0,0 +1,122 @@
+package forward
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// RouteStats counts the requests a route has answered since the process
+// started. Counters survive configuration reloads.
+type RouteStats struct {
+	Requests     uint64    `json:"requests"`
+	ClientErrors uint64    `json:"clientErrors"` // 4xx
+	ServerErrors uint64    `json:"serverErrors"` // 5xx
+	LastError    time.Time `json:"lastError"`
+}
+
+type routeCounters struct {
+	requests, clientErrors, serverErrors atomic.Uint64
+	lastError                            atomic.Int64 // unix nanoseconds
+}
+
+func (c *routeCounters) record(status int) {
+	c.requests.Add(1)
+	switch {
+	case status >= 500:
+		c.serverErrors.Add(1)
+	case status >= 400:
+		c.clientErrors.Add(1)
+	default:
+		return
+	}
+	c.lastError.Store(time.Now().UnixNano())
+}
+
+func (c *routeCounters) snapshot() RouteStats {
+	stats := RouteStats{
+		Requests:     c.requests.Load(),
+		ClientErrors: c.clientErrors.Load(),
+		ServerErrors: c.serverErrors.Load(),
+	}
+	if last := c.lastError.Load(); last != 0 {
+		stats.LastError = time.Unix(0, last)
+	}
+	return stats
+}
+
+// routeStats keeps the counters of every route path seen
+type routeStats struct {
+	m sync.Map // route path -> *routeCounters
+}
+
+func (rs *routeStats) counters(path string) *routeCounters {
+	if c, ok := rs.m.Load(path); ok {
+		return c.(*routeCounters)
+	}
+	c, _ := rs.m.LoadOrStore(path, &routeCounters{})
+	return c.(*routeCounters)
+}
+
+// RouteStats returns the counters of every route that has served requests
+func (s *ProxyServer) RouteStats() map[string]RouteStats {
+	stats := map[string]RouteStats{}
+	s.stats.m.Range(func(path, c any) bool {
+		stats[path.(string)] = c.(*routeCounters).snapshot()
+		return true
+	})
+	return stats
+}
+
+// statusRecorder remembers the status written through it. It passes flushes
+// and hijacks on, so streaming and WebSockets keep working.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (rec *statusRecorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *statusRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	return rec.ResponseWriter.Write(b)
+}
+
+func (rec *statusRecorder) Flush() {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	http.NewResponseController(rec.ResponseWriter).Flush()
+}
+
+func (rec *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := rec.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response does not implement http.Hijacker")
+	}
+	rec.status = http.StatusSwitchingProtocols
+	return hijacker.Hijack()
+}
+
+func (rec *statusRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
+
+// statusCode returns the recorded status, 200 if nothing was written
+func (rec *statusRecorder) statusCode() int {
+	if rec.status == 0 {
+		return http.StatusOK
+	}
+	return rec.status
+}
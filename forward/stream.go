@@ -0,0 +1,54 @@
+package forward
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net/http"
+)
+
+const streamBufferSize = 32 * 1024
+
+// streamResponse copies the upstream response to the client, flushing after
+// every read so that server-sent events and chunked responses reach the
+// client as they are produced. It stops when either side goes away.
+func streamResponse(w http.ResponseWriter, r *http.Request, resp *http.Response) {
+	for key, values := range resp.Header {
+		for _, value := range values {
+			w.Header().Add(key, value)
+		}
+	}
+	w.WriteHeader(resp.StatusCode)
+
+	rc := http.NewResponseController(w)
+	if err := rc.Flush(); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		log.Printf("Error flushing response headers: %v", err)
+		return
+	}
+
+	buf := make([]byte, streamBufferSize)
+	for {
+		n, readErr := resp.Body.Read(buf)
+		if n > 0 {
+			if _, err := w.Write(buf[:n]); err != nil {
+				log.Printf("Error writing response: %v", err)
+				return
+			}
+			if err := rc.Flush(); err != nil && !errors.Is(err, http.ErrNotSupported) {
+				log.Printf("Error flushing response: %v", err)
+				return
+			}
+		}
+		if readErr == io.EOF {
+			return
+		}
+		if readErr != nil {
+			if r.Context().Err() != nil {
+				log.Printf("[INFO] Client went away, stopped streaming %s", r.URL.Path)
+			} else {
+				log.Printf("Error reading response body: %v", readErr)
+			}
+			return
+		}
+	}
+}
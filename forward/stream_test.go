@@ -0,0 +1,107 @@
+package forward
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// streamingProxy proxies /events to upstream through a real listener, so
+// that flushes reach the client over the wire
+func streamingProxy(t *testing.T, upstream http.HandlerFunc) *httptest.Server {
+	t.Helper()
+	proxy := testProxy(t, &Config{Routes: map[string]*RouteConfig{"/events": {}}}, upstream)
+	return startServer(t, proxy.ServeHTTP)
+}
+
+func TestStreamingDeliversEventsAsTheyArrive(t *testing.T) {
+	next := make(chan struct{})
+	front := streamingProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		for i, event := range []string{"data: one\n\n", "data: two\n\n"} {
+			if i > 0 {
+				<-next
+			}
+			io.WriteString(w, event)
+			w.(http.Flusher).Flush()
+		}
+	})
+
+	resp, err := http.Get(front.URL + "/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Errorf("got Content-Type %q", ct)
+	}
+
+	events := make(chan string)
+	go func() {
+		rd := bufio.NewReader(resp.Body)
+		for {
+			line, err := rd.ReadString('\n')
+			if err != nil {
+				close(events)
+				return
+			}
+			if line != "\n" {
+				events <- line
+			}
+		}
+	}()
+
+	// The first event arrives while the upstream still holds back the second
+	select {
+	case event := <-events:
+		if event != "data: one\n" {
+			t.Errorf("got %q", event)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("first event not delivered before the response finished")
+	}
+	close(next)
+	if event := <-events; event != "data: two\n" {
+		t.Errorf("got %q", event)
+	}
+	if _, open := <-events; open {
+		t.Error("stream did not end with the upstream response")
+	}
+}
+
+func TestStreamingClientDisconnectCancelsUpstream(t *testing.T) {
+	cancelled := make(chan struct{})
+	front := streamingProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		io.WriteString(w, "data: hello\n\n")
+		w.(http.Flusher).Flush()
+		select {
+		case <-r.Context().Done():
+			close(cancelled)
+		case <-time.After(5 * time.Second):
+		}
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, front.URL+"/events", nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if line, err := bufio.NewReader(resp.Body).ReadString('\n'); err != nil || line != "data: hello\n" {
+		t.Fatalf("got %q, %v", line, err)
+	}
+
+	cancel()
+	select {
+	case <-cancelled:
+	case <-time.After(2 * time.Second):
+		t.Fatal("upstream request still running after the client went away")
+	}
+}
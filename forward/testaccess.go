@@ -0,0 +1,133 @@
+package forward
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+// TestAccessHeader carries the token of a test credential
+const TestAccessHeader = "X-Test-Token"
+
+// TestAccess lets automated tests call the message routes without a RuoYi
+// login. It only takes effect where the FORWARD_ENV environment variable
+// names one of Environments, and every use is audited.
+type TestAccess struct {
+	Environments []string         `yaml:"environments"`
+	Credentials  []TestCredential `yaml:"credentials"`
+}
+
+// TestCredential is presented as the TestAccessHeader token. It grants
+// access to its own session only, on the listed routes and methods, until it
+// expires.
+type TestCredential struct {
+	Name      string    `yaml:"name"`
+	Token     string    `yaml:"token"`
+	SessionID string    `yaml:"sessionId"` // sender ID of the test session
+	Routes    []string  `yaml:"routes"`    // route paths as configured
+	Methods   []string  `yaml:"methods"`   // empty allows every method
+	Expires   time.Time `yaml:"expires"`
+}
+
+// validate checks the credentials; each must be scoped and expire
+func (ta *TestAccess) validate() error {
+	var errs []error
+	for i, c := range ta.Credentials {
+		switch {
+		case c.Name == "":
+			errs = append(errs, fmt.Errorf("credentials[%d]: name is required", i))
+		case c.Token == "":
+			errs = append(errs, fmt.Errorf("credentials[%d] %s: token is required", i, c.Name))
+		case len(c.Routes) == 0:
+			errs = append(errs, fmt.Errorf("credentials[%d] %s: routes are required", i, c.Name))
+		case c.Expires.IsZero():
+			errs = append(errs, fmt.Errorf("credentials[%d] %s: expires is required", i, c.Name))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (ta *TestAccess) enabled() bool {
+	env := os.Getenv("FORWARD_ENV")
+	return env != "" && len(ta.Credentials) > 0 && slices.Contains(ta.Environments, env)
+}
+
+// presented returns the credential r presents, if any
+func (ta *TestAccess) presented(r *http.Request) *TestCredential {
+	token := r.Header.Get(TestAccessHeader)
+	if token == "" {
+		return nil
+	}
+	for i := range ta.Credentials {
+		c := &ta.Credentials[i]
+		if c.Token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(c.Token)) == 1 {
+			return c
+		}
+	}
+	return nil
+}
+
+// check returns the credential r presents if it is valid for the request.
+// Credentials that are presented but expired or out of scope are audited and
+// rejected.
+func (ta *TestAccess) check(r *http.Request) (*TestCredential, error) {
+	if !ta.enabled() {
+		return nil, nil
+	}
+	c := ta.presented(r)
+	if c == nil {
+		return nil, nil
+	}
+
+	route := RoutePattern(r)
+	var reason string
+	switch {
+	case time.Now().After(c.Expires):
+		reason = "expired " + c.Expires.Format(time.RFC3339)
+	case !slices.Contains(c.Routes, route):
+		reason = "route not allowed"
+	case len(c.Methods) > 0 && !slices.ContainsFunc(c.Methods, func(m string) bool { return strings.EqualFold(m, r.Method) }):
+		reason = "method not allowed"
+	}
+	entry := AuditEntry{
+		Actor:      "test:" + c.Name,
+		RemoteAddr: clientIP(r),
+		Action:     "testAccess.use",
+		Target:     r.Method + " " + route,
+	}
+	if reason != "" {
+		entry.Action, entry.Detail = "testAccess.deny", reason
+		audit(entry)
+		return nil, fmt.Errorf("unauthorized: test credential %s: %s", c.Name, reason)
+	}
+	audit(entry)
+	return c, nil
+}
+
+type testCredentialKey struct{}
+
+// TestCredentialFrom returns the test credential a request was admitted with
+func TestCredentialFrom(r *http.Request) *TestCredential {
+	c, _ := r.Context().Value(testCredentialKey{}).(*TestCredential)
+	return c
+}
+
+// admitTestAccess checks r against the test access of the proxy serving it.
+// When a valid credential is presented it returns a copy of r recording it,
+// and nil when none is.
+func admitTestAccess(r *http.Request) (*http.Request, error) {
+	testAccess := requestConfig(r).TestAccess
+	c, err := testAccess.check(r)
+	if c == nil || err != nil {
+		return nil, err
+	}
+	log.Printf("[INFO] Admitted test credential %s for path: %s", c.Name, r.URL.Path)
+	return r.WithContext(context.WithValue(r.Context(), testCredentialKey{}, c)), nil
+}
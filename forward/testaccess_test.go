@@ -0,0 +1,112 @@
+package forward
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestTestAccess(t *testing.T) {
+	var leaked atomic.Bool
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get(TestAccessHeader) != "" {
+			leaked.Store(true)
+		}
+		io.WriteString(w, "ok")
+	}))
+	defer upstream.Close()
+
+	config := &Config{
+		BaseURL: upstream.URL,
+		TestAccess: TestAccess{
+			Environments: []string{"staging"},
+			Credentials: []TestCredential{
+				{Name: "e2e", Token: "tok", SessionID: "s1", Routes: []string{"/system/message/list"}, Methods: []string{"GET"}, Expires: time.Now().Add(time.Hour)},
+				{Name: "old", Token: "old", SessionID: "s2", Routes: []string{"/system/message/list"}, Expires: time.Now().Add(-time.Hour)},
+			},
+		},
+	}
+	AddRoute(config, "/system/message/list", "/system/message/list", &MessageListAuthValidator{}, &MessageListHandler{})
+	proxy := NewProxyServer(config)
+
+	get := func(target, token string) int {
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		if token != "" {
+			req.Header.Set(TestAccessHeader, token)
+		}
+		rec := httptest.NewRecorder()
+		proxy.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	t.Setenv("FORWARD_ENV", "production")
+	if code := get("/system/message/list?senderId=s1", "tok"); code != http.StatusUnauthorized {
+		t.Errorf("production: got %d", code)
+	}
+
+	t.Setenv("FORWARD_ENV", "staging")
+	tests := []struct {
+		target, token string
+		code          int
+	}{
+		{"/system/message/list?senderId=s1", "tok", http.StatusOK},
+		{"/system/message/list?senderId=s1", "", http.StatusUnauthorized},
+		{"/system/message/list?senderId=other", "tok", http.StatusBadRequest},
+		{"/system/message/list?senderId=s2", "old", http.StatusUnauthorized},
+		{"/system/message/list?senderId=s1", "wrong", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		if code := get(tt.target, tt.token); code != tt.code {
+			t.Errorf("%s with %q: got %d, want %d", tt.target, tt.token, code, tt.code)
+		}
+	}
+
+	if leaked.Load() {
+		t.Errorf("upstream received %s", TestAccessHeader)
+	}
+
+	var uses, denials int
+	for _, entry := range AuditEntries() {
+		switch {
+		case entry.Action == "testAccess.use" && entry.Actor == "test:e2e":
+			uses++
+		case entry.Action == "testAccess.deny" && entry.Actor == "test:old":
+			denials++
+		}
+	}
+	if uses != 2 || denials != 1 {
+		t.Errorf("audited %d uses and %d denials", uses, denials)
+	}
+}
+
+func TestTestAccessLeavesCallerRequestAlone(t *testing.T) {
+	t.Setenv("FORWARD_ENV", "staging")
+	config := &Config{TestAccess: TestAccess{
+		Environments: []string{"staging"},
+		Credentials:  []TestCredential{{Name: "e2e", Token: "tok", SessionID: "s1", Routes: []string{"/system/message"}, Expires: time.Now().Add(time.Hour)}},
+	}}
+	req := httptest.NewRequest(http.MethodPost, "/system/message", nil)
+	req.Header.Set(TestAccessHeader, "tok")
+	req = withRoutes(withRoutePattern(req, "/system/message"), compileRoutes(config, nil))
+
+	admitted, auth, err := (&MessageAuthValidator{}).ValidateRequest(req)
+	if err != nil || auth != "" {
+		t.Fatalf("got %q, %v", auth, err)
+	}
+	if c := TestCredentialFrom(admitted); c == nil || c.Name != "e2e" {
+		t.Errorf("admitted request carries %+v", c)
+	}
+	if c := TestCredentialFrom(req); c != nil {
+		t.Errorf("caller's request was modified to carry %+v", c)
+	}
+}
+
+func TestTestAccessRequiresTokens(t *testing.T) {
+	ta := TestAccess{Credentials: []TestCredential{{Name: "legacy", SessionID: "s1", Routes: []string{"/x"}, Expires: time.Now()}}}
+	if err := ta.validate(); err == nil {
+		t.Error("credential without a token was accepted")
+	}
+}
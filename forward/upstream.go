@@ -0,0 +1,294 @@
+package forward
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Balancing strategies for routes with several upstreams
+const (
+	BalanceRoundRobin = "round_robin"
+	BalanceLeastConn  = "least_conn"
+)
+
+// HealthCheck configures how upstreams are probed and ejected
+type HealthCheck struct {
+	Path     string        `yaml:"path"`     // probed with GET, defaults to /
+	Interval time.Duration `yaml:"interval"` // zero disables active probes
+	Timeout  time.Duration `yaml:"timeout"`
+	Failures int           `yaml:"failures"` // consecutive failures before ejection
+	Cooldown time.Duration `yaml:"cooldown"` // how long an ejected upstream sits out
+}
+
+func (hc HealthCheck) withDefaults() HealthCheck {
+	if hc.Path == "" {
+		hc.Path = "/"
+	}
+	if hc.Timeout <= 0 {
+		hc.Timeout = 2 * time.Second
+	}
+	if hc.Failures <= 0 {
+		hc.Failures = 3
+	}
+	if hc.Cooldown <= 0 {
+		hc.Cooldown = 30 * time.Second
+	}
+	return hc
+}
+
+// UpstreamStatus reports the state of one upstream
+type UpstreamStatus struct {
+	URL                 string    `json:"url"`
+	Healthy             bool      `json:"healthy"`
+	Ejected             bool      `json:"ejected"`
+	ActiveRequests      int64     `json:"activeRequests"`
+	ConsecutiveFailures int       `json:"consecutiveFailures"`
+	LastError           string    `json:"lastError,omitempty"`
+	LastChecked         time.Time `json:"lastChecked"`
+}
+
+// upstream is a single backend. Its state survives configuration reloads as
+// long as the URL stays in use.
+type upstream struct {
+	url    string
+	active atomic.Int64
+
+	mu           sync.Mutex
+	healthy      bool // result of the last active probe
+	failures     int
+	ejectedUntil time.Time
+	lastErr      string
+	lastChecked  time.Time
+}
+
+func newUpstream(url string) *upstream {
+	return &upstream{url: strings.TrimSuffix(url, "/"), healthy: true}
+}
+
+func (u *upstream) available(now time.Time) bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.healthy && !now.Before(u.ejectedUntil)
+}
+
+// report records the outcome of a proxied request for passive ejection.
+// Transport errors and gateway statuses count as failures.
+func (u *upstream) report(status int, err error, check HealthCheck) {
+	failed := err != nil || status == http.StatusBadGateway ||
+		status == http.StatusServiceUnavailable || status == http.StatusGatewayTimeout
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if !failed {
+		u.failures = 0
+		return
+	}
+	u.failures++
+	if err != nil {
+		u.lastErr = err.Error()
+	} else {
+		u.lastErr = http.StatusText(status)
+	}
+	if u.failures >= check.Failures && !time.Now().Before(u.ejectedUntil) {
+		u.ejectedUntil = time.Now().Add(check.Cooldown)
+		log.Printf("[ERROR] Ejecting upstream %s for %s after %d consecutive failures: %s",
+			u.url, check.Cooldown, u.failures, u.lastErr)
+	}
+}
+
+// probe checks one upstream. Any response below 500 counts as healthy, since
+// RuoYi answers unauthenticated requests with 401.
+func (u *upstream) probe(check HealthCheck) {
+	ctx, cancel := context.WithTimeout(context.Background(), check.Timeout)
+	defer cancel()
+
+	var probeErr string
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.url+check.Path, nil)
+	if err == nil {
+		var resp *http.Response
+		resp, err = upstreamClient.Do(req)
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode >= http.StatusInternalServerError {
+				probeErr = resp.Status
+			}
+		}
+	}
+	if err != nil {
+		probeErr = err.Error()
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	healthy := probeErr == ""
+	if healthy != u.healthy {
+		if healthy {
+			log.Printf("[INFO] Upstream %s is healthy again", u.url)
+		} else {
+			log.Printf("[ERROR] Upstream %s failed health check: %s", u.url, probeErr)
+		}
+	}
+	u.healthy = healthy
+	u.lastChecked = time.Now()
+	if healthy {
+		u.failures = 0
+		u.ejectedUntil = time.Time{}
+	} else {
+		u.lastErr = probeErr
+	}
+}
+
+func (u *upstream) status(now time.Time) UpstreamStatus {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return UpstreamStatus{
+		URL:                 u.url,
+		Healthy:             u.healthy,
+		Ejected:             now.Before(u.ejectedUntil),
+		ActiveRequests:      u.active.Load(),
+		ConsecutiveFailures: u.failures,
+		LastError:           u.lastErr,
+		LastChecked:         u.lastChecked,
+	}
+}
+
+// probeLoop actively checks upstreams every check.Interval until stop is closed
+func probeLoop(upstreams []*upstream, check HealthCheck, stop <-chan struct{}) {
+	ticker := time.NewTicker(check.Interval)
+	defer ticker.Stop()
+	for {
+		var wg sync.WaitGroup
+		for _, u := range upstreams {
+			wg.Add(1)
+			go func(u *upstream) {
+				defer wg.Done()
+				u.probe(check)
+			}(u)
+		}
+		wg.Wait()
+
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// upstreamPool spreads the requests of a route over its upstreams
+type upstreamPool struct {
+	balance   string
+	check     HealthCheck
+	upstreams []*upstream
+	next      atomic.Uint64
+}
+
+// pick chooses an upstream, skipping those in tried. When every remaining
+// upstream is unhealthy one of them is returned anyway rather than failing
+// outright. It returns nil once all upstreams have been tried.
+func (p *upstreamPool) pick(tried map[*upstream]bool) *upstream {
+	now := time.Now()
+	var candidates, fallback []*upstream
+	for _, u := range p.upstreams {
+		if tried[u] {
+			continue
+		}
+		fallback = append(fallback, u)
+		if u.available(now) {
+			candidates = append(candidates, u)
+		}
+	}
+	if len(candidates) == 0 {
+		candidates = fallback
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	start := int((p.next.Add(1) - 1) % uint64(len(candidates)))
+	if p.balance != BalanceLeastConn {
+		return candidates[start]
+	}
+	best := candidates[start]
+	for i := 1; i < len(candidates); i++ {
+		u := candidates[(start+i)%len(candidates)]
+		if u.active.Load() < best.active.Load() {
+			best = u
+		}
+	}
+	return best
+}
+
+// report records the outcome of a request sent to u
+func (p *upstreamPool) report(u *upstream, status int, err error) {
+	u.report(status, err, p.check)
+}
+
+// get sends a GET for path on behalf of auth, moving on to the next upstream
+// after transport errors and gateway statuses like proxied idempotent
+// requests do. Each upstream is tried at most once.
+func (p *upstreamPool) get(path, auth string) ([]byte, error) {
+	tried := map[*upstream]bool{}
+	var lastErr error
+	for target := p.pick(tried); target != nil; target = p.pick(tried) {
+		tried[target] = true
+		target.active.Add(1)
+		body, status, err := getWithAuth(target.url+path, auth)
+		target.active.Add(-1)
+		p.report(target, status, err)
+		switch {
+		case err != nil:
+			lastErr = err
+		case status == http.StatusBadGateway || status == http.StatusServiceUnavailable ||
+			status == http.StatusGatewayTimeout:
+			lastErr = fmt.Errorf("upstream %s answered %d %s", target.url, status, http.StatusText(status))
+		default:
+			return body, nil
+		}
+		log.Printf("[ERROR] Lookup of %s on %s failed: %v", path, target.url, lastErr)
+	}
+	return nil, lastErr
+}
+
+// getWithAuth sends a GET to url with the Authorization header set to auth
+func getWithAuth(url, auth string) (body []byte, status int, err error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	req.Header.Set("Authorization", auth)
+	resp, err := upstreamClient.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	body, err = io.ReadAll(resp.Body)
+	return body, resp.StatusCode, err
+}
+
+// UpstreamStatus reports the state of every upstream of the running configuration
+func (s *ProxyServer) UpstreamStatus() []UpstreamStatus {
+	table := s.routes()
+	now := time.Now()
+	var statuses []UpstreamStatus
+	for _, url := range sortedKeys(table.upstreams) {
+		statuses = append(statuses, table.upstreams[url].status(now))
+	}
+	return statuses
+}
+
+// UpstreamStatusHandler serves UpstreamStatus as JSON
+func (s *ProxyServer) UpstreamStatusHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(s.UpstreamStatus())
+	})
+}
@@ -0,0 +1,176 @@
+package forward
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPoolRoundRobin(t *testing.T) {
+	pool := &upstreamPool{upstreams: []*upstream{newUpstream("a"), newUpstream("b"), newUpstream("c")}}
+	var got string
+	for i := 0; i < 6; i++ {
+		got += pool.pick(nil).url
+	}
+	if got != "abcabc" {
+		t.Errorf("got %s, want abcabc", got)
+	}
+
+	// Ejected upstreams are skipped until every one is
+	pool.upstreams[1].ejectedUntil = time.Now().Add(time.Minute)
+	if u := pool.pick(map[*upstream]bool{pool.upstreams[0]: true}); u.url != "c" {
+		t.Errorf("got %s, want c", u.url)
+	}
+	tried := map[*upstream]bool{pool.upstreams[0]: true, pool.upstreams[2]: true}
+	if u := pool.pick(tried); u.url != "b" {
+		t.Errorf("got %s with the rest tried, want b", u.url)
+	}
+}
+
+func TestPoolLeastConn(t *testing.T) {
+	pool := &upstreamPool{
+		balance:   BalanceLeastConn,
+		upstreams: []*upstream{newUpstream("a"), newUpstream("b"), newUpstream("c")},
+	}
+	pool.upstreams[0].active.Store(3)
+	pool.upstreams[1].active.Store(1)
+	pool.upstreams[2].active.Store(2)
+	for i := 0; i < 3; i++ {
+		if u := pool.pick(nil); u.url != "b" {
+			t.Fatalf("got %s, want b", u.url)
+		}
+	}
+	pool.upstreams[1].active.Store(5)
+	if u := pool.pick(nil); u.url != "c" {
+		t.Errorf("got %s, want c", u.url)
+	}
+}
+
+// sessionNode answers loginInfo and session lookups for user 7, with 502
+// while down is set
+func sessionNode(t *testing.T, down *atomic.Bool, hits *atomic.Int32) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		if down.Load() {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		if r.URL.Path == "/system/loginInfo" {
+			io.WriteString(w, `{"code": 200, "data": {"id": 7, "mobile": "13800000007"}}`)
+			return
+		}
+		io.WriteString(w, `{"code": 200, "data": {"senderId": "s7"}}`)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestLookupsEjectFailingNodes(t *testing.T) {
+	var badDown, goodDown atomic.Bool
+	var badHits, goodHits atomic.Int32
+	badDown.Store(true)
+	bad := sessionNode(t, &badDown, &badHits)
+	good := sessionNode(t, &goodDown, &goodHits)
+
+	table := compileRoutes(&Config{
+		BaseURL:     bad.URL,
+		Upstreams:   []string{bad.URL, good.URL},
+		HealthCheck: HealthCheck{Failures: 2, Cooldown: time.Minute},
+	}, nil)
+	defer table.close()
+
+	counterpart := Counterpart{ID: FixedLawyerId, SessionPath: DefaultSessionPath}
+	for i := 0; i < 6; i++ {
+		senderId, err := lookupSenderId(table, "7", counterpart, "Bearer t7")
+		if err != nil || senderId != "s7" {
+			t.Fatalf("lookup %d: got %q, %v", i, senderId, err)
+		}
+	}
+	if n := badHits.Load(); n != 2 {
+		t.Errorf("failing node got %d lookups, want 2 before ejection", n)
+	}
+	if n := goodHits.Load(); n != 6 {
+		t.Errorf("healthy node got %d lookups, want 6", n)
+	}
+	if status := table.upstreams[bad.URL].status(time.Now()); !status.Ejected {
+		t.Errorf("failing node not ejected: %+v", status)
+	}
+
+	// With every node failing the lookup reports the error
+	goodDown.Store(true)
+	if _, err := lookupSenderId(table, "7", counterpart, "Bearer t7"); err == nil {
+		t.Error("lookup succeeded with every node down")
+	}
+}
+
+func TestProbesRestoreNodes(t *testing.T) {
+	var down atomic.Bool
+	var hits atomic.Int32
+	node := sessionNode(t, &down, &hits)
+
+	table := compileRoutes(&Config{
+		BaseURL:     node.URL,
+		HealthCheck: HealthCheck{Interval: 20 * time.Millisecond, Failures: 1, Cooldown: time.Hour},
+	}, nil)
+	defer table.close()
+	u := table.upstreams[node.URL]
+
+	down.Store(true)
+	u.report(http.StatusBadGateway, nil, table.lookups.check)
+	if u.available(time.Now()) {
+		t.Fatal("node still available after failing")
+	}
+
+	// The ejection would last an hour, but the next probe passes
+	down.Store(false)
+	deadline := time.Now().Add(2 * time.Second)
+	for !u.available(time.Now()) {
+		if time.Now().After(deadline) {
+			t.Fatalf("node not restored by probes: %+v", u.status(time.Now()))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// And a failing probe takes it out again without any traffic
+	down.Store(true)
+	deadline = time.Now().Add(2 * time.Second)
+	for u.available(time.Now()) {
+		if time.Now().After(deadline) {
+			t.Fatalf("node not marked unhealthy by probes: %+v", u.status(time.Now()))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestTokenChecksFailOver(t *testing.T) {
+	var badDown, goodDown atomic.Bool
+	var badHits, goodHits atomic.Int32
+	badDown.Store(true)
+	bad := sessionNode(t, &badDown, &badHits)
+	good := sessionNode(t, &goodDown, &goodHits)
+
+	table := compileRoutes(&Config{
+		BaseURL:     bad.URL,
+		Upstreams:   []string{bad.URL, good.URL},
+		HealthCheck: HealthCheck{Failures: 2, Cooldown: time.Minute},
+	}, nil)
+	defer table.close()
+	req := withRoutes(httptest.NewRequest(http.MethodGet, "/", nil), table)
+
+	for i := 0; i < 4; i++ {
+		if id, err := GetIdByAuth(req, fmt.Sprintf("Bearer t%d", i)); err != nil || id != "7" {
+			t.Fatalf("check %d: got %q, %v", i, id, err)
+		}
+	}
+	if n := badHits.Load(); n != 2 {
+		t.Errorf("failing node got %d token checks, want 2 before ejection", n)
+	}
+	if n := goodHits.Load(); n != 4 {
+		t.Errorf("healthy node got %d token checks, want 4", n)
+	}
+}
@@ -0,0 +1,255 @@
+package forward
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/go-playground/validator/v10"
+)
+
+// RequestSchema checks JSON request bodies before they reach middleware and
+// the upstream. The body is decoded into the registered Schema struct and
+// checked with its validate tags, and each of Fields is checked with its
+// validator rules, e.g. {msgText: "required,max=2000"}. Strict rejects fields
+// the schema does not know.
+type RequestSchema struct {
+	Schema string            `yaml:"schema"`
+	Fields map[string]string `yaml:"fields"`
+	Strict bool              `yaml:"strict"`
+
+	factory SchemaFactory
+}
+
+// messageSchema is the built-in schema of /system/message bodies. userId and
+// senderId are left to the message middleware, which may inject them.
+type messageSchema struct {
+	ID         int64  `json:"id"`
+	MsgText    string `json:"msgText" validate:"required,max=5000"`
+	MsgType    int    `json:"msgType" validate:"gte=0"`
+	SenderID   string `json:"senderId" validate:"omitempty,max=64"`
+	SourceType int    `json:"sourceType" validate:"gte=0"`
+	UserID     int    `json:"userId" validate:"gte=0"`
+}
+
+var validate = newValidate()
+
+func newValidate() *validator.Validate {
+	v := validator.New(validator.WithRequiredStructEnabled())
+	// Report fields by their JSON names
+	v.RegisterTagNameFunc(func(field reflect.StructField) string {
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "-" {
+			return ""
+		}
+		return name
+	})
+	return v
+}
+
+// compile resolves the schema and checks the field rules
+func (rs *RequestSchema) compile() error {
+	if rs.Schema != "" {
+		registryMu.RLock()
+		rs.factory = schemas[rs.Schema]
+		registryMu.RUnlock()
+		if rs.factory == nil {
+			return fmt.Errorf("unknown schema %q", rs.Schema)
+		}
+	}
+	if rs.factory == nil && len(rs.Fields) == 0 {
+		return errors.New("schema or fields is required")
+	}
+	for field, rules := range rs.Fields {
+		if err := checkRules(rules); err != nil {
+			return fmt.Errorf("fields.%s: %w", field, err)
+		}
+	}
+	return nil
+}
+
+// checkRules reports rules the validator does not understand, which it would
+// otherwise only panic on at request time
+func checkRules(rules string) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("invalid rules %q: %v", rules, r)
+		}
+	}()
+	validate.Var(nil, rules)
+	return nil
+}
+
+// check validates body, returning a message fit for the client
+func (rs *RequestSchema) check(body []byte) error {
+	if rs.factory != nil {
+		v := rs.factory()
+		dec := json.NewDecoder(bytes.NewReader(body))
+		if rs.Strict && len(rs.Fields) == 0 {
+			dec.DisallowUnknownFields()
+		}
+		if err := dec.Decode(v); err != nil {
+			return fmt.Errorf("invalid JSON: %v", err)
+		}
+		if err := validate.Struct(v); err != nil {
+			return validationMessage(err, "")
+		}
+	}
+
+	if len(rs.Fields) == 0 {
+		return nil
+	}
+	var fields map[string]any
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return fmt.Errorf("invalid JSON: %v", err)
+	}
+	if rs.Strict {
+		for name := range fields {
+			if _, ok := rs.Fields[name]; !ok && !rs.schemaField(name) {
+				return fmt.Errorf("%s: unknown field", name)
+			}
+		}
+	}
+	for _, name := range sortedKeys(rs.Fields) {
+		if err := checkField(name, fields[name], rs.Fields[name]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkField validates one decoded JSON value. The validator panics when a
+// rule does not fit the value's type, e.g. len on a bool, which the client
+// sees as a type error.
+func checkField(name string, value any, rules string) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%s: invalid type %s", name, jsonType(value))
+		}
+	}()
+	if err := validate.Var(value, rules); err != nil {
+		return validationMessage(err, name)
+	}
+	return nil
+}
+
+// jsonType names the JSON type of a value decoded into any
+func jsonType(value any) string {
+	switch value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		return "number"
+	case string:
+		return "string"
+	case []any:
+		return "array"
+	default:
+		return "object"
+	}
+}
+
+// schemaField reports whether name is a JSON field of the schema struct
+func (rs *RequestSchema) schemaField(name string) bool {
+	if rs.factory == nil {
+		return false
+	}
+	t := reflect.TypeOf(rs.factory()).Elem()
+	for i := 0; i < t.NumField(); i++ {
+		tag, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+		if tag == name || (tag == "" && t.Field(i).Name == name) {
+			return true
+		}
+	}
+	return false
+}
+
+// validationMessage turns validator errors into "field: rule" messages
+func validationMessage(err error, field string) error {
+	var errs validator.ValidationErrors
+	if !errors.As(err, &errs) {
+		return err
+	}
+	msgs := make([]string, 0, len(errs))
+	for _, e := range errs {
+		name := field
+		if name == "" {
+			name = e.Field()
+		}
+		rule := e.Tag()
+		if e.Param() != "" {
+			rule += "=" + e.Param()
+		}
+		msgs = append(msgs, name+": "+rule)
+	}
+	sort.Strings(msgs)
+	return errors.New(strings.Join(msgs, "; "))
+}
+
+// checkRequestBody enforces the body limit and schema of a route, answering
+// in RuoYi's {code,msg} format. It reports whether the request may proceed.
+// The body is buffered, so later middleware reads it from memory.
+func checkRequestBody(w http.ResponseWriter, r *http.Request, routeConfig *RouteConfig) bool {
+	limit := routeConfig.MaxBodySize
+	if limit <= 0 && routeConfig.Schema == nil {
+		return true
+	}
+	if limit > 0 && r.ContentLength > limit {
+		writeEnvelope(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("request body exceeds %d bytes", limit))
+		return false
+	}
+
+	var body []byte
+	if r.Body != nil && r.Body != http.NoBody {
+		var reader io.Reader = r.Body
+		if limit > 0 {
+			reader = http.MaxBytesReader(w, r.Body, limit)
+		}
+		var err error
+		if body, err = io.ReadAll(reader); err != nil {
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				writeEnvelope(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("request body exceeds %d bytes", limit))
+			} else {
+				writeEnvelope(w, http.StatusBadRequest, "error reading request body")
+			}
+			return false
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+	}
+
+	if routeConfig.Schema == nil {
+		return true
+	}
+	var err error
+	switch {
+	case len(body) > 0:
+		err = routeConfig.Schema.check(body)
+	case r.Method == http.MethodPost || r.Method == http.MethodPut || r.Method == http.MethodPatch:
+		err = errors.New("request body is required")
+	}
+	if err != nil {
+		log.Printf("[ERROR] Invalid request body for path: %s, error: %v", r.URL.Path, err)
+		writeEnvelope(w, http.StatusBadRequest, err.Error())
+		return false
+	}
+	return true
+}
+
+// writeEnvelope replies with a RuoYi style {code,msg} error
+func writeEnvelope(w http.ResponseWriter, status int, msg string) {
+	body, _ := marshalJSON(ruoyiEnvelope{Code: status, Msg: msg})
+	w.Header().Set("Content-Type", "application/json;charset=UTF-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	w.Write(body)
+}
@@ -0,0 +1,84 @@
+package forward
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRequestBodyValidation(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Write(body)
+	}))
+	defer upstream.Close()
+
+	spec := RouteSpec{
+		Path:        "/system/message",
+		Auth:        PluginSpec{Name: "referer"},
+		MaxBodySize: 64,
+		Validate:    &RequestSchema{Schema: "message", Strict: true, Fields: map[string]string{"msgText": "max=10"}},
+	}
+	route, err := spec.build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := NewProxyServer(&Config{BaseURL: upstream.URL, Routes: map[string]*RouteConfig{"/system/message": route}})
+
+	tests := []struct {
+		body string
+		code int
+		msg  string
+	}{
+		{`{"msgText": "hi", "msgType": 1}`, http.StatusOK, ""},
+		{`{"msgType": 1}`, http.StatusBadRequest, `{"code":400,"msg":"msgText: required"}`},
+		{`{"msgText": "hello world"}`, http.StatusBadRequest, `{"code":400,"msg":"msgText: max=10"}`},
+		{`{"msgText": "hi", "admin": true}`, http.StatusBadRequest, `{"code":400,"msg":"admin: unknown field"}`},
+		{`{"msgText": "hi", "msgType": -1}`, http.StatusBadRequest, `{"code":400,"msg":"msgType: gte=0"}`},
+		{"", http.StatusBadRequest, `{"code":400,"msg":"request body is required"}`},
+		{`{"msgText": "` + strings.Repeat("x", 64) + `"}`, http.StatusRequestEntityTooLarge, `{"code":413,"msg":"request body exceeds 64 bytes"}`},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodPost, "/system/message", strings.NewReader(tt.body))
+		req.Header.Set("Referer", ValidReferer)
+		rec := httptest.NewRecorder()
+		proxy.ServeHTTP(rec, req)
+		if rec.Code != tt.code {
+			t.Errorf("%s: got %d %s", tt.body, rec.Code, rec.Body.String())
+			continue
+		}
+		if tt.msg != "" && rec.Body.String() != tt.msg {
+			t.Errorf("%s: got %s, want %s", tt.body, rec.Body.String(), tt.msg)
+		}
+	}
+
+	if _, err := (&RouteSpec{Path: "/x", Auth: PluginSpec{Name: "referer"}, Validate: &RequestSchema{Schema: "nope"}}).build(); err == nil {
+		t.Error("unknown schema accepted")
+	}
+	if _, err := (&RouteSpec{Path: "/x", Auth: PluginSpec{Name: "referer"}, Validate: &RequestSchema{Fields: map[string]string{"a": "bogus"}}}).build(); err == nil {
+		t.Error("unknown rule accepted")
+	}
+}
+
+func TestRequestBodyWrongType(t *testing.T) {
+	spec := RouteSpec{
+		Path:     "/system/message",
+		Auth:     PluginSpec{Name: "referer"},
+		Validate: &RequestSchema{Fields: map[string]string{"msgText": "len=3"}},
+	}
+	route, err := spec.build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := NewProxyServer(&Config{BaseURL: "http://127.0.0.1:1", Routes: map[string]*RouteConfig{"/system/message": route}})
+
+	req := httptest.NewRequest(http.MethodPost, "/system/message", strings.NewReader(`{"msgText": true}`))
+	req.Header.Set("Referer", ValidReferer)
+	rec := httptest.NewRecorder()
+	proxy.ServeHTTP(rec, req)
+	if want := `{"code":400,"msg":"msgText: invalid type boolean"}`; rec.Code != http.StatusBadRequest || rec.Body.String() != want {
+		t.Errorf("got %d %s, want %s", rec.Code, rec.Body.String(), want)
+	}
+}
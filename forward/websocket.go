@@ -0,0 +1,187 @@
+package forward
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	wsWriteWait  = 10 * time.Second
+	wsPongWait   = 60 * time.Second
+	wsPingPeriod = wsPongWait * 9 / 10
+)
+
+// Handshake headers set by the websocket library itself
+var wsHandshakeHeaders = map[string]bool{
+	"Connection":               true,
+	"Upgrade":                  true,
+	"Host":                     true,
+	"Sec-Websocket-Key":        true,
+	"Sec-Websocket-Version":    true,
+	"Sec-Websocket-Extensions": true,
+	"Sec-Websocket-Protocol":   true,
+}
+
+var wsUpgrader = websocket.Upgrader{
+	// The route's AuthValidator has already accepted the handshake
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+var wsDialer = &websocket.Dialer{
+	Proxy:            http.ProxyFromEnvironment,
+	HandshakeTimeout: 10 * time.Second,
+}
+
+// toWebSocketURL turns an http(s) upstream URL into its ws(s) equivalent
+func toWebSocketURL(httpURL string) string {
+	switch {
+	case strings.HasPrefix(httpURL, "https://"):
+		return "wss://" + strings.TrimPrefix(httpURL, "https://")
+	case strings.HasPrefix(httpURL, "http://"):
+		return "ws://" + strings.TrimPrefix(httpURL, "http://")
+	}
+	return httpURL
+}
+
+// proxyWebSocket connects to the upstream WebSocket endpoint, upgrades the
+// client connection and pumps frames both ways until either side closes
+func (s *ProxyServer) proxyWebSocket(w http.ResponseWriter, r *http.Request, pool *upstreamPool, targetPath string, routeConfig *RouteConfig) {
+	target := pool.pick(nil)
+	target.active.Add(1)
+	defer target.active.Add(-1)
+
+	targetURL := toWebSocketURL(target.url + targetPath)
+	if r.URL.RawQuery != "" {
+		targetURL += "?" + r.URL.RawQuery
+	}
+
+	header := outboundHeader(r, &routeConfig.Headers, s.routes().config.TrustedProxies)
+	for key := range header {
+		if wsHandshakeHeaders[http.CanonicalHeaderKey(key)] {
+			delete(header, key)
+		}
+	}
+	if host := routeConfig.Headers.upstreamHost(r.Host); host != "" {
+		// The dialer sends this as the Host of the handshake
+		header.Set("Host", host)
+	}
+	dialer := *wsDialer
+	dialer.Subprotocols = websocket.Subprotocols(r)
+
+	backend, resp, err := dialer.DialContext(r.Context(), targetURL, header)
+	if err != nil {
+		log.Printf("Error dialing websocket %s: %v", targetURL, err)
+		status := http.StatusBadGateway
+		if resp != nil {
+			status = resp.StatusCode
+			pool.report(target, status, nil)
+		} else if r.Context().Err() == nil {
+			pool.report(target, 0, err)
+		}
+		http.Error(w, "Error connecting upstream: "+err.Error(), status)
+		return
+	}
+	pool.report(target, http.StatusSwitchingProtocols, nil)
+	defer backend.Close()
+
+	responseHeader := http.Header{}
+	if protocol := backend.Subprotocol(); protocol != "" {
+		responseHeader.Set("Sec-WebSocket-Protocol", protocol)
+	}
+	client, err := wsUpgrader.Upgrade(w, r, responseHeader)
+	if err != nil {
+		// Upgrade has already replied to the client
+		log.Printf("Error upgrading websocket for %s: %v", r.URL.Path, err)
+		return
+	}
+	defer client.Close()
+	log.Printf("[INFO] WebSocket connected: %s <-> %s", r.URL.Path, targetURL)
+
+	expectPongs(client)
+	expectPongs(backend)
+	done := make(chan struct{})
+	defer close(done)
+	go keepAlive(client, done)
+	go keepAlive(backend, done)
+
+	errc := make(chan error, 2)
+	go pumpFrames(backend, client, errc)
+	go pumpFrames(client, backend, errc)
+
+	err = <-errc
+	// Give the other direction a moment to complete the close handshake
+	select {
+	case <-errc:
+	case <-time.After(wsWriteWait):
+	}
+	if err != nil && !websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+		log.Printf("[INFO] WebSocket closed: %s: %v", r.URL.Path, err)
+		return
+	}
+	log.Printf("[INFO] WebSocket closed: %s", r.URL.Path)
+}
+
+// pumpFrames copies messages from src to dst. When src closes, the close
+// code and reason are passed on to dst.
+func pumpFrames(dst, src *websocket.Conn, errc chan<- error) {
+	for {
+		messageType, data, err := src.ReadMessage()
+		if err != nil {
+			dst.WriteControl(websocket.CloseMessage, closeMessageFor(err), time.Now().Add(wsWriteWait))
+			errc <- err
+			return
+		}
+		dst.SetWriteDeadline(time.Now().Add(wsWriteWait))
+		if err := dst.WriteMessage(messageType, data); err != nil {
+			src.WriteControl(websocket.CloseMessage, closeMessageFor(err), time.Now().Add(wsWriteWait))
+			errc <- err
+			return
+		}
+	}
+}
+
+// closeMessageFor builds the close frame to forward for a read or write error
+func closeMessageFor(err error) []byte {
+	var closeErr *websocket.CloseError
+	if errors.As(err, &closeErr) {
+		switch closeErr.Code {
+		case websocket.CloseNoStatusReceived:
+			return websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
+		case websocket.CloseAbnormalClosure, websocket.CloseTLSHandshake:
+			// Reserved codes that must not be sent on the wire
+		default:
+			return websocket.FormatCloseMessage(closeErr.Code, closeErr.Text)
+		}
+	}
+	return websocket.FormatCloseMessage(websocket.CloseGoingAway, "")
+}
+
+// expectPongs makes reads on conn fail once pongs stop arriving. It must be
+// called before the connection is read from.
+func expectPongs(conn *websocket.Conn) {
+	conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	})
+}
+
+// keepAlive pings conn periodically until done is closed
+func keepAlive(conn *websocket.Conn, done <-chan struct{}) {
+	ticker := time.NewTicker(wsPingPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteWait)); err != nil {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package forward
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// bearerValidator accepts a single token
+type bearerValidator string
+
+func (v bearerValidator) Validate(r *http.Request) (string, error) {
+	if auth := r.Header.Get("Authorization"); auth != "Bearer "+string(v) {
+		return "", errors.New("invalid token")
+	}
+	return r.Header.Get("Authorization"), nil
+}
+
+// wsBackend echoes messages prefixed with "echo: ". It closes with 4001 when
+// told "close" and reports the close frames it receives on closed.
+type wsBackend struct {
+	auth   chan string
+	closed chan *websocket.CloseError
+}
+
+func newWSBackend() *wsBackend {
+	return &wsBackend{auth: make(chan string, 10), closed: make(chan *websocket.CloseError, 10)}
+}
+
+func (b *wsBackend) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	b.auth <- r.Header.Get("Authorization")
+	var upgrader websocket.Upgrader
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	for {
+		messageType, data, err := conn.ReadMessage()
+		var closeErr *websocket.CloseError
+		if errors.As(err, &closeErr) {
+			b.closed <- closeErr
+		}
+		if err != nil {
+			return
+		}
+		if string(data) == "close" {
+			conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(4001, "bye"), time.Now().Add(time.Second))
+			continue
+		}
+		conn.WriteMessage(messageType, append([]byte("echo: "), data...))
+	}
+}
+
+// wsURL serves /ws, requiring the token "secret", in front of backend on a
+// real listener and returns its URL
+func wsURL(t *testing.T, backend *wsBackend) string {
+	t.Helper()
+	config := &Config{Routes: map[string]*RouteConfig{"/ws": {AuthValidator: bearerValidator("secret"), WebSocket: true}}}
+	proxy := testProxy(t, config, backend.ServeHTTP)
+	return toWebSocketURL(startServer(t, proxy.ServeHTTP).URL) + "/ws"
+}
+
+func dialWS(t *testing.T, url, token string) (*websocket.Conn, *http.Response, error) {
+	t.Helper()
+	header := http.Header{}
+	if token != "" {
+		header.Set("Authorization", "Bearer "+token)
+	}
+	conn, resp, err := websocket.DefaultDialer.Dial(url, header)
+	if conn != nil {
+		t.Cleanup(func() { conn.Close() })
+	}
+	return conn, resp, err
+}
+
+func TestWebSocketHandshakeAuth(t *testing.T) {
+	backend := newWSBackend()
+	url := wsURL(t, backend)
+
+	for _, token := range []string{"", "wrong"} {
+		_, resp, err := dialWS(t, url, token)
+		if err == nil || resp == nil || resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("token %q: got %v, want a 401 handshake", token, err)
+		}
+	}
+	select {
+	case <-backend.auth:
+		t.Fatal("unauthenticated handshake reached the upstream")
+	default:
+	}
+
+	if _, _, err := dialWS(t, url, "secret"); err != nil {
+		t.Fatal(err)
+	}
+	if auth := <-backend.auth; auth != "Bearer secret" {
+		t.Errorf("upstream handshake carried Authorization %q", auth)
+	}
+}
+
+func TestWebSocketRelaysFrames(t *testing.T) {
+	backend := newWSBackend()
+	conn, _, err := dialWS(t, wsURL(t, backend), "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	for _, msg := range []struct {
+		kind int
+		data string
+	}{
+		{websocket.TextMessage, "你好"},
+		{websocket.BinaryMessage, "\x00\x01\x02"},
+		{websocket.TextMessage, strings.Repeat("x", 100000)},
+	} {
+		if err := conn.WriteMessage(msg.kind, []byte(msg.data)); err != nil {
+			t.Fatal(err)
+		}
+		kind, data, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if kind != msg.kind || string(data) != "echo: "+msg.data {
+			t.Errorf("got type %d %.20q, want type %d echo of %.20q", kind, data, msg.kind, msg.data)
+		}
+	}
+}
+
+func TestWebSocketPassesCloseCodes(t *testing.T) {
+	backend := newWSBackend()
+	url := wsURL(t, backend)
+
+	// Upstream to client
+	conn, _, err := dialWS(t, url, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	conn.WriteMessage(websocket.TextMessage, []byte("close"))
+	_, _, err = conn.ReadMessage()
+	if !websocket.IsCloseError(err, 4001) || !strings.Contains(err.Error(), "bye") {
+		t.Errorf("client got %v, want close 4001 bye", err)
+	}
+
+	// Client to upstream
+	conn, _, err = dialWS(t, url, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(4002, "done"), time.Now().Add(time.Second))
+	for {
+		select {
+		case closeErr := <-backend.closed:
+			if closeErr.Code == 4001 {
+				continue // the echo of the first connection's close
+			}
+			if closeErr.Code != 4002 || closeErr.Text != "done" {
+				t.Errorf("upstream got close %d %q, want 4002 done", closeErr.Code, closeErr.Text)
+			}
+			return
+		case <-time.After(5 * time.Second):
+			t.Fatal("close frame did not reach the upstream")
+		}
+	}
+}
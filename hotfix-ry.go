@@ -1,9 +1,45 @@
 package main
 
 import (
+	"flag"
+	"log"
+	"os"
+	"strings"
+
 	"e.coding.net/Love54dj/weizhong/etc/forward"
 )
 
 func main() {
-	forward.ServeOnPort(9304)
+	addr := flag.String("addr", ":9304", "listen address")
+	routesFile := flag.String("routes", "", "route file (YAML or JSON), defaults to the built-in routes")
+	tlsCert := flag.String("tls-cert", "", "TLS certificate file, serves HTTPS together with -tls-key")
+	tlsKey := flag.String("tls-key", "", "TLS key file")
+	internalAddr := flag.String("internal-addr", "127.0.0.1:9305", "listen address of the admin API and metrics, keep it off the public network")
+	auditLog := flag.String("audit-log", "", "file keeping the admin audit trail across restarts, in memory only when empty")
+	flag.Parse()
+
+	err := forward.Serve(forward.ServeOptions{
+		Addr:         *addr,
+		RoutesFile:   *routesFile,
+		TLSCertFile:  *tlsCert,
+		TLSKeyFile:   *tlsKey,
+		InternalAddr: *internalAddr,
+		// FORWARD_ADMIN_TOKENS="alice=token1,bob=token2" enables the admin API
+		AdminTokens: adminTokens(os.Getenv("FORWARD_ADMIN_TOKENS")),
+		AuditLog:    *auditLog,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func adminTokens(spec string) map[string]string {
+	tokens := map[string]string{}
+	for _, pair := range strings.Split(spec, ",") {
+		name, token, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if ok && name != "" && token != "" {
+			tokens[name] = token
+		}
+	}
+	return tokens
 }
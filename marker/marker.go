@@ -8,11 +8,14 @@ import (
 	"log/slog"
 	"net/http"
 	"sync"
+
+	"e.coding.net/Love54dj/weizhong/etc/metrics"
 )
 
 var baseUrl string
 var authToken string
 var singleThreadMutex sync.Mutex
+var client = metrics.InstrumentClient("marker", &http.Client{})
 
 func Init(host string, token string) {
 	baseUrl = fmt.Sprintf("http://%s/convert", host)
@@ -34,7 +37,7 @@ func Pdf2Markdown(fileUrl string) (markdownText string, err error) {
 	}
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("Authorization", authToken)
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := client.Do(req)
 	if err != nil {
 		return
 	}
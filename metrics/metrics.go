@@ -0,0 +1,302 @@
+// Package metrics keeps counters, gauges and histograms in memory and exposes
+// them in the Prometheus text format, for scraping at /metrics.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefBuckets are latency buckets in seconds, from 5ms to 10s
+var DefBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Default is the registry of the package level functions and Handler
+var Default = NewRegistry()
+
+// Registry holds metric families by name
+type Registry struct {
+	mu       sync.Mutex
+	families map[string]*family
+}
+
+// NewRegistry returns an empty registry
+func NewRegistry() *Registry {
+	return &Registry{families: map[string]*family{}}
+}
+
+type family struct {
+	name, help, kind string
+	labels           []string
+	buckets          []float64                          // histograms only
+	collect          func(set func(float64, ...string)) // gauge functions only
+
+	mu     sync.Mutex
+	series map[string]*series
+}
+
+type series struct {
+	labels []string
+	value  float64  // counters and gauges
+	counts []uint64 // histograms, per bucket
+	sum    float64
+	count  uint64
+}
+
+// register returns the family called name, creating it if needed. Asking
+// for an existing name with another kind or labels is a programming error.
+func (reg *Registry) register(name, help, kind string, buckets []float64, labels []string) *family {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	if f, ok := reg.families[name]; ok {
+		if f.kind != kind || strings.Join(f.labels, ",") != strings.Join(labels, ",") {
+			panic(fmt.Sprintf("metrics: %s registered again as a %s with labels %v", name, kind, labels))
+		}
+		return f
+	}
+	f := &family{name: name, help: help, kind: kind, labels: labels, buckets: buckets, series: map[string]*series{}}
+	reg.families[name] = f
+	return f
+}
+
+// get returns the series of the label values, which must match the labels
+// of the family in number
+func (f *family) get(values []string) *series {
+	if len(values) != len(f.labels) {
+		panic(fmt.Sprintf("metrics: %s takes %d label values, got %d", f.name, len(f.labels), len(values)))
+	}
+	key := strings.Join(values, "\xff")
+	s, ok := f.series[key]
+	if !ok {
+		s = &series{labels: append([]string(nil), values...)}
+		if f.kind == "histogram" {
+			s.counts = make([]uint64, len(f.buckets))
+		}
+		f.series[key] = s
+	}
+	return s
+}
+
+// CounterVec counts events, split by label values
+type CounterVec struct{ f *family }
+
+// Counter returns the counter called name, registering it on first use
+func (reg *Registry) Counter(name, help string, labels ...string) *CounterVec {
+	return &CounterVec{reg.register(name, help, "counter", nil, labels)}
+}
+
+// Inc adds one to the counter of the label values
+func (c *CounterVec) Inc(values ...string) {
+	c.Add(1, values...)
+}
+
+// Add adds v, which must not be negative, to the counter of the label values
+func (c *CounterVec) Add(v float64, values ...string) {
+	if v < 0 {
+		return
+	}
+	c.f.mu.Lock()
+	c.f.get(values).value += v
+	c.f.mu.Unlock()
+}
+
+// GaugeVec holds values that go up and down, split by label values
+type GaugeVec struct{ f *family }
+
+// Gauge returns the gauge called name, registering it on first use
+func (reg *Registry) Gauge(name, help string, labels ...string) *GaugeVec {
+	return &GaugeVec{reg.register(name, help, "gauge", nil, labels)}
+}
+
+// Set sets the gauge of the label values to v
+func (g *GaugeVec) Set(v float64, values ...string) {
+	g.f.mu.Lock()
+	g.f.get(values).value = v
+	g.f.mu.Unlock()
+}
+
+// Add adds v to the gauge of the label values
+func (g *GaugeVec) Add(v float64, values ...string) {
+	g.f.mu.Lock()
+	g.f.get(values).value += v
+	g.f.mu.Unlock()
+}
+
+// GaugeFunc registers a gauge whose values are read from collect on every
+// scrape. collect calls set once per series. Registering the name again
+// replaces collect.
+func (reg *Registry) GaugeFunc(name, help string, collect func(set func(v float64, values ...string)), labels ...string) {
+	f := reg.register(name, help, "gauge", nil, labels)
+	f.mu.Lock()
+	f.collect = collect
+	f.mu.Unlock()
+}
+
+// HistogramVec counts observations, such as latencies, into buckets
+type HistogramVec struct{ f *family }
+
+// Histogram returns the histogram called name, registering it on first use.
+// buckets are the upper bounds, in increasing order; +Inf is implied.
+func (reg *Registry) Histogram(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	buckets = append([]float64(nil), buckets...)
+	sort.Float64s(buckets)
+	return &HistogramVec{reg.register(name, help, "histogram", buckets, labels)}
+}
+
+// Observe records v for the label values
+func (h *HistogramVec) Observe(v float64, values ...string) {
+	h.f.mu.Lock()
+	defer h.f.mu.Unlock()
+	s := h.f.get(values)
+	if i := sort.SearchFloat64s(h.f.buckets, v); i < len(s.counts) {
+		s.counts[i]++
+	}
+	s.sum += v
+	s.count++
+}
+
+// Counter returns a counter of the Default registry
+func Counter(name, help string, labels ...string) *CounterVec {
+	return Default.Counter(name, help, labels...)
+}
+
+// Gauge returns a gauge of the Default registry
+func Gauge(name, help string, labels ...string) *GaugeVec {
+	return Default.Gauge(name, help, labels...)
+}
+
+// GaugeFunc registers a gauge function with the Default registry
+func GaugeFunc(name, help string, collect func(set func(v float64, values ...string)), labels ...string) {
+	Default.GaugeFunc(name, help, collect, labels...)
+}
+
+// Histogram returns a histogram of the Default registry
+func Histogram(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	return Default.Histogram(name, help, buckets, labels...)
+}
+
+// WriteText writes every metric in the Prometheus text exposition format,
+// families sorted by name and series by label values
+func (reg *Registry) WriteText(w io.Writer) error {
+	reg.mu.Lock()
+	families := make([]*family, 0, len(reg.families))
+	for _, f := range reg.families {
+		families = append(families, f)
+	}
+	reg.mu.Unlock()
+	sort.Slice(families, func(i, j int) bool { return families[i].name < families[j].name })
+
+	bw := bufio.NewWriter(w)
+	for _, f := range families {
+		f.write(bw)
+	}
+	return bw.Flush()
+}
+
+func (f *family) write(w *bufio.Writer) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	series := f.snapshot()
+	if len(series) == 0 {
+		return
+	}
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", f.name, escapeHelp(f.help), f.name, f.kind)
+	for _, s := range series {
+		if f.kind != "histogram" {
+			fmt.Fprintf(w, "%s%s %s\n", f.name, formatLabels(f.labels, s.labels, "", 0), formatValue(s.value))
+			continue
+		}
+		var cumulative uint64
+		for i, bound := range f.buckets {
+			cumulative += s.counts[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", f.name, formatLabels(f.labels, s.labels, "le", bound), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", f.name, formatLabels(f.labels, s.labels, "le", math.Inf(1)), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", f.name, formatLabels(f.labels, s.labels, "", 0), formatValue(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", f.name, formatLabels(f.labels, s.labels, "", 0), s.count)
+	}
+}
+
+// snapshot returns the series sorted by label values, collected afresh for
+// gauge functions
+func (f *family) snapshot() []*series {
+	if f.collect != nil {
+		f.series = map[string]*series{}
+		f.collect(func(v float64, values ...string) { f.get(values).value = v })
+	}
+	series := make([]*series, 0, len(f.series))
+	for _, s := range f.series {
+		series = append(series, s)
+	}
+	sort.Slice(series, func(i, j int) bool {
+		return strings.Join(series[i].labels, "\xff") < strings.Join(series[j].labels, "\xff")
+	})
+	return series
+}
+
+func formatLabels(names, values []string, extra string, extraValue float64) string {
+	if len(names) == 0 && extra == "" {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, name := range names {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(name + `="` + escapeLabel(values[i]) + `"`)
+	}
+	if extra != "" {
+		if len(names) > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(extra + `="` + formatValue(extraValue) + `"`)
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var (
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func escapeHelp(s string) string {
+	return helpEscaper.Replace(s)
+}
+
+// escapeLabel escapes a label value for the text format
+func escapeLabel(s string) string {
+	return labelEscaper.Replace(s)
+}
+
+// Handler serves the Default registry
+func Handler() http.Handler {
+	return Default.Handler()
+}
+
+// Handler serves the registry in the Prometheus text format
+func (reg *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		reg.WriteText(w) // only fails once the scraper has gone
+	})
+}
@@ -0,0 +1,80 @@
+package metrics_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"e.coding.net/Love54dj/weizhong/etc/metrics"
+)
+
+func TestWriteText(t *testing.T) {
+	reg := metrics.NewRegistry()
+	requests := reg.Counter("requests_total", "Requests.", "route", "code")
+	requests.Inc("/b", "200")
+	requests.Inc("/a", "500")
+	requests.Add(2, "/a", "500")
+	reg.Gauge("queue_length", "Queued\njobs.").Set(3)
+	reg.GaugeFunc("state", "State.", func(set func(float64, ...string)) { set(2, `say "hi"`) }, "name")
+	latency := reg.Histogram("latency_seconds", "Latency.", []float64{0.1, 1}, "route")
+	latency.Observe(0.05, "/a")
+	latency.Observe(0.5, "/a")
+	latency.Observe(3, "/a")
+	reg.Counter("unused_total", "Never incremented.")
+
+	var b strings.Builder
+	if err := reg.WriteText(&b); err != nil {
+		t.Fatal(err)
+	}
+	want := `# HELP latency_seconds Latency.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{route="/a",le="0.1"} 1
+latency_seconds_bucket{route="/a",le="1"} 2
+latency_seconds_bucket{route="/a",le="+Inf"} 3
+latency_seconds_sum{route="/a"} 3.55
+latency_seconds_count{route="/a"} 3
+# HELP queue_length Queued\njobs.
+# TYPE queue_length gauge
+queue_length 3
+# HELP requests_total Requests.
+# TYPE requests_total counter
+requests_total{route="/a",code="500"} 3
+requests_total{route="/b",code="200"} 1
+# HELP state State.
+# TYPE state gauge
+state{name="say \"hi\""} 2
+`
+	if got := b.String(); got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestInstrumentClient(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	}))
+	defer upstream.Close()
+
+	client := metrics.InstrumentClient("test", &http.Client{})
+	resp, err := client.Get(upstream.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if _, err := client.Get("http://127.0.0.1:1"); err == nil {
+		t.Fatal("expected a connection error")
+	}
+
+	rec := httptest.NewRecorder()
+	metrics.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	for _, want := range []string{
+		`outbound_requests_total{client="test",method="GET",code="418"} 1`,
+		`outbound_requests_total{client="test",method="GET",code="error"} 1`,
+		`outbound_request_duration_seconds_count{client="test",method="GET"} 2`,
+	} {
+		if !strings.Contains(rec.Body.String(), want) {
+			t.Errorf("missing %s in\n%s", want, rec.Body)
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+)
+
+var (
+	outboundRequests = Counter("outbound_requests_total",
+		"HTTP requests sent to other services, by client, method and status code (error for transport errors).",
+		"client", "method", "code")
+	outboundDuration = Histogram("outbound_request_duration_seconds",
+		"Time until other services returned response headers, by client and method.",
+		DefBuckets, "client", "method")
+)
+
+// transport counts the requests of one named client
+type transport struct {
+	client string
+	next   http.RoundTripper
+}
+
+// InstrumentTransport returns a RoundTripper recording the requests it sends
+// through next, http.DefaultTransport when nil, as outbound_requests_total
+// and outbound_request_duration_seconds labelled with client
+func InstrumentTransport(client string, next http.RoundTripper) http.RoundTripper {
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	return &transport{client: client, next: next}
+}
+
+// InstrumentClient wraps the transport of c with InstrumentTransport and
+// returns c
+func InstrumentClient(client string, c *http.Client) *http.Client {
+	c.Transport = InstrumentTransport(client, c.Transport)
+	return c
+}
+
+func (t *transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := t.next.RoundTrip(req)
+	outboundDuration.Observe(time.Since(start).Seconds(), t.client, req.Method)
+	code := "error"
+	if err == nil {
+		code = strconv.Itoa(resp.StatusCode)
+	}
+	outboundRequests.Inc(t.client, req.Method, code)
+	return resp, err
+}
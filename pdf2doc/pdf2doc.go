@@ -14,6 +14,8 @@ import (
 	"path"
 	"strings"
 	"time"
+
+	"e.coding.net/Love54dj/weizhong/etc/metrics"
 )
 
 const apiURL = "https://solution.wps.cn"
@@ -25,6 +27,8 @@ var cachePath string
 var notInitialized bool = true
 var defaultError = errors.New("Please run pdf2doc.Init()")
 
+var client = metrics.InstrumentClient("wps", &http.Client{})
+
 func Init(WpsCachePath string, WpsAppid string, WpsAppsecret string) (err error) {
 	appID = WpsAppid
 	appSecret = WpsAppsecret
@@ -85,7 +89,6 @@ func IsExpired(err error) bool {
 
 func sendHttpRequest(req *http.Request) (responseBody []byte, err error) {
 	// 发送 HTTP 请求
-	client := &http.Client{}
 	resp, err := client.Do(req)
 	if err != nil {
 		err = fmt.Errorf("failed to send request: %v", err)
@@ -193,7 +196,7 @@ func downloadFile(url string, filepath string) error {
 	}
 	defer out.Close()
 	// Get the response
-	resp, err := http.Get(url)
+	resp, err := client.Get(url)
 	if err != nil {
 		return err
 	}
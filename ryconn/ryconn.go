@@ -3,20 +3,40 @@ package ryconn
 import (
 	"encoding/json"
 	"errors"
+	"io"
 	"net/http"
 	"strings"
+	"time"
+
+	"e.coding.net/Love54dj/weizhong/etc/metrics"
 )
 
 var loginUrl string = "https://lawyer.dlaws.cn:9900/api/lawyer/master/system/loginInfo"
 
+var client = metrics.InstrumentClient("ruoyi", &http.Client{Timeout: 10 * time.Second})
+
 func Init(loginInfoUrl string) {
 	loginUrl = loginInfoUrl
 }
 
 func AuthToMobile(autoToken string) (mobile string, err error) {
-	// access loginUrl with autoToken as header: Authorization
-	client := &http.Client{}
-	req, err := http.NewRequest("GET", loginUrl, nil)
+	user, err := LoginInfo(autoToken)
+	if err != nil {
+		return
+	}
+	mobile = user.Mobile
+	return
+}
+
+// LoginInfo returns the user logged in with autoToken
+func LoginInfo(autoToken string) (user RuoyiUserData, err error) {
+	return LoginInfoFrom(loginUrl, autoToken)
+}
+
+// LoginInfoFrom is LoginInfo against an explicit loginInfo endpoint
+func LoginInfoFrom(loginInfoUrl string, autoToken string) (user RuoyiUserData, err error) {
+	// access loginInfoUrl with autoToken as header: Authorization
+	req, err := http.NewRequest("GET", loginInfoUrl, nil)
 	if err != nil {
 		return
 	}
@@ -30,9 +50,17 @@ func AuthToMobile(autoToken string) (mobile string, err error) {
 		return
 	}
 	defer resp.Body.Close()
-	// parse response body
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return
+	}
+	return ParseLoginInfo(body)
+}
+
+// ParseLoginInfo returns the user of a loginInfo response body
+func ParseLoginInfo(body []byte) (user RuoyiUserData, err error) {
 	respStruct := RuoyiResponse{}
-	err = json.NewDecoder(resp.Body).Decode(&respStruct)
+	err = json.Unmarshal(body, &respStruct)
 	if err != nil {
 		return
 	}
@@ -40,10 +68,10 @@ func AuthToMobile(autoToken string) (mobile string, err error) {
 		err = errors.New(respStruct.Msg)
 		return
 	}
-	mobile = respStruct.Data.Mobile
-	if mobile == "" {
+	if respStruct.Data.Mobile == "" {
 		err = errors.New("Not logged in.")
 		return
 	}
+	user = respStruct.Data
 	return
 }
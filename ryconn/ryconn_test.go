@@ -0,0 +1,36 @@
+package ryconn_test
+
+import (
+	"testing"
+
+	"e.coding.net/Love54dj/weizhong/etc/ryconn"
+	"e.coding.net/Love54dj/weizhong/etc/ryfake"
+)
+
+func TestLoginInfo(t *testing.T) {
+	ry := ryfake.NewServer()
+	defer ry.Close()
+	ryconn.Init(ry.LoginInfoURL())
+
+	tests := []struct {
+		token   string
+		mobile  string
+		wantErr bool
+	}{
+		{"token-1001", "13800001001", false},
+		{"Bearer token-1002", "13800001002", false},
+		{"unknown", "", true},
+		{"", "", true},
+	}
+	for _, tt := range tests {
+		mobile, err := ryconn.AuthToMobile(tt.token)
+		if (err != nil) != tt.wantErr || mobile != tt.mobile {
+			t.Errorf("%q: got %q, %v", tt.token, mobile, err)
+		}
+	}
+
+	user, err := ryconn.LoginInfoFrom(ry.LoginInfoURL(), "token-132")
+	if err != nil || user.ID != 132 || user.LawyerID != 132 {
+		t.Errorf("lawyer: got %+v, %v", user, err)
+	}
+}
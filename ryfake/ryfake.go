@@ -0,0 +1,266 @@
+// Package ryfake is an in-process stand-in for the RuoYi backend. It serves
+// the endpoints forward and ryconn call from seeded users and tokens, so both
+// can be exercised without reaching the real hosts.
+package ryfake
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"e.coding.net/Love54dj/weizhong/etc/ryconn"
+)
+
+// User is a RuoYi account together with the token it is logged in with
+type User struct {
+	Token string
+	ryconn.RuoyiUserData
+}
+
+// DefaultUsers are seeded when New is given no users
+var DefaultUsers = []User{
+	{Token: "token-1001", RuoyiUserData: ryconn.RuoyiUserData{
+		ID: 1001, Type: "user", Nickname: "张三", Mobile: "13800001001", ChannelID: 3,
+		CreatedAt: "2024-01-01 00:00:00", UpdatedAt: "2024-01-01 00:00:00",
+	}},
+	{Token: "token-1002", RuoyiUserData: ryconn.RuoyiUserData{
+		ID: 1002, Type: "user", Nickname: "李四", Mobile: "13800001002", ChannelID: 5, MediateID: 9,
+		CreatedAt: "2024-01-01 00:00:00", UpdatedAt: "2024-01-01 00:00:00",
+	}},
+	{Token: "token-132", RuoyiUserData: ryconn.RuoyiUserData{
+		ID: 132, LawyerID: 132, Type: "lawyer", Nickname: "王律师", Mobile: "13800000132",
+		CreatedAt: "2024-01-01 00:00:00", UpdatedAt: "2024-01-01 00:00:00",
+	}},
+}
+
+// Message is a chat message as /system/message stores it
+type Message struct {
+	ID         int64  `json:"id"`
+	MsgText    string `json:"msgText"`
+	MsgType    int    `json:"msgType"`
+	SenderID   string `json:"senderId"`
+	SourceType int    `json:"sourceType"`
+	UserID     int    `json:"userId"`
+	CreatedAt  string `json:"createdAt"`
+}
+
+// Request is a request the backend received
+type Request struct {
+	Method string
+	Path   string
+	Query  string
+	Header http.Header
+	Body   []byte
+}
+
+// SenderID is the sender ID of a user in the kind ("digital", "mediate", ...)
+// of session with lawyerID
+func SenderID(kind string, userID int, lawyerID string) string {
+	return fmt.Sprintf("%s-%d-%s", kind, userID, lawyerID)
+}
+
+// Backend answers like RuoYi: errors are reported with HTTP 200 and the code
+// of the {code,msg} body, except for unknown paths. It is safe for concurrent
+// use.
+type Backend struct {
+	mux *http.ServeMux
+
+	mu       sync.Mutex
+	users    map[string]*User // by token
+	messages []Message
+	requests []Request
+}
+
+// New returns a backend with the given users, DefaultUsers when there are
+// none
+func New(users ...User) *Backend {
+	if len(users) == 0 {
+		users = DefaultUsers
+	}
+	b := &Backend{mux: http.NewServeMux(), users: map[string]*User{}}
+	for _, u := range users {
+		b.AddUser(u)
+	}
+	b.mux.HandleFunc("GET /system/loginInfo", b.loginInfo)
+	b.mux.HandleFunc("GET /system/session/{kind}/{userId}/{lawyerId}", b.session)
+	b.mux.HandleFunc("POST /system/message", b.postMessage)
+	b.mux.HandleFunc("GET /system/message/list", b.listMessages)
+	b.mux.HandleFunc("POST /logout", b.logout)
+	return b
+}
+
+// AddUser logs u in with u.Token
+func (b *Backend) AddUser(u User) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.users[u.Token] = &u
+}
+
+// Messages returns the messages posted by senderID, all of them when it is
+// empty
+func (b *Backend) Messages(senderID string) []Message {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var messages []Message
+	for _, m := range b.messages {
+		if senderID == "" || m.SenderID == senderID {
+			messages = append(messages, m)
+		}
+	}
+	return messages
+}
+
+// Requests returns the requests received so far, oldest first
+func (b *Backend) Requests() []Request {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]Request(nil), b.requests...)
+}
+
+func (b *Backend) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	b.mu.Lock()
+	b.requests = append(b.requests, Request{
+		Method: r.Method,
+		Path:   r.URL.Path,
+		Query:  r.URL.RawQuery,
+		Header: r.Header.Clone(),
+		Body:   body,
+	})
+	b.mu.Unlock()
+	b.mux.ServeHTTP(w, r)
+}
+
+// ajaxResult is RuoYi's AjaxResult
+type ajaxResult struct {
+	Code int    `json:"code"`
+	Msg  string `json:"msg"`
+	Data any    `json:"data,omitempty"`
+}
+
+// tableDataInfo is RuoYi's paged list result
+type tableDataInfo struct {
+	Total int       `json:"total"`
+	Rows  []Message `json:"rows"`
+	Code  int       `json:"code"`
+	Msg   string    `json:"msg"`
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json;charset=UTF-8")
+	json.NewEncoder(w).Encode(v)
+}
+
+// caller returns the user logged in with the request's token, answering
+// 401 in the body when there is none
+func (b *Backend) caller(w http.ResponseWriter, r *http.Request) *User {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	b.mu.Lock()
+	u := b.users[token]
+	b.mu.Unlock()
+	if token == "" || u == nil {
+		writeJSON(w, ajaxResult{Code: http.StatusUnauthorized, Msg: "认证失败，无法访问系统资源"})
+		return nil
+	}
+	return u
+}
+
+func (b *Backend) loginInfo(w http.ResponseWriter, r *http.Request) {
+	if u := b.caller(w, r); u != nil {
+		writeJSON(w, ajaxResult{Code: http.StatusOK, Msg: "操作成功", Data: u.RuoyiUserData})
+	}
+}
+
+func (b *Backend) session(w http.ResponseWriter, r *http.Request) {
+	u := b.caller(w, r)
+	if u == nil {
+		return
+	}
+	userID, err := strconv.Atoi(r.PathValue("userId"))
+	if err != nil || userID != u.ID {
+		writeJSON(w, ajaxResult{Code: http.StatusForbidden, Msg: "没有权限，请联系管理员授权"})
+		return
+	}
+	lawyerID := r.PathValue("lawyerId")
+	writeJSON(w, ajaxResult{Code: http.StatusOK, Msg: "操作成功", Data: map[string]any{
+		"userId":   userID,
+		"lawyerId": lawyerID,
+		"senderId": SenderID(r.PathValue("kind"), userID, lawyerID),
+	}})
+}
+
+func (b *Backend) postMessage(w http.ResponseWriter, r *http.Request) {
+	if b.caller(w, r) == nil {
+		return
+	}
+	var m Message
+	if err := json.NewDecoder(r.Body).Decode(&m); err != nil {
+		writeJSON(w, ajaxResult{Code: http.StatusInternalServerError, Msg: "请求参数格式错误"})
+		return
+	}
+	if m.MsgText == "" || m.SenderID == "" {
+		writeJSON(w, ajaxResult{Code: http.StatusInternalServerError, Msg: "消息内容和发送人不能为空"})
+		return
+	}
+	b.mu.Lock()
+	m.ID = int64(len(b.messages) + 1)
+	m.CreatedAt = time.Now().Format(time.DateTime)
+	b.messages = append(b.messages, m)
+	b.mu.Unlock()
+	writeJSON(w, ajaxResult{Code: http.StatusOK, Msg: "操作成功", Data: m.ID})
+}
+
+func (b *Backend) listMessages(w http.ResponseWriter, r *http.Request) {
+	if b.caller(w, r) == nil {
+		return
+	}
+	query := r.URL.Query()
+	pageNum, _ := strconv.Atoi(query.Get("pageNum"))
+	pageSize, _ := strconv.Atoi(query.Get("pageSize"))
+	if pageNum < 1 {
+		pageNum = 1
+	}
+	if pageSize < 1 {
+		pageSize = 10
+	}
+	messages := b.Messages(query.Get("senderId"))
+	rows := []Message{}
+	if start := (pageNum - 1) * pageSize; start < len(messages) {
+		rows = messages[start:min(start+pageSize, len(messages))]
+	}
+	writeJSON(w, tableDataInfo{Total: len(messages), Rows: rows, Code: http.StatusOK, Msg: "查询成功"})
+}
+
+func (b *Backend) logout(w http.ResponseWriter, r *http.Request) {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	b.mu.Lock()
+	delete(b.users, token)
+	b.mu.Unlock()
+	writeJSON(w, ajaxResult{Code: http.StatusOK, Msg: "退出成功"})
+}
+
+// Server is a Backend listening on a local port, for tests
+type Server struct {
+	*httptest.Server
+	Backend *Backend
+}
+
+// NewServer starts a backend with the given users, DefaultUsers when there
+// are none. Close it when done.
+func NewServer(users ...User) *Server {
+	b := New(users...)
+	return &Server{Server: httptest.NewServer(b), Backend: b}
+}
+
+// LoginInfoURL is the loginInfo endpoint of the server
+func (s *Server) LoginInfoURL() string {
+	return s.URL + "/system/loginInfo"
+}
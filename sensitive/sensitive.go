@@ -0,0 +1,174 @@
+// Package sensitive finds words of a categorised dictionary in text with an
+// Aho-Corasick automaton, so scanning costs the same however many words the
+// dictionary holds.
+package sensitive
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"unicode"
+)
+
+// Entry is a dictionary word and its category
+type Entry struct {
+	Word     string
+	Category string
+}
+
+// Match is an occurrence of a dictionary word. Start and End are rune offsets
+// into the scanned text.
+type Match struct {
+	Start, End int
+	Entry
+}
+
+// Matcher scans text for the words it was built from, ignoring case. It is
+// safe for concurrent use.
+type Matcher struct {
+	nodes   []node
+	entries []Entry
+}
+
+type node struct {
+	next map[rune]int32
+	fail int32
+	out  []int32 // entries ending here, including those reached through fail
+}
+
+// NewMatcher builds a matcher for entries. Empty words are ignored.
+func NewMatcher(entries []Entry) *Matcher {
+	m := &Matcher{nodes: []node{{}}}
+	for _, e := range entries {
+		word := []rune(e.Word)
+		if len(word) == 0 {
+			continue
+		}
+		cur := int32(0)
+		for _, c := range word {
+			c = unicode.ToLower(c)
+			next, ok := m.nodes[cur].next[c]
+			if !ok {
+				next = int32(len(m.nodes))
+				m.nodes = append(m.nodes, node{})
+				if m.nodes[cur].next == nil {
+					m.nodes[cur].next = map[rune]int32{}
+				}
+				m.nodes[cur].next[c] = next
+			}
+			cur = next
+		}
+		m.nodes[cur].out = append(m.nodes[cur].out, int32(len(m.entries)))
+		m.entries = append(m.entries, e)
+	}
+
+	// Breadth first, so the fail target of a node is complete before its children
+	queue := make([]int32, 0, len(m.nodes))
+	for _, child := range m.nodes[0].next {
+		queue = append(queue, child)
+	}
+	for len(queue) > 0 {
+		cur := queue[0]
+		queue = queue[1:]
+		for c, child := range m.nodes[cur].next {
+			fail := m.nodes[cur].fail
+			for fail != 0 && !m.has(fail, c) {
+				fail = m.nodes[fail].fail
+			}
+			if target, ok := m.nodes[fail].next[c]; ok && target != child {
+				m.nodes[child].fail = target
+			}
+			m.nodes[child].out = append(m.nodes[child].out, m.nodes[m.nodes[child].fail].out...)
+			queue = append(queue, child)
+		}
+	}
+	return m
+}
+
+func (m *Matcher) has(n int32, c rune) bool {
+	_, ok := m.nodes[n].next[c]
+	return ok
+}
+
+// Len returns the number of words in the matcher
+func (m *Matcher) Len() int {
+	return len(m.entries)
+}
+
+// FindAll returns every occurrence of a dictionary word in text, overlapping
+// ones included, ordered by where they end
+func (m *Matcher) FindAll(text string) []Match {
+	var matches []Match
+	cur := int32(0)
+	pos := 0
+	for _, c := range text {
+		c = unicode.ToLower(c)
+		for cur != 0 && !m.has(cur, c) {
+			cur = m.nodes[cur].fail
+		}
+		cur = m.nodes[cur].next[c] // the root when there is no transition
+		pos++
+		for _, idx := range m.nodes[cur].out {
+			e := m.entries[idx]
+			n := len([]rune(e.Word))
+			matches = append(matches, Match{Start: pos - n, End: pos, Entry: e})
+		}
+	}
+	return matches
+}
+
+// Mask replaces the runes covered by matches with mask
+func Mask(text string, matches []Match, mask rune) string {
+	if len(matches) == 0 {
+		return text
+	}
+	runes := []rune(text)
+	for _, match := range matches {
+		for i := match.Start; i < match.End && i < len(runes); i++ {
+			runes[i] = mask
+		}
+	}
+	return string(runes)
+}
+
+// ParseDictionary reads a word list with one word per line. Lines of the form
+// [category] set the category of the words below them, lines starting with #
+// are comments.
+func ParseDictionary(r io.Reader) ([]Entry, error) {
+	var entries []Entry
+	category := ""
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		switch {
+		case text == "" || strings.HasPrefix(text, "#"):
+		case strings.HasPrefix(text, "["):
+			if !strings.HasSuffix(text, "]") || len(text) < 3 {
+				return nil, fmt.Errorf("line %d: invalid category %q", line, text)
+			}
+			category = strings.TrimSpace(text[1 : len(text)-1])
+		default:
+			if category == "" {
+				return nil, fmt.Errorf("line %d: word %q outside a [category]", line, text)
+			}
+			entries = append(entries, Entry{Word: text, Category: category})
+		}
+	}
+	return entries, scanner.Err()
+}
+
+// LoadFile builds a matcher from the dictionary file at path
+func LoadFile(path string) (*Matcher, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	entries, err := ParseDictionary(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return NewMatcher(entries), nil
+}
@@ -0,0 +1,50 @@
+package sensitive_test
+
+import (
+	"strings"
+	"testing"
+
+	"e.coding.net/Love54dj/weizhong/etc/sensitive"
+)
+
+func TestFindAll(t *testing.T) {
+	entries, err := sensitive.ParseDictionary(strings.NewReader(`
+# test dictionary
+[abuse]
+傻瓜
+he
+[contact]
+微信号
+she
+hers
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := sensitive.NewMatcher(entries)
+
+	matches := m.FindAll("Ushers 你这个傻瓜，加我微信号")
+	var got []string
+	for _, match := range matches {
+		got = append(got, match.Category+":"+match.Word)
+	}
+	want := "contact:she,abuse:he,contact:hers,abuse:傻瓜,contact:微信号"
+	if strings.Join(got, ",") != want {
+		t.Errorf("got %v, want %s", got, want)
+	}
+
+	if masked := sensitive.Mask("你这个傻瓜", m.FindAll("你这个傻瓜"), '*'); masked != "你这个**" {
+		t.Errorf("masked %q", masked)
+	}
+	if len(m.FindAll("nothing to see")) != 0 {
+		t.Error("unexpected match")
+	}
+}
+
+func TestParseDictionaryErrors(t *testing.T) {
+	for _, dict := range []string{"word without category", "[]\nword", "[abuse\nword"} {
+		if _, err := sensitive.ParseDictionary(strings.NewReader(dict)); err == nil {
+			t.Errorf("%q: expected an error", dict)
+		}
+	}
+}
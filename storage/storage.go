@@ -13,6 +13,7 @@ import (
 	"strings"
 	"time"
 
+	"e.coding.net/Love54dj/weizhong/etc/metrics"
 	"github.com/tencentyun/cos-go-sdk-v5"
 )
 
@@ -47,6 +48,7 @@ func Init(SecretID string, SecretKey string, bucket string, region string, front
 			//如实填写账号和密钥，也可以设置为环境变量
 			SecretID:  SecretID,
 			SecretKey: SecretKey,
+			Transport: metrics.InstrumentTransport("cos", nil),
 		},
 	})
 	_, err = cosClient.Object.Put(ctx, filenameAccessCheck, io.NopCloser(strings.NewReader(time.Now().String())), nil)
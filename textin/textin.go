@@ -8,6 +8,7 @@ import (
 	"os"
 	"time"
 
+	"e.coding.net/Love54dj/weizhong/etc/metrics"
 	"github.com/google/go-querystring/query"
 )
 
@@ -89,7 +90,7 @@ func (ocr *TextinOcr) recognizePDF2MD(image []byte, options Options, isUrl bool)
 	q, _ := query.Values(options)
 	req.URL.RawQuery = q.Encode()
 
-	client := &http.Client{}
+	client := metrics.InstrumentClient("textin", &http.Client{})
 	return client.Do(req)
 }
 